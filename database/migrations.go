@@ -2,7 +2,10 @@ package database
 
 import (
 	"embed"
+	"io/fs"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database"
@@ -35,8 +38,34 @@ func RunMigrationsPostgreSQL(db *sqlx.DB) error {
 	return RunMigrations(targetInstance, "postgres")
 }
 
+// LatestVersion returns the version of the newest migration for the database, which is "sqlite"
+// or "postgres".
+func LatestVersion(databaseName string) (int, error) {
+	entries, err := fs.ReadDir(migrations, "migrations/"+databaseName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read migrations for %s", databaseName)
+	}
+
+	latest := 0
+
+	for _, entry := range entries {
+		versionPart := strings.SplitN(entry.Name(), "_", 2)[0]
+
+		version, err := strconv.Atoi(versionPart)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid migration file name %s", entry.Name())
+		}
+
+		if version > latest {
+			latest = version
+		}
+	}
+
+	return latest, nil
+}
+
 func RunMigrations(driver database.Driver, databaseName string) error {
-	sourceInstance, err := httpfs.New(http.FS(migrations), "migrations")
+	sourceInstance, err := httpfs.New(http.FS(migrations), "migrations/"+databaseName)
 	if err != nil {
 		return errors.Wrap(err, "invalid source instance")
 	}
@@ -0,0 +1 @@
+ALTER TABLE transactions ALTER COLUMN data_bytes TYPE BIGINT;
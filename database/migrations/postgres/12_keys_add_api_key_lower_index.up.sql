@@ -0,0 +1 @@
+CREATE INDEX keys_api_key_lower_idx ON keys (LOWER(api_key));
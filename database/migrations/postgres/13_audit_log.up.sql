@@ -0,0 +1,8 @@
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TEXT NOT NULL,
+    operation TEXT NOT NULL,
+    target_id TEXT NOT NULL,
+    actor TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);
@@ -0,0 +1,9 @@
+CREATE FUNCTION notify_transaction_inserted() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('transactions_inserted', NEW.id);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER transactions_notify_insert AFTER INSERT ON transactions
+    FOR EACH ROW EXECUTE PROCEDURE notify_transaction_inserted();
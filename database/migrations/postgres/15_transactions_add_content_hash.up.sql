@@ -0,0 +1,2 @@
+ALTER TABLE transactions ADD COLUMN content_hash TEXT NOT NULL DEFAULT '';
+CREATE INDEX transactions_api_key_content_hash_idx ON transactions (api_key, content_hash);
@@ -0,0 +1 @@
+ALTER TABLE transactions ADD COLUMN replaced_by TEXT;
@@ -0,0 +1,2 @@
+ALTER TABLE transactions ADD COLUMN idempotency_key TEXT;
+CREATE UNIQUE INDEX transactions_idempotency_key_idx ON transactions (idempotency_key);
@@ -0,0 +1,5 @@
+CREATE TABLE proofs (
+    txid TEXT PRIMARY KEY,
+    created_at TEXT NOT NULL,
+    proof BYTEA NOT NULL
+);
@@ -0,0 +1,5 @@
+CREATE TABLE payloads (
+    txid TEXT PRIMARY KEY,
+    created_at TEXT NOT NULL,
+    payload BYTEA NOT NULL
+);
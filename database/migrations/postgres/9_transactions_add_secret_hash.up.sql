@@ -0,0 +1 @@
+ALTER TABLE transactions ADD COLUMN secret_hash TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE keys ADD COLUMN revoked_reason TEXT;
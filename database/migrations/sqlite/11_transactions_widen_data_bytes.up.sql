@@ -0,0 +1,2 @@
+-- SQLite INTEGER columns already store 64 bit values, this migration only keeps the versions in line with PostgreSQL
+SELECT 1;
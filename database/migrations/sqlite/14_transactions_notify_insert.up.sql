@@ -0,0 +1,2 @@
+-- SQLite has no notifications, this migration only keeps the versions in line with PostgreSQL
+SELECT 1;
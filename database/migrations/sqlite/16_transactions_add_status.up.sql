@@ -0,0 +1,5 @@
+ALTER TABLE transactions ADD COLUMN status TEXT NOT NULL DEFAULT 'pending';
+ALTER TABLE transactions ADD COLUMN status_at TEXT;
+-- The transactions stored so far have all been broadcast
+UPDATE transactions SET status = 'broadcast';
+CREATE INDEX transactions_status_idx ON transactions (status);
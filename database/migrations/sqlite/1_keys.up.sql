@@ -0,0 +1,6 @@
+CREATE TABLE keys (
+ api_key TEXT NOT NULL PRIMARY KEY,
+ private_key TEXT NOT NULL,
+ public_key TEXT NOT NULL,
+ address TEXT NOT NULL
+);
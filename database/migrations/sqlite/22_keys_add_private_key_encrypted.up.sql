@@ -0,0 +1 @@
+ALTER TABLE keys ADD COLUMN private_key_encrypted INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+CREATE INDEX transactions_created_at_idx ON transactions (created_at);
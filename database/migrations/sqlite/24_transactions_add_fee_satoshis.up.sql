@@ -0,0 +1 @@
+ALTER TABLE transactions ADD COLUMN fee_satoshis INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+CREATE TABLE transactions (
+    id TEXT PRIMARY KEY
+);
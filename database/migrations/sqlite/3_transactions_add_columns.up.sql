@@ -0,0 +1 @@
+ALTER TABLE transactions ADD api_key TEXT;
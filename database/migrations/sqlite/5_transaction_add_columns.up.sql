@@ -0,0 +1,2 @@
+ALTER TABLE transactions ADD COLUMN data_bytes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN created_at TEXT NOT NULL DEFAULT '1970-01-01T00:00:00.000Z'
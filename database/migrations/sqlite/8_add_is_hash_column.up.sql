@@ -0,0 +1 @@
+ALTER TABLE transactions ADD COLUMN is_hash INTEGER NOT NULL DEFAULT 0;
@@ -8,10 +8,15 @@ import (
 	"github.com/pkg/errors"
 )
 
+// PostgreSqlConnectionString returns the connection string used by GetPostgreSqlDB.
+func PostgreSqlConnectionString(dbHost string, dbPort int, dbUser, dbPassword, dbName string) string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", dbHost, dbPort, dbUser, dbPassword, dbName)
+}
+
 func GetPostgreSqlDB(dbHost string, dbPort int, dbUser, dbPassword, dbName string) (*sqlx.DB, error) {
 	var sqlDB *sql.DB
 
-	connectionString := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", dbHost, dbPort, dbUser, dbPassword, dbName)
+	connectionString := PostgreSqlConnectionString(dbHost, dbPort, dbUser, dbPassword, dbName)
 
 	sqlDB, err := sql.Open("postgres", connectionString)
 	if err != nil {
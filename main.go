@@ -127,7 +127,13 @@ func startServer(db *sqlx.DB) error {
 	}
 
 	client := client.New(settings.Get("taalUrl"), timeout)
-	repo := repository.NewRepository(db, time.Now)
+
+	schemaVersion, err := database.LatestVersion(settings.Get("dbType"))
+	if err != nil {
+		return errors.Wrap(err, "failed to get schema version")
+	}
+
+	repo := repository.NewRepository(db, time.Now, repository.WithSchemaVersionCheck(schemaVersion))
 
 	// move keys from the key json files to the database. Once all active customers ran this code it can be removed
 	ctx := context.Background()
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+// aggregateExpressions are the allowed aggregates. The sum and average are cast so that both
+// databases return them as numbers of the same type.
+var aggregateExpressions = map[server.Aggregate]string{
+	server.AggregateCount:        `count(*)`,
+	server.AggregateSumDataBytes: `CAST(COALESCE(SUM(data_bytes), 0) AS BIGINT)`,
+	server.AggregateAvgDataBytes: `CAST(AVG(data_bytes) AS DOUBLE PRECISION)`,
+	server.AggregateMaxDataBytes: `MAX(data_bytes)`,
+	server.AggregateActiveKeys:   `count(DISTINCT api_key)`,
+}
+
+// dimensionExpressions are the allowed dimensions to group by.
+var dimensionExpressions = map[server.AggregateDimension]string{
+	server.DimensionApiKey: `api_key`,
+	server.DimensionIsHash: `is_hash`,
+	server.DimensionStatus: `status`,
+	server.DimensionDay:    `SUBSTR(created_at, 1, 10)`,
+}
+
+// RunAggregate computes the aggregate of spec over the transactions in its time window. Each row
+// holds the aggregate as "value" and, if spec groups the transactions, the value of the dimension
+// under its name, ordered by it. The query is only built from the allowed aggregates and
+// dimensions, for anything else server.ErrInvalidAggregate is returned.
+func (r Repository) RunAggregate(ctx context.Context, spec server.AggregateSpec) ([]map[string]interface{}, error) {
+	aggregate, ok := aggregateExpressions[spec.Aggregate]
+	if !ok {
+		return nil, errors.Wrapf(server.ErrInvalidAggregate, "unknown aggregate %q", spec.Aggregate)
+	}
+
+	err := validateRange(spec.From, spec.To)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + aggregate + ` AS value FROM transactions WHERE created_at >= $1 AND created_at < $2 AND ` + notReserving + `;`
+
+	if spec.GroupBy != server.DimensionNone {
+		dimension, ok := dimensionExpressions[spec.GroupBy]
+		if !ok {
+			return nil, errors.Wrapf(server.ErrInvalidAggregate, "unknown dimension %q", spec.GroupBy)
+		}
+
+		query = `SELECT ` + dimension + ` AS ` + string(spec.GroupBy) + `, ` + aggregate + ` AS value FROM transactions
+		WHERE created_at >= $1 AND created_at < $2 AND ` + notReserving + ` GROUP BY ` + dimension + ` ORDER BY ` + dimension + `;`
+	}
+
+	rows, err := r.reader().QueryxContext(ctx, query, spec.From.UTC().Format(ISO8601), spec.To.UTC().Format(ISO8601))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		row := make(map[string]interface{})
+		if err := rows.MapScan(row); err != nil {
+			return nil, err
+		}
+
+		// Text columns can be returned as bytes by the drivers
+		for column, value := range row {
+			if b, ok := value.([]byte); ok {
+				row[column] = string(b)
+			}
+		}
+
+		results = append(results, row)
+	}
+
+	return results, rows.Err()
+}
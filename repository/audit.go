@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"taal-client/server"
+)
+
+// Operations recorded in the audit log.
+const (
+	AuditKeyCreated               = "key_created"
+	AuditKeyRevoked               = "key_revoked"
+	AuditKeyAddressSet            = "key_address_set"
+	AuditKeyPurged                = "key_purged"
+	AuditTransactionInserted      = "transaction_inserted"
+	AuditTransactionReserved      = "transaction_reserved"
+	AuditTransactionRestored      = "transaction_restored"
+	AuditTransactionsReattributed = "transactions_reattributed"
+	AuditTransactionStatusUpdated = "transaction_status_updated"
+	AuditTransactionReplaced      = "transaction_replaced"
+	AuditTransactionMetadataSet   = "transaction_metadata_set"
+	AuditTransactionProofSet      = "transaction_proof_set"
+	AuditTransactionPayloadSet    = "transaction_payload_set"
+	AuditTransactionsDeleted      = "transactions_deleted"
+	AuditTransactionsClamped      = "transactions_clamped"
+)
+
+type actorContextKey struct{}
+
+// ContextWithActor returns a copy of ctx which makes the audit log record actor for the writes
+// done with it.
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+func actorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorContextKey{}).(string)
+	return actor
+}
+
+type auditEntry struct {
+	operation string
+	targetID  string
+}
+
+// execer is implemented by both *database and *sqlx.Tx.
+type execer interface {
+	sqlx.ExecerContext
+	sqlx.QueryerContext
+	Rebind(query string) string
+}
+
+// mutate runs the write fn. If WithAuditLog is set, fn runs within a transaction together with
+// the insert of the audit entries which it returns, so neither is stored without the other.
+func (r Repository) mutate(ctx context.Context, fn func(ex execer) ([]auditEntry, error)) error {
+	if !r.audit {
+		_, err := fn(r.db)
+		return err
+	}
+
+	return r.WithTx(ctx, func(tx *sqlx.Tx) error {
+		entries, err := fn(tx)
+		if err != nil {
+			return err
+		}
+
+		return r.insertAuditEntries(ctx, tx, entries)
+	})
+}
+
+// insertAuditEntries stores the entries within tx if WithAuditLog is set.
+func (r Repository) insertAuditEntries(ctx context.Context, tx *sqlx.Tx, entries []auditEntry) error {
+	if !r.audit {
+		return nil
+	}
+
+	createdAt := r.now().UTC().Format(ISO8601)
+	actor := actorFromContext(ctx)
+
+	query := `INSERT INTO audit_log (created_at, operation, target_id, actor) VALUES ($1, $2, $3, $4);`
+	for _, entry := range entries {
+		_, err := tx.ExecContext(ctx, query, createdAt, entry.operation, entry.targetID, actor)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAuditLog returns the audit log entries created from (inclusive) to to (exclusive) in the
+// order they were written.
+func (r Repository) GetAuditLog(ctx context.Context, from time.Time, to time.Time) ([]server.AuditEntry, error) {
+	query := `SELECT * FROM audit_log WHERE created_at >= $1 AND created_at < $2 ORDER BY id;`
+
+	entries := make([]server.AuditEntry, 0)
+
+	err := r.reader().SelectContext(ctx, &entries, query, from.UTC().Format(ISO8601), to.UTC().Format(ISO8601))
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+// BalanceProvider looks up the balance in satoshis of an address, typically on chain.
+type BalanceProvider interface {
+	Balance(ctx context.Context, address string) (int64, error)
+}
+
+// WithExpectedBalance sets how ReconcileBalances computes the balance expected for the usage of a
+// key, and by how many satoshis the actual balance may differ from it.
+func WithExpectedBalance(expected func(server.KeyUsage) int64, tolerance int64) Option {
+	return func(r *Repository) {
+		r.expectedBalance = expected
+		r.balanceTolerance = tolerance
+	}
+}
+
+// ReconcileBalances compares the balance of the address of each active key, as returned by the
+// provider, with the balance expected for the usage of the key as set with WithExpectedBalance.
+// It returns the keys where the two differ by more than the tolerance, in the order of
+// GetAllKeysUsage. Keys without an address are skipped.
+func (r Repository) ReconcileBalances(ctx context.Context, provider BalanceProvider) ([]server.BalanceDiscrepancy, error) {
+	if r.expectedBalance == nil {
+		return nil, errors.New("no expected balance set, use WithExpectedBalance")
+	}
+
+	// The keys are read up front, so that no rows are held open while the provider is called.
+	keys, err := r.GetAllKeysUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	discrepancies := make([]server.BalanceDiscrepancy, 0)
+
+	for _, key := range keys {
+		if key.Address == "" {
+			continue
+		}
+
+		actual, err := provider.Balance(ctx, key.Address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get balance of address %s", key.Address)
+		}
+
+		want := r.expectedBalance(key)
+
+		diff := actual - want
+		if diff < 0 {
+			diff = -diff
+		}
+
+		if diff > r.balanceTolerance {
+			discrepancies = append(discrepancies, server.BalanceDiscrepancy{
+				ApiKey:   key.ApiKey,
+				Address:  key.Address,
+				Expected: want,
+				Actual:   actual,
+			})
+		}
+	}
+
+	return discrepancies, nil
+}
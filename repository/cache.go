@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"sync"
+	"time"
+
+	"taal-client/server"
+)
+
+type transactionInfoCacheKey struct {
+	from        time.Time
+	to          time.Time
+	granularity server.Granularity
+	opts        server.TransactionInfoOptions
+}
+
+type transactionInfoCacheEntry struct {
+	txInfos   []server.TransactionInfo
+	expiresAt time.Time
+}
+
+// transactionInfoCache holds GetTransactionInfo results until their TTL has passed or a
+// transaction is inserted. It is safe for concurrent use.
+type transactionInfoCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[transactionInfoCacheKey]transactionInfoCacheEntry
+}
+
+func newTransactionInfoCache(ttl time.Duration) *transactionInfoCache {
+	return &transactionInfoCache{
+		ttl:     ttl,
+		entries: make(map[transactionInfoCacheKey]transactionInfoCacheEntry),
+	}
+}
+
+func (c *transactionInfoCache) get(key transactionInfoCacheKey, now time.Time) ([]server.TransactionInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if !now.Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	return copyTransactionInfos(entry.txInfos), true
+}
+
+func (c *transactionInfoCache) set(key transactionInfoCacheKey, txInfos []server.TransactionInfo, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = transactionInfoCacheEntry{
+		txInfos:   copyTransactionInfos(txInfos),
+		expiresAt: now.Add(c.ttl),
+	}
+}
+
+func (c *transactionInfoCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[transactionInfoCacheKey]transactionInfoCacheEntry)
+}
+
+// copyTransactionInfos is used so that callers appending to or modifying a result cannot change
+// the cached entry.
+func copyTransactionInfos(txInfos []server.TransactionInfo) []server.TransactionInfo {
+	c := make([]server.TransactionInfo, len(txInfos))
+	copy(c, txInfos)
+
+	return c
+}
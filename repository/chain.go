@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+// ChainRepository reads from a primary repository and, when a key or transaction is not found
+// there, from a secondary one. It is meant for the time a store is migrated, when a row might
+// live in either. Only the single-row reads GetKey and GetTransaction fall back. The lists and
+// aggregates GetAllKeys, GetAllKeysUsage, GetAllTransactions, GetTransactionInfo and
+// ExportTransactionsJSONL as well as Health only read the primary, as do all writes.
+type ChainRepository struct {
+	server.Repository
+	secondary server.Repository
+}
+
+func NewChainRepository(primary server.Repository, secondary server.Repository) ChainRepository {
+	return ChainRepository{Repository: primary, secondary: secondary}
+}
+
+// GetKey returns the key from the primary, or from the secondary if the primary does not have it.
+func (c ChainRepository) GetKey(ctx context.Context, apiKey string) (server.Key, error) {
+	key, err := c.Repository.GetKey(ctx, apiKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.secondary.GetKey(ctx, apiKey)
+	}
+
+	return key, err
+}
+
+// GetTransaction returns the transaction from the primary, or from the secondary if the primary
+// does not have it.
+func (c ChainRepository) GetTransaction(ctx context.Context, txid string) (*server.Transaction, error) {
+	tx, err := c.Repository.GetTransaction(ctx, txid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.secondary.GetTransaction(ctx, txid)
+	}
+
+	return tx, err
+}
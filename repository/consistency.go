@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+
+	"taal-client/server"
+)
+
+// consistencySampleSize is the maximum number of ids reported per issue.
+const consistencySampleSize = 10
+
+// AddressValidator checks the format of the address of a key, such as server.BSVAddressValidator.
+type AddressValidator interface {
+	ValidateAddress(address string) error
+}
+
+// WithAddressValidator sets the AddressValidator used by CheckConsistency.
+func WithAddressValidator(validator AddressValidator) Option {
+	return func(r *Repository) {
+		r.addressValidator = validator
+	}
+}
+
+// CheckConsistency looks for transactions without a key, keys sharing an address, keys with a
+// malformed address if WithAddressValidator is set and rows which were created in the future. It
+// only reads, and all checks see the same snapshot.
+func (r Repository) CheckConsistency(ctx context.Context) (server.ConsistencyReport, error) {
+	var report server.ConsistencyReport
+
+	now := r.now().UTC().Format(ISO8601)
+
+	err := r.withReadTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+
+		report.OrphanedTransactions, err = consistencyIssue(ctx, tx, `t.id`,
+			`transactions t WHERE NOT EXISTS (SELECT 1 FROM keys k WHERE k.api_key = t.api_key)`)
+		if err != nil {
+			return err
+		}
+
+		report.DuplicateAddresses, err = consistencyIssue(ctx, tx, `k.api_key`,
+			`keys k WHERE EXISTS (SELECT 1 FROM keys o WHERE o.address = k.address AND o.api_key <> k.api_key)`)
+		if err != nil {
+			return err
+		}
+
+		report.FutureTransactions, err = consistencyIssue(ctx, tx, `id`, `transactions WHERE created_at > $1`, now)
+		if err != nil {
+			return err
+		}
+
+		report.FutureKeys, err = consistencyIssue(ctx, tx, `api_key`, `keys WHERE created_at > $1`, now)
+		if err != nil {
+			return err
+		}
+
+		report.MalformedAddresses, err = r.malformedAddresses(ctx, tx)
+
+		return err
+	})
+	if err != nil {
+		return server.ConsistencyReport{}, err
+	}
+
+	return report, nil
+}
+
+// consistencyIssue counts the rows of source, which is a FROM clause with its conditions, and
+// samples their idColumn.
+func consistencyIssue(ctx context.Context, tx *sqlx.Tx, idColumn string, source string, args ...interface{}) (server.ConsistencyIssue, error) {
+	issue := server.ConsistencyIssue{SampleIDs: make([]string, 0)}
+
+	err := tx.GetContext(ctx, &issue.Count, `SELECT count(*) FROM `+source+`;`, args...)
+	if err != nil {
+		return server.ConsistencyIssue{}, err
+	}
+
+	if issue.Count == 0 {
+		return issue, nil
+	}
+
+	query := `SELECT ` + idColumn + ` FROM ` + source + ` ORDER BY ` + idColumn + ` LIMIT ` + strconv.Itoa(consistencySampleSize) + `;`
+
+	err = tx.SelectContext(ctx, &issue.SampleIDs, query, args...)
+	if err != nil {
+		return server.ConsistencyIssue{}, err
+	}
+
+	return issue, nil
+}
+
+// malformedAddresses validates the address of every key in Go, as neither database can check
+// its encoding.
+func (r Repository) malformedAddresses(ctx context.Context, tx *sqlx.Tx) (server.ConsistencyIssue, error) {
+	issue := server.ConsistencyIssue{SampleIDs: make([]string, 0)}
+
+	if r.addressValidator == nil {
+		return issue, nil
+	}
+
+	rows, err := tx.QueryxContext(ctx, `SELECT api_key, address FROM keys ORDER BY api_key;`)
+	if err != nil {
+		return server.ConsistencyIssue{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var apiKey, address string
+		if err := rows.Scan(&apiKey, &address); err != nil {
+			return server.ConsistencyIssue{}, err
+		}
+
+		if r.addressValidator.ValidateAddress(address) == nil {
+			continue
+		}
+
+		issue.Count++
+		if len(issue.SampleIDs) < consistencySampleSize {
+			issue.SampleIDs = append(issue.SampleIDs, apiKey)
+		}
+	}
+
+	return issue, rows.Err()
+}
@@ -0,0 +1,153 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+// QueryInfo describes a query which has been run by the Repository.
+type QueryInfo struct {
+	Query   string
+	Elapsed time.Duration
+	Err     error
+	// Replica is set if the query was run against the read replica.
+	Replica bool
+	// RequestID is the id set on the context with server.WithRequestID.
+	RequestID string
+}
+
+// QueryObserver is called after each query run by the Repository outside of a transaction.
+type QueryObserver func(ctx context.Context, info QueryInfo)
+
+// slowQueryLogger returns an observer which logs the queries taking at least threshold and then
+// calls next, if set.
+func slowQueryLogger(threshold time.Duration, logger *log.Logger, next QueryObserver) QueryObserver {
+	return func(ctx context.Context, info QueryInfo) {
+		if info.Elapsed >= threshold {
+			requestID := info.RequestID
+			if requestID == "" {
+				requestID = "-"
+			}
+
+			logger.Printf("WARN: slow query took %s [request_id=%s]: %s", info.Elapsed, requestID, info.Query)
+		}
+
+		if next != nil {
+			next(ctx, info)
+		}
+	}
+}
+
+// database wraps the *sqlx.DB so that every query passes through the QueryObserver.
+type database struct {
+	*sqlx.DB
+	observer QueryObserver
+	replica  bool
+	// reconnect resets the connections after a query failed on a dead connection, after which the
+	// idle connection limit is set back to maxIdleConns.
+	reconnect    bool
+	maxIdleConns int
+	resetMtx     sync.Mutex
+}
+
+func (d *database) observe(ctx context.Context, query string, start time.Time, err error) {
+	if d.observer != nil {
+		d.observer(ctx, QueryInfo{
+			Query:     query,
+			Elapsed:   time.Since(start),
+			Err:       err,
+			Replica:   d.replica,
+			RequestID: server.RequestIDFromContext(ctx),
+		})
+	}
+}
+
+func (d *database) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := d.DB.ExecContext(ctx, query, args...)
+	d.observe(ctx, query, start, err)
+
+	return result, d.checkConnection(ctx, err)
+}
+
+func (d *database) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := d.DB.QueryContext(ctx, query, args...)
+	d.observe(ctx, query, start, err)
+
+	return rows, d.checkConnection(ctx, err)
+}
+
+func (d *database) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	start := time.Now()
+	rows, err := d.DB.QueryxContext(ctx, query, args...)
+	d.observe(ctx, query, start, err)
+
+	return rows, d.checkConnection(ctx, err)
+}
+
+func (d *database) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	start := time.Now()
+	row := d.DB.QueryRowxContext(ctx, query, args...)
+	d.observe(ctx, query, start, row.Err())
+
+	return row
+}
+
+func (d *database) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return sqlx.SelectContext(ctx, d, dest, query, args...)
+}
+
+func (d *database) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	// sqlx reads the single row through QueryRowxContext, whose error cannot be replaced there
+	return d.checkConnection(ctx, sqlx.GetContext(ctx, d, dest, query, args...))
+}
+
+// defaultMaxIdleConns is the number of idle connections database/sql keeps by default.
+const defaultMaxIdleConns = 2
+
+// checkConnection resets the connections if reconnect is set and err means that the connection
+// died, for instance because the database failed over. It then returns a
+// server.ConnectionResetError, so that the caller can retry on the new connections.
+func (d *database) checkConnection(ctx context.Context, err error) error {
+	if !d.reconnect || err == nil || errors.Is(err, server.ErrConnectionReset) || !isDeadConnection(err) {
+		return err
+	}
+
+	// Concurrent queries failing at the same time reset the pool one after the other
+	d.resetMtx.Lock()
+	defer d.resetMtx.Unlock()
+
+	// Closes the idle connections, which are likely dead too. The ones in use are dropped by
+	// database/sql as soon as they fail.
+	d.DB.SetMaxIdleConns(0)
+	d.DB.SetMaxIdleConns(d.maxIdleConns)
+
+	_ = d.DB.PingContext(ctx)
+
+	return server.ConnectionResetError{Err: err}
+}
+
+// isDeadConnection reports whether err means that the connection is gone. A timeout, such as of
+// a slow query, leaves the connection usable and does not count.
+func isDeadConnection(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsDeadConnection(t *testing.T) {
+	tt := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "bad connection", err: errors.Wrap(driver.ErrBadConn, "query failed"), expected: true},
+		{name: "eof", err: io.EOF, expected: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, expected: true},
+		{name: "connection reset", err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, expected: true},
+		{name: "timeout", err: &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, expected: false},
+		{name: "other network error", err: &net.DNSError{Err: "no such host", Name: "db"}, expected: false},
+		{name: "query error", err: errors.New("syntax error"), expected: false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(tc.expected, isDeadConnection(tc.err))
+		})
+	}
+}
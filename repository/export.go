@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+// transactionExport is the exported form of a transaction. It deliberately has no secret.
+type transactionExport struct {
+	ID        string `json:"id"`
+	ApiKey    string `json:"api_key"`
+	DataBytes int64  `json:"data_bytes"`
+	CreatedAt string `json:"created_at"`
+	Filename  string `json:"filename"`
+	IsHash    bool   `json:"isHash"`
+}
+
+// ExportTransactionsJSONL writes the transactions created at or after from and before to as JSON
+// Lines, one transaction per line with an RFC3339 created_at. Rows are streamed from the database
+// one at a time, so memory use does not depend on the size of the window.
+func (r Repository) ExportTransactionsJSONL(ctx context.Context, w io.Writer, from time.Time, to time.Time) error {
+	query := `SELECT * FROM transactions WHERE created_at >= $1 AND created_at < $2 ORDER BY created_at;`
+
+	rows, err := r.reader().QueryxContext(ctx, query, from.UTC().Format(ISO8601), to.UTC().Format(ISO8601))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	encoder := json.NewEncoder(w)
+
+	for rows.Next() {
+		var tx server.Transaction
+		if err := rows.StructScan(&tx); err != nil {
+			return err
+		}
+
+		createdAt, err := parseDBTimestamp(tx.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		err = encoder.Encode(transactionExport{
+			ID:        tx.ID,
+			ApiKey:    tx.ApiKey,
+			DataBytes: tx.DataBytes,
+			CreatedAt: createdAt.Format(time.RFC3339Nano),
+			Filename:  tx.Filename,
+			IsHash:    tx.IsHash,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// anonymizedTransactionExport is the exported form of a transaction for analytics. The api key is
+// hashed, and the id is left out too as it leads to the data on chain.
+type anonymizedTransactionExport struct {
+	ApiKeyHash string `json:"api_key_hash"`
+	DataBytes  int64  `json:"data_bytes"`
+	CreatedAt  string `json:"created_at"`
+	IsHash     bool   `json:"isHash"`
+}
+
+// ExportTransactionsAnonymized writes the transactions created at or after from and before to as
+// JSON Lines like ExportTransactionsJSONL, but without filename, secret or id and with the api key
+// replaced by its SHA-256 hash salted with the salt set by WithAnonymizationSalt. The same salt
+// gives the same hashes in every export.
+func (r Repository) ExportTransactionsAnonymized(ctx context.Context, w io.Writer, from time.Time, to time.Time) error {
+	if len(r.anonymizationSalt) == 0 {
+		return errors.New("no anonymization salt set")
+	}
+
+	query := `SELECT * FROM transactions WHERE created_at >= $1 AND created_at < $2 ORDER BY created_at;`
+
+	rows, err := r.reader().QueryxContext(ctx, query, from.UTC().Format(ISO8601), to.UTC().Format(ISO8601))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	encoder := json.NewEncoder(w)
+
+	for rows.Next() {
+		var tx server.Transaction
+		if err := rows.StructScan(&tx); err != nil {
+			return err
+		}
+
+		createdAt, err := parseDBTimestamp(tx.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		err = encoder.Encode(anonymizedTransactionExport{
+			ApiKeyHash: r.hashApiKey(tx.ApiKey),
+			DataBytes:  tx.DataBytes,
+			CreatedAt:  createdAt.Format(time.RFC3339Nano),
+			IsHash:     tx.IsHash,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (r Repository) hashApiKey(apiKey string) string {
+	h := sha256.New()
+	h.Write(r.anonymizationSalt)
+	h.Write([]byte(apiKey))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
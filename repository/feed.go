@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+// transactionsInsertedChannel is notified with the id of each inserted transaction by a trigger.
+const transactionsInsertedChannel = "transactions_inserted"
+
+// SubscribeTransactions emits the transactions inserted from now on until ctx is done, when the
+// channel is closed. Notifications sent while the listener reconnects are lost. It returns
+// server.ErrUnsupported on SQLite and an error if WithChangeFeed is not set.
+func (r Repository) SubscribeTransactions(ctx context.Context) (<-chan server.Transaction, error) {
+	if !r.isPostgres() {
+		return nil, server.ErrUnsupported
+	}
+
+	if r.feedConnStr == "" {
+		return nil, errors.New("change feed is not enabled, use WithChangeFeed")
+	}
+
+	listener := pq.NewListener(r.feedConnStr, time.Second, time.Minute, nil)
+
+	err := listener.Listen(transactionsInsertedChannel)
+	if err != nil {
+		_ = listener.Close()
+		return nil, errors.Wrapf(err, "failed to listen on %s", transactionsInsertedChannel)
+	}
+
+	txs := make(chan server.Transaction)
+
+	go func() {
+		defer close(txs)
+		defer listener.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case notification := <-listener.Notify:
+				// nil is sent after the connection was re-established
+				if notification == nil {
+					continue
+				}
+
+				// The row is read from the primary, a replica might not have it yet
+				var tx server.Transaction
+				err := r.db.GetContext(ctx, &tx, `SELECT * FROM transactions WHERE id = $1;`, notification.Extra)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("WARN: failed to read inserted transaction %s [request_id=%s]: %v", notification.Extra, server.RequestIDFromContext(ctx), err)
+					}
+					continue
+				}
+
+				select {
+				case txs <- tx:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return txs, nil
+}
+
+// tailBatchSize is the number of transactions TailTransactions reads per query.
+const tailBatchSize = 100
+
+// TailTransactions emits the transactions created from now on, oldest first, by polling the
+// database every pollInterval until ctx is done, when the channel is closed. It works on both
+// databases and keeps a (created_at, id) cursor, so a transaction is emitted once and earlier
+// ones are not read again. A transaction committed after a later one was already emitted is
+// missed.
+func (r Repository) TailTransactions(ctx context.Context, pollInterval time.Duration) (<-chan server.Transaction, error) {
+	if pollInterval <= 0 {
+		return nil, errors.Errorf("poll interval must be positive, got %s", pollInterval)
+	}
+
+	query := `SELECT * FROM transactions WHERE created_at > $1 OR (created_at = $1 AND id > $2) ORDER BY created_at, id LIMIT $3;`
+
+	cursorCreatedAt := r.now().UTC().Format(ISO8601)
+	cursorID := ""
+
+	txs := make(chan server.Transaction)
+
+	go func() {
+		defer close(txs)
+
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			for {
+				batch := make([]server.Transaction, 0, tailBatchSize)
+
+				// The rows are read from the primary, a replica might not have all of them yet
+				err := r.db.SelectContext(ctx, &batch, query, cursorCreatedAt, cursorID, tailBatchSize)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("WARN: failed to poll transactions after %s [request_id=%s]: %v", cursorCreatedAt, server.RequestIDFromContext(ctx), err)
+					}
+					break
+				}
+
+				for _, tx := range batch {
+					// The cursor compares to the stored value, not the normalized one
+					cursorCreatedAt = tx.CreatedAt
+					cursorID = tx.ID
+
+					tx.CreatedAt = formatDBTimestamp(tx.CreatedAt)
+
+					select {
+					case txs <- tx:
+					case <-ctx.Done():
+						return
+					}
+				}
+
+				if len(batch) < tailBatchSize {
+					break
+				}
+			}
+		}
+	}()
+
+	return txs, nil
+}
@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+// Encryptor encrypts the private keys before they are stored and decrypts them after they are
+// read.
+type Encryptor interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// WithEncryptor encrypts the private keys of new keys with encryptor. Keys stored before remain in
+// plaintext and are still read, as private_key_encrypted marks the rows which are encrypted.
+// Without an Encryptor private keys are stored in plaintext and encrypted keys cannot be read.
+func WithEncryptor(encryptor Encryptor) Option {
+	return func(r *Repository) {
+		r.encryptor = encryptor
+	}
+}
+
+// encryptPrivateKey returns the private key to store, hex encoded if it was encrypted, and whether
+// it was.
+func (r Repository) encryptPrivateKey(privateKey string) (string, bool, error) {
+	if r.encryptor == nil {
+		return privateKey, false, nil
+	}
+
+	ciphertext, err := r.encryptor.Encrypt([]byte(privateKey))
+	if err != nil {
+		return "", false, errors.Wrap(err, "failed to encrypt private key")
+	}
+
+	return hex.EncodeToString(ciphertext), true, nil
+}
+
+// decryptKeys decrypts the private keys of those keys which are stored encrypted. It returns
+// server.ErrDecryptionFailed if one cannot be decrypted.
+func (r Repository) decryptKeys(keys []server.Key) error {
+	for idx := range keys {
+		err := r.decryptKey(&keys[idx])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r Repository) decryptKey(key *server.Key) error {
+	privateKey, err := r.decryptPrivateKey(key.ApiKey, key.PrivateKey, key.PrivateKeyEncrypted)
+	if err != nil {
+		return err
+	}
+
+	key.PrivateKey = privateKey
+
+	return nil
+}
+
+// decryptPrivateKey returns the stored private key of apiKey decrypted if it is encrypted.
+func (r Repository) decryptPrivateKey(apiKey string, privateKey string, encrypted bool) (string, error) {
+	if !encrypted {
+		return privateKey, nil
+	}
+
+	if r.encryptor == nil {
+		return "", errors.Wrapf(server.ErrDecryptionFailed, "private key of %s is encrypted, but no Encryptor is set", apiKey)
+	}
+
+	ciphertext, err := hex.DecodeString(privateKey)
+	if err != nil {
+		return "", errors.Wrapf(server.ErrDecryptionFailed, "private key of %s: %v", apiKey, err)
+	}
+
+	plaintext, err := r.encryptor.Decrypt(ciphertext)
+	if err != nil {
+		return "", errors.Wrapf(server.ErrDecryptionFailed, "private key of %s: %v", apiKey, err)
+	}
+
+	return string(plaintext), nil
+}
@@ -0,0 +1,185 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+
+	"taal-client/server"
+)
+
+// keyExportMagic starts every encrypted key export and names its format version.
+const keyExportMagic = "TAALKEYS1"
+
+const (
+	keyExportSaltSize  = 16
+	keyExportNonceSize = 24
+)
+
+// keyBackup holds all columns of a key, unlike server.Key it includes the private key in JSON.
+type keyBackup struct {
+	ApiKey        string  `db:"api_key" json:"api_key"`
+	PublicKey     string  `db:"public_key" json:"public_key"`
+	PrivateKey    string  `db:"private_key" json:"private_key"`
+	Address       string  `db:"address" json:"address"`
+	CreatedAt     string  `db:"created_at" json:"created_at"`
+	RevokedAt     *string `db:"revoked_at" json:"revoked_at"`
+	RevokedReason *string `db:"revoked_reason" json:"revoked_reason"`
+	// PrivateKeyEncrypted is only set in snapshots, key exports hold the decrypted private keys.
+	PrivateKeyEncrypted bool `db:"private_key_encrypted" json:"private_key_encrypted,omitempty"`
+}
+
+// ExportKeysEncrypted writes all keys including their private keys to w, encrypted with NaCl
+// secretbox under a key derived from the passphrase with scrypt. The keys are only held in
+// memory unencrypted.
+func (r Repository) ExportKeysEncrypted(ctx context.Context, w io.Writer, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("passphrase must not be empty")
+	}
+
+	query := `SELECT api_key, public_key, private_key, private_key_encrypted, address, created_at, revoked_at, revoked_reason FROM keys ORDER BY created_at, api_key;`
+
+	keys := make([]keyBackup, 0)
+
+	err := r.reader().SelectContext(ctx, &keys, query)
+	if err != nil {
+		return err
+	}
+
+	for idx := range keys {
+		keys[idx].PrivateKey, err = r.decryptPrivateKey(keys[idx].ApiKey, keys[idx].PrivateKey, keys[idx].PrivateKeyEncrypted)
+		if err != nil {
+			return err
+		}
+		keys[idx].PrivateKeyEncrypted = false
+	}
+
+	plaintext, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	defer zero(plaintext)
+
+	header := make([]byte, len(keyExportMagic)+keyExportSaltSize+keyExportNonceSize)
+	copy(header, keyExportMagic)
+
+	salt := header[len(keyExportMagic) : len(keyExportMagic)+keyExportSaltSize]
+	var nonce [keyExportNonceSize]byte
+
+	_, err = io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return err
+	}
+	copy(header[len(keyExportMagic)+keyExportSaltSize:], nonce[:])
+
+	secretKey, err := deriveKeyExportKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	sealed := secretbox.Seal(header, plaintext, &nonce, secretKey)
+
+	_, err = w.Write(sealed)
+
+	return err
+}
+
+// ImportKeysEncrypted stores the keys written by ExportKeysEncrypted, keeping their timestamps.
+// Keys which already exist are left as they are. It returns server.ErrDecryptionFailed for a
+// wrong passphrase.
+func (r Repository) ImportKeysEncrypted(ctx context.Context, reader io.Reader, passphrase string) error {
+	sealed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	headerSize := len(keyExportMagic) + keyExportSaltSize + keyExportNonceSize
+	if len(sealed) < headerSize || !bytes.Equal(sealed[:len(keyExportMagic)], []byte(keyExportMagic)) {
+		return errors.New("not an encrypted key export")
+	}
+
+	salt := sealed[len(keyExportMagic) : len(keyExportMagic)+keyExportSaltSize]
+	var nonce [keyExportNonceSize]byte
+	copy(nonce[:], sealed[len(keyExportMagic)+keyExportSaltSize:headerSize])
+
+	secretKey, err := deriveKeyExportKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	plaintext, ok := secretbox.Open(nil, sealed[headerSize:], &nonce, secretKey)
+	if !ok {
+		return server.ErrDecryptionFailed
+	}
+	defer zero(plaintext)
+
+	var keys []keyBackup
+
+	err = json.Unmarshal(plaintext, &keys)
+	if err != nil {
+		return errors.Wrap(err, "invalid key export")
+	}
+
+	query := `INSERT INTO keys (api_key, public_key, private_key, address, created_at, revoked_at, revoked_reason, private_key_encrypted) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (api_key) DO NOTHING;`
+
+	return r.WithTx(ctx, func(tx *sqlx.Tx) error {
+		var entries []auditEntry
+
+		for _, key := range keys {
+			privateKey, encrypted, err := r.encryptPrivateKey(key.PrivateKey)
+			if err != nil {
+				return err
+			}
+
+			result, err := tx.ExecContext(ctx, query, key.ApiKey, key.PublicKey, privateKey, key.Address, key.CreatedAt, key.RevokedAt, key.RevokedReason, bool2integer(encrypted))
+			if err != nil {
+				return errors.Wrapf(err, "failed to import key %s", key.ApiKey)
+			}
+
+			imported, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+
+			if imported > 0 {
+				entries = append(entries, auditEntry{operation: AuditKeyCreated, targetID: key.ApiKey})
+			}
+		}
+
+		return r.insertAuditEntries(ctx, tx, entries)
+	})
+}
+
+func deriveKeyExportKey(passphrase string, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [32]byte
+	copy(key[:], derived)
+	zero(derived)
+
+	return &key, nil
+}
+
+// zero overwrites b, so that secrets do not linger in memory longer than needed.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
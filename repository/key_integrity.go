@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+// KeyDeriver derives the public key and address of a stored private key, such as
+// server.BSVKeyDeriver.
+type KeyDeriver interface {
+	DeriveKey(privateKey string) (publicKey string, address string, err error)
+}
+
+// WithKeyDeriver sets the KeyDeriver used by VerifyKeyIntegrity.
+func WithKeyDeriver(deriver KeyDeriver) Option {
+	return func(r *Repository) {
+		r.keyDeriver = deriver
+	}
+}
+
+// VerifyKeyIntegrity checks that the stored private key of the api key derives its stored public
+// key and address. It returns server.ErrKeyCorrupt if it does not or the private key cannot be
+// decoded, and sql.ErrNoRows if the key does not exist.
+func (r Repository) VerifyKeyIntegrity(ctx context.Context, apiKey string) error {
+	if r.keyDeriver == nil {
+		return errors.New("no key deriver set")
+	}
+
+	key, err := r.GetKey(ctx, apiKey)
+	if err != nil {
+		return err
+	}
+
+	publicKey, address, err := r.keyDeriver.DeriveKey(key.PrivateKey)
+	if err != nil {
+		return errors.Wrapf(server.ErrKeyCorrupt, "key %s: %v", apiKey, err)
+	}
+
+	if publicKey != key.PublicKey {
+		return errors.Wrapf(server.ErrKeyCorrupt, "key %s: public key %s is stored, %s is derived", apiKey, key.PublicKey, publicKey)
+	}
+
+	if address != key.Address {
+		return errors.Wrapf(server.ErrKeyCorrupt, "key %s: address %s is stored, %s is derived", apiKey, key.Address, address)
+	}
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package repository
+
+import "strings"
+
+// likeEscapeChar is the escape character used in LIKE patterns. SQLite has no default escape
+// character, so every LIKE using an escaped pattern must be followed by likeEscapeClause.
+const likeEscapeChar = `\`
+
+// likeEscapeClause declares likeEscapeChar as escape character and works on SQLite and PostgreSQL.
+const likeEscapeClause = `ESCAPE '` + likeEscapeChar + `'`
+
+var likeEscaper = strings.NewReplacer(
+	likeEscapeChar, likeEscapeChar+likeEscapeChar,
+	"%", likeEscapeChar+"%",
+	"_", likeEscapeChar+"_",
+)
+
+// escapeLike escapes the LIKE wildcards and the escape character in s so that it can be used
+// as a literal inside a LIKE pattern.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
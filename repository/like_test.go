@@ -0,0 +1,28 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestEscapeLike(t *testing.T) {
+	tt := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{name: "no wildcards", input: "picture.png", expected: "picture.png"},
+		{name: "percent", input: "100%.png", expected: `100\%.png`},
+		{name: "underscore", input: "my_file.txt", expected: `my\_file.txt`},
+		{name: "escape char", input: `dir\file`, expected: `dir\\file`},
+		{name: "mixed", input: `%_\`, expected: `\%\_\\`},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(tc.expected, escapeLike(tc.input))
+		})
+	}
+}
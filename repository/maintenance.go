@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+// DeleteTransactionsBefore deletes the transactions created before the given time and returns
+// how many were deleted.
+func (r Repository) DeleteTransactionsBefore(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM transactions WHERE created_at < $1;`
+
+	cutoff := before.UTC().Format(ISO8601)
+
+	var deleted int64
+
+	err := r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		result, err := ex.ExecContext(ctx, query, cutoff)
+		if err != nil {
+			return nil, err
+		}
+
+		deleted, err = result.RowsAffected()
+		if err != nil || deleted == 0 {
+			return nil, err
+		}
+
+		return []auditEntry{{operation: AuditTransactionsDeleted, targetID: cutoff}}, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if deleted > 0 && r.infoCache != nil {
+		r.infoCache.clear()
+	}
+
+	return deleted, nil
+}
+
+// PreviewDeleteTransactionsBefore returns how many transactions DeleteTransactionsBefore would
+// delete, without deleting them.
+func (r Repository) PreviewDeleteTransactionsBefore(ctx context.Context, before time.Time) (int64, error) {
+	query := `SELECT count(*) FROM transactions WHERE created_at < $1;`
+
+	var count int64
+
+	err := r.db.GetContext(ctx, &count, query, before.UTC().Format(ISO8601))
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// ClampFutureTimestamps sets the creation time of the transactions created after now, as given by
+// the clock of the Repository, to now and returns how many were changed.
+func (r Repository) ClampFutureTimestamps(ctx context.Context) (int64, error) {
+	query := `UPDATE transactions SET created_at = $1 WHERE created_at > $1;`
+
+	now := r.now().UTC().Format(ISO8601)
+
+	var clamped int64
+
+	err := r.WithTx(ctx, func(tx *sqlx.Tx) error {
+		result, err := tx.ExecContext(ctx, query, now)
+		if err != nil {
+			return err
+		}
+
+		clamped, err = result.RowsAffected()
+		if err != nil || clamped == 0 {
+			return err
+		}
+
+		return r.insertAuditEntries(ctx, tx, []auditEntry{{operation: AuditTransactionsClamped, targetID: now}})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if clamped > 0 && r.infoCache != nil {
+		r.infoCache.clear()
+	}
+
+	return clamped, nil
+}
+
+// Optimize reclaims the space of deleted rows and updates the statistics of the query planner.
+// Both databases lock tables while doing so.
+func (r Repository) Optimize(ctx context.Context) error {
+	statements := []string{`VACUUM;`, `ANALYZE;`}
+	if r.isPostgres() {
+		statements = []string{`VACUUM ANALYZE;`}
+	}
+
+	for _, statement := range statements {
+		_, err := r.db.ExecContext(ctx, statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StartMaintenance deletes the transactions older than the retention and optionally optimizes
+// the database every interval, until ctx is done or stop is called. stop waits for a running
+// maintenance to finish. It returns an error if the interval is not positive.
+func (r Repository) StartMaintenance(ctx context.Context, cfg server.MaintenanceConfig) (stop func(), err error) {
+	if cfg.Interval <= 0 {
+		return nil, errors.Errorf("maintenance interval must be positive, got %s", cfg.Interval)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.runMaintenance(ctx, cfg)
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}, nil
+}
+
+func (r Repository) runMaintenance(ctx context.Context, cfg server.MaintenanceConfig) {
+	logf := func(format string, args ...interface{}) {
+		if cfg.Logger != nil {
+			cfg.Logger.Printf(format, args...)
+		}
+	}
+
+	if cfg.Retention > 0 {
+		before := r.now().Add(-cfg.Retention)
+
+		deleted, err := r.DeleteTransactionsBefore(ctx, before)
+		if err != nil {
+			logf("ERROR: maintenance failed to delete transactions before %s: %v", before.Format(time.RFC3339), err)
+			return
+		}
+
+		logf("INFO: maintenance deleted %d transactions before %s", deleted, before.Format(time.RFC3339))
+	}
+
+	if cfg.Optimize {
+		err := r.Optimize(ctx)
+		if err != nil {
+			logf("ERROR: maintenance failed to optimize the database: %v", err)
+			return
+		}
+
+		logf("INFO: maintenance optimized the database")
+	}
+}
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// SetTransactionMetadata stores the metadata of the transaction as a JSON document, replacing any
+// earlier metadata. A nil map clears it. It returns sql.ErrNoRows if there is no transaction with
+// the id.
+func (r Repository) SetTransactionMetadata(ctx context.Context, txid string, metadata map[string]interface{}) error {
+	var document *string
+	if metadata != nil {
+		b, err := json.Marshal(metadata)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal metadata")
+		}
+
+		s := string(b)
+		document = &s
+	}
+
+	query := `UPDATE transactions SET metadata = $1 WHERE id = $2;`
+
+	return r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		result, err := ex.ExecContext(ctx, query, document, txid)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+
+		if rows == 0 {
+			return nil, sql.ErrNoRows
+		}
+
+		return []auditEntry{{operation: AuditTransactionMetadataSet, targetID: txid}}, nil
+	})
+}
+
+// GetTransactionMetadata returns the metadata of the transaction, or nil if none was set. Numbers
+// are returned as float64 as with any decoded JSON. It returns sql.ErrNoRows if there is no
+// transaction with the id.
+func (r Repository) GetTransactionMetadata(ctx context.Context, txid string) (map[string]interface{}, error) {
+	query := `SELECT metadata FROM transactions WHERE id = $1;`
+
+	var document *string
+
+	err := r.reader().GetContext(ctx, &document, query, txid)
+	if err != nil {
+		return nil, err
+	}
+
+	if document == nil {
+		return nil, nil
+	}
+
+	metadata := make(map[string]interface{})
+
+	err = json.Unmarshal([]byte(*document), &metadata)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal metadata")
+	}
+
+	return metadata, nil
+}
@@ -1,7 +1,20 @@
 package repository
 
 type TransactionInfo struct {
-	Timestamp string `db:"timestamp" json:"timestamp"`
-	Count     int    `db:"count" json:"count"`
-	DataBytes int    `db:"data_bytes" json:"data_bytes"`
+	Timestamp           string  `db:"timestamp" json:"timestamp"`
+	Count               int     `db:"count" json:"count"`
+	DataBytes           int64   `db:"data_bytes" json:"data_bytes"`
+	DataBytesP50        float64 `db:"data_bytes_p50" json:"data_bytes_p50"`
+	DataBytesP95        float64 `db:"data_bytes_p95" json:"data_bytes_p95"`
+	CumulativeDataBytes int64   `db:"cumulative_data_bytes" json:"cumulative_data_bytes"`
+	ActiveKeys          int     `db:"active_keys" json:"active_keys"`
+	FullCount           int     `db:"full_count" json:"full_count"`
+	HashCount           int     `db:"hash_count" json:"hash_count"`
+}
+
+type TransactionWeekInfo struct {
+	Week       string `db:"week" json:"week"`
+	Count      int    `db:"count" json:"count"`
+	DataBytes  int64  `db:"data_bytes" json:"data_bytes"`
+	ActiveKeys int    `db:"active_keys" json:"active_keys"`
 }
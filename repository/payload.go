@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Codec encodes payloads before they are stored and decodes them after they are read, for
+// instance to compress them.
+type Codec interface {
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// noopCodec stores payloads unchanged.
+type noopCodec struct{}
+
+func (noopCodec) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (noopCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// WithCodec sets the Codec which SetTransactionPayload and GetTransactionPayload encode and decode
+// payloads with. Payloads stored with another codec can no longer be read.
+func WithCodec(codec Codec) Option {
+	return func(r *Repository) {
+		if codec != nil {
+			r.codec = codec
+		}
+	}
+}
+
+// SetTransactionPayload stores the payload of the transaction encoded with the Codec, replacing
+// any earlier payload. The transaction itself does not need to be stored.
+func (r Repository) SetTransactionPayload(ctx context.Context, txid string, payload []byte) error {
+	encoded, err := r.codec.Encode(payload)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode payload of transaction %s", txid)
+	}
+
+	createdAt := r.now().UTC().Format(ISO8601)
+	query := `INSERT INTO payloads (txid, created_at, payload) VALUES ($1, $2, $3)
+	ON CONFLICT (txid) DO UPDATE SET created_at = excluded.created_at, payload = excluded.payload;`
+
+	return r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		_, err := ex.ExecContext(ctx, query, txid, createdAt, encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		return []auditEntry{{operation: AuditTransactionPayloadSet, targetID: txid}}, nil
+	})
+}
+
+// GetTransactionPayload returns the payload of the transaction decoded with the Codec, or
+// sql.ErrNoRows if no payload is stored for it.
+func (r Repository) GetTransactionPayload(ctx context.Context, txid string) ([]byte, error) {
+	query := `SELECT payload FROM payloads WHERE txid = $1;`
+
+	var encoded []byte
+
+	err := r.reader().GetContext(ctx, &encoded, query, txid)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := r.codec.Decode(encoded)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode payload of transaction %s", txid)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,37 @@
+package repository
+
+import (
+	"context"
+)
+
+// SetTransactionProof stores the raw merkle proof of the transaction, replacing any earlier proof.
+// The transaction itself does not need to be stored.
+func (r Repository) SetTransactionProof(ctx context.Context, txid string, proof []byte) error {
+	createdAt := r.now().UTC().Format(ISO8601)
+	query := `INSERT INTO proofs (txid, created_at, proof) VALUES ($1, $2, $3)
+	ON CONFLICT (txid) DO UPDATE SET created_at = excluded.created_at, proof = excluded.proof;`
+
+	return r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		_, err := ex.ExecContext(ctx, query, txid, createdAt, proof)
+		if err != nil {
+			return nil, err
+		}
+
+		return []auditEntry{{operation: AuditTransactionProofSet, targetID: txid}}, nil
+	})
+}
+
+// GetTransactionProof returns the raw merkle proof of the transaction, or sql.ErrNoRows if no
+// proof is stored for it.
+func (r Repository) GetTransactionProof(ctx context.Context, txid string) ([]byte, error) {
+	query := `SELECT proof FROM proofs WHERE txid = $1;`
+
+	var proof []byte
+
+	err := r.reader().GetContext(ctx, &proof, query, txid)
+	if err != nil {
+		return nil, err
+	}
+
+	return proof, nil
+}
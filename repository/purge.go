@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+
+	"taal-client/server"
+)
+
+// PurgeRevokedKey deletes the revoked key together with all its transactions and their proofs
+// and payloads within one transaction, and returns how many keys and transactions were deleted.
+// It returns a server.KeyActiveError if the key is not revoked and sql.ErrNoRows if it does not
+// exist.
+func (r Repository) PurgeRevokedKey(ctx context.Context, apiKey string) (keysDeleted int64, txDeleted int64, err error) {
+	err = r.WithTx(ctx, func(tx *sqlx.Tx) error {
+		var revokedAt sql.NullString
+		err := tx.GetContext(ctx, &revokedAt, `SELECT revoked_at FROM keys WHERE api_key = $1;`, apiKey)
+		if err != nil {
+			return err
+		}
+
+		if !revokedAt.Valid {
+			return server.KeyActiveError{ApiKey: apiKey}
+		}
+
+		for _, table := range []string{"proofs", "payloads"} {
+			_, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE txid IN (SELECT id FROM transactions WHERE api_key = $1);`, apiKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		result, err := tx.ExecContext(ctx, `DELETE FROM transactions WHERE api_key = $1;`, apiKey)
+		if err != nil {
+			return err
+		}
+
+		txDeleted, err = result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		result, err = tx.ExecContext(ctx, `DELETE FROM keys WHERE api_key = $1;`, apiKey)
+		if err != nil {
+			return err
+		}
+
+		keysDeleted, err = result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		return r.insertAuditEntries(ctx, tx, []auditEntry{{operation: AuditKeyPurged, targetID: apiKey}})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if txDeleted > 0 && r.infoCache != nil {
+		r.infoCache.clear()
+	}
+
+	return keysDeleted, txDeleted, nil
+}
@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+// maxReplacements bounds the number of links ResolveReplacement follows, in case of a cycle.
+const maxReplacements = 100
+
+// MarkTransactionReplaced links the transaction oldTxid to the transaction newTxid which was
+// broadcast in its place. If newTxid is not stored yet it is created with the api key, size,
+// filename, secret and fee of oldTxid and the broadcast status. It returns sql.ErrNoRows if there is no transaction oldTxid.
+func (r Repository) MarkTransactionReplaced(ctx context.Context, oldTxid string, newTxid string) error {
+	if newTxid == "" || newTxid == oldTxid {
+		return server.InvalidTransactionError{Field: "replaced_by", Reason: "must be another transaction"}
+	}
+
+	createdAt := r.now().UTC().Format(ISO8601)
+
+	err := r.WithTx(ctx, func(tx *sqlx.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE transactions SET replaced_by = $1 WHERE id = $2;`, newTxid, oldTxid)
+		if err != nil {
+			return err
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rows == 0 {
+			return sql.ErrNoRows
+		}
+
+		query := `INSERT INTO transactions (created_at, id, api_key, data_bytes, filename, secret, secret_hash, is_hash, content_hash, fee_satoshis, status, status_at)
+		SELECT $1, $2, api_key, data_bytes, filename, secret, secret_hash, is_hash, content_hash, fee_satoshis, $3, $1 FROM transactions WHERE id = $4
+		ON CONFLICT (id) DO NOTHING;`
+
+		result, err = tx.ExecContext(ctx, query, createdAt, newTxid, server.TransactionStatusBroadcast, oldTxid)
+		if err != nil {
+			return errors.Wrapf(err, "failed to copy transaction %s to %s", oldTxid, newTxid)
+		}
+
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		entries := []auditEntry{{operation: AuditTransactionReplaced, targetID: oldTxid}}
+		if inserted > 0 {
+			entries = append(entries, auditEntry{operation: AuditTransactionInserted, targetID: newTxid})
+		}
+
+		return r.insertAuditEntries(ctx, tx, entries)
+	})
+	if err != nil {
+		return err
+	}
+
+	if r.infoCache != nil {
+		r.infoCache.clear()
+	}
+
+	return nil
+}
+
+// ResolveReplacement follows the replacements of the transaction and returns the id of the last
+// one, which is txid itself if it was not replaced. It returns sql.ErrNoRows if there is no
+// transaction txid.
+func (r Repository) ResolveReplacement(ctx context.Context, txid string) (string, error) {
+	query := `SELECT replaced_by FROM transactions WHERE id = $1;`
+
+	current := txid
+
+	for i := 0; i < maxReplacements; i++ {
+		var replacedBy *string
+
+		err := r.reader().GetContext(ctx, &replacedBy, query, current)
+		if err != nil {
+			if err == sql.ErrNoRows && current != txid {
+				// The replacement was linked but is not stored
+				return current, nil
+			}
+			return "", err
+		}
+
+		if replacedBy == nil {
+			return current, nil
+		}
+
+		current = *replacedBy
+	}
+
+	return "", errors.Errorf("more than %d replacements of transaction %s", maxReplacements, txid)
+}
@@ -3,46 +3,362 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
 
 	"taal-client/server"
 )
 
+// Repository stores the keys and transactions. The secret column of a transaction holds the key
+// its data was encrypted with, which is stored in plaintext because reading the transaction needs
+// it. A recovery secret is kept apart from it as a bcrypt hash in secret_hash, see
+// SetTransactionSecretHashed, and is never stored in plaintext.
 type Repository struct {
-	db  *sqlx.DB
-	now func() time.Time
+	db          *database
+	readDB      *database
+	audit       bool
+	observer    QueryObserver
+	now         func() time.Time
+	checkApiKey bool
+	infoCache   *transactionInfoCache
+
+	txRetries      int
+	txRetryBackoff time.Duration
+
+	schemaVersion int
+	maxRows       int
+	feedConnStr   string
+
+	slowQueryThreshold time.Duration
+	slowQueryLogger    *log.Logger
+
+	anonymizationSalt []byte
+	statementTimeout  time.Duration
+	reconnect         bool
+	maxIdleConns      *int
+	keyDeriver        KeyDeriver
+	expectedBalance   func(server.KeyUsage) int64
+	balanceTolerance  int64
+	addressValidator  AddressValidator
+	maxDataBytes      int64
+	codec             Codec
+	insertGrace       time.Duration
+	encryptor         Encryptor
+}
+
+// Option configures optional behaviour of the Repository.
+type Option func(r *Repository)
+
+// WithApiKeyCheck makes InsertTransaction reject transactions whose api key is not stored.
+func WithApiKeyCheck() Option {
+	return func(r *Repository) {
+		r.checkApiKey = true
+	}
+}
+
+// WithClock makes the Repository take the current time from clock instead of the now function
+// passed to NewRepository.
+func WithClock(clock server.Clock) Option {
+	return func(r *Repository) {
+		r.now = clock.Now
+	}
+}
+
+// WithTransactionInfoCache caches GetTransactionInfo results per from, to and granularity for ttl.
+// The cache is cleared whenever a transaction is inserted through the Repository.
+func WithTransactionInfoCache(ttl time.Duration) Option {
+	return func(r *Repository) {
+		r.infoCache = newTransactionInfoCache(ttl)
+	}
+}
+
+// WithSerializationRetries retries transactions run by WithTx up to maxRetries times when
+// PostgreSQL aborts them with a serialization failure or a deadlock. The wait before the first
+// retry is backoff and doubles with every further retry. It has no effect on SQLite.
+func WithSerializationRetries(maxRetries int, backoff time.Duration) Option {
+	return func(r *Repository) {
+		r.txRetries = maxRetries
+		r.txRetryBackoff = backoff
+	}
+}
+
+// WithMaxRows makes GetAllTransactions and GetAllKeys return server.ErrResultTooLarge instead of
+// loading more than maxRows rows.
+func WithMaxRows(maxRows int) Option {
+	return func(r *Repository) {
+		r.maxRows = maxRows
+	}
+}
+
+// WithChangeFeed enables SubscribeTransactions on PostgreSQL. The notifications need a connection
+// of their own, which is opened with connectionString.
+func WithChangeFeed(connectionString string) Option {
+	return func(r *Repository) {
+		r.feedConnStr = connectionString
+	}
+}
+
+// WithSchemaVersionCheck makes Health also check that the database schema has the given version.
+func WithSchemaVersionCheck(version int) Option {
+	return func(r *Repository) {
+		r.schemaVersion = version
+	}
+}
+
+// WithQueryObserver registers an observer which is called after each query.
+func WithQueryObserver(observer QueryObserver) Option {
+	return func(r *Repository) {
+		r.observer = observer
+	}
+}
+
+// WithSlowQueryLog logs the queries taking at least threshold to logger, together with the
+// request id set on their context with server.WithRequestID.
+func WithSlowQueryLog(threshold time.Duration, logger *log.Logger) Option {
+	return func(r *Repository) {
+		r.slowQueryThreshold = threshold
+		r.slowQueryLogger = logger
+	}
 }
 
-func NewRepository(db *sqlx.DB, now func() time.Time) Repository {
-	return Repository{
-		db:  db,
-		now: now,
+// WithAnonymizationSalt sets the salt the api keys are hashed with by
+// ExportTransactionsAnonymized. It should be random and kept secret, as anyone who knows it can
+// check whether a hash belongs to a given api key.
+func WithAnonymizationSalt(salt []byte) Option {
+	return func(r *Repository) {
+		r.anonymizationSalt = salt
+	}
+}
+
+// WithStatementTimeout makes PostgreSQL cancel statements which run inside a transaction of the
+// Repository for longer than timeout, so that they stop holding locks when the client has long
+// given up. It has no effect on SQLite.
+func WithStatementTimeout(timeout time.Duration) Option {
+	return func(r *Repository) {
+		r.statementTimeout = timeout
+	}
+}
+
+// WithReconnectOnError resets the database connections when a query fails because its connection
+// died, and then returns a server.ConnectionResetError so the caller can retry. The idle
+// connection limit is set back to the one given to WithMaxIdleConns by the reset, or to the
+// database/sql default of 2 without it. Queries within transactions are not covered.
+func WithReconnectOnError() Option {
+	return func(r *Repository) {
+		r.reconnect = true
+	}
+}
+
+// WithMaxIdleConns sets the idle connection limit of the database and the read replica, which
+// WithReconnectOnError restores after resetting the connections. database/sql does not expose the
+// limit, so one set on the *sqlx.DB directly cannot be restored.
+func WithMaxIdleConns(n int) Option {
+	return func(r *Repository) {
+		r.maxIdleConns = &n
+	}
+}
+
+// WithMaxDataBytes makes the insert methods reject transactions with more than maxDataBytes data
+// bytes with server.ErrDataTooLarge. Zero means unlimited.
+func WithMaxDataBytes(maxDataBytes int64) Option {
+	return func(r *Repository) {
+		r.maxDataBytes = maxDataBytes
+	}
+}
+
+// WithInsertGracePeriod lets InsertTransaction store a transaction for up to grace after the
+// caller's context was canceled. The transaction is inserted after it was broadcast, so dropping
+// the insert because the HTTP request was abandoned would leave a transaction on chain which is
+// not recorded locally. The trade-off is that the caller can no longer abort the insert, which may
+// outlast the request by up to grace and succeed although nobody waits for the result.
+func WithInsertGracePeriod(grace time.Duration) Option {
+	return func(r *Repository) {
+		r.insertGrace = grace
+	}
+}
+
+// WithAuditLog makes the write methods record what they changed in the audit log. Use
+// ContextWithActor to record who made the change.
+func WithAuditLog() Option {
+	return func(r *Repository) {
+		r.audit = true
+	}
+}
+
+// WithReadReplica routes the read-only methods to the replica, while all writes and the reads
+// belonging to a write still go to the primary database. Replicas usually lag behind the primary,
+// so a read directly following a write can miss it.
+func WithReadReplica(replica *sqlx.DB) Option {
+	return func(r *Repository) {
+		if replica != nil {
+			r.readDB = &database{DB: replica, replica: true}
+		}
+	}
+}
+
+func NewRepository(db *sqlx.DB, now func() time.Time, opts ...Option) Repository {
+	r := Repository{
+		db:    &database{DB: db},
+		now:   now,
+		codec: noopCodec{},
+	}
+
+	for _, opt := range opts {
+		opt(&r)
+	}
+
+	observer := r.observer
+	if r.slowQueryLogger != nil {
+		observer = slowQueryLogger(r.slowQueryThreshold, r.slowQueryLogger, observer)
+	}
+
+	maxIdleConns := defaultMaxIdleConns
+	if r.maxIdleConns != nil {
+		maxIdleConns = *r.maxIdleConns
+		r.db.DB.SetMaxIdleConns(maxIdleConns)
+	}
+
+	r.db.observer = observer
+	r.db.reconnect = r.reconnect
+	r.db.maxIdleConns = maxIdleConns
+	if r.readDB != nil {
+		if r.maxIdleConns != nil {
+			r.readDB.DB.SetMaxIdleConns(maxIdleConns)
+		}
+
+		r.readDB.observer = observer
+		r.readDB.reconnect = r.reconnect
+		r.readDB.maxIdleConns = maxIdleConns
 	}
+
+	return r
 }
 
-const ISO8601 = "2006-01-02T15:04:05.999Z"
+// ISO8601 is the layout timestamps are written in. The fraction of a second always has three
+// digits, so that stored timestamps compare correctly as strings and SUBSTR cuts them at the same
+// positions whether or not the time fell on a round second.
+const ISO8601 = "2006-01-02T15:04:05.000Z"
+
+// iso8601Variable parses timestamps written before ISO8601 had a fixed width fraction.
+const iso8601Variable = "2006-01-02T15:04:05.999Z"
 const ISO8601DBOutput = "2006-01-02 15:04:05.999Z"
 const ISO8601Sqlite = "2006-01-02 15:04:05.999+00:00"
 
+// InsertKey stores the key. Its private key is encrypted if WithEncryptor is set.
 func (r Repository) InsertKey(ctx context.Context, key server.Key) error {
 	createdAt := r.now().UTC().Format(ISO8601)
 
-	query := `INSERT INTO keys (created_at, api_key, private_key, public_key, address) VALUES ($1, $2, $3, $4, $5);`
-	_, err := r.db.ExecContext(ctx, query, createdAt, key.ApiKey, key.PrivateKey, key.PublicKey, key.Address)
+	privateKey, encrypted, err := r.encryptPrivateKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO keys (created_at, api_key, private_key, public_key, address, private_key_encrypted) VALUES ($1, $2, $3, $4, $5, $6);`
 
-	return err
+	return r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		_, err := ex.ExecContext(ctx, query, createdAt, key.ApiKey, privateKey, key.PublicKey, key.Address, bool2integer(encrypted))
+		if err != nil {
+			return nil, err
+		}
+
+		return []auditEntry{{operation: AuditKeyCreated, targetID: key.ApiKey}}, nil
+	})
+}
+
+// insertKeysBatchSize is the number of keys per INSERT of InsertKeys, which keeps the number of
+// parameters below the limit of 999 of older SQLite versions.
+const insertKeysBatchSize = 100
+
+// InsertKeys stores all keys within one transaction, so that either all or none of them are
+// stored, for instance if one of the api keys exists already.
+func (r Repository) InsertKeys(ctx context.Context, keys []server.Key) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	createdAt := r.now().UTC().Format(ISO8601)
+
+	return r.WithTx(ctx, func(tx *sqlx.Tx) error {
+		var entries []auditEntry
+
+		for start := 0; start < len(keys); start += insertKeysBatchSize {
+			end := start + insertKeysBatchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			values := make([]string, 0, end-start)
+			args := make([]interface{}, 0, 6*(end-start))
+
+			for _, key := range keys[start:end] {
+				privateKey, encrypted, err := r.encryptPrivateKey(key.PrivateKey)
+				if err != nil {
+					return err
+				}
+
+				n := len(args)
+				values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6))
+				args = append(args, createdAt, key.ApiKey, privateKey, key.PublicKey, key.Address, bool2integer(encrypted))
+				entries = append(entries, auditEntry{operation: AuditKeyCreated, targetID: key.ApiKey})
+			}
+
+			query := `INSERT INTO keys (created_at, api_key, private_key, public_key, address, private_key_encrypted) VALUES ` + strings.Join(values, ", ") + `;`
+
+			_, err := tx.ExecContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+		}
+
+		return r.insertAuditEntries(ctx, tx, entries)
+	})
 }
 
+// GetKey returns the key, including its time and reason of revocation if it was revoked. Both
+// are nil for an active key.
 func (r Repository) GetKey(ctx context.Context, apiKey string) (server.Key, error) {
 	query := `SELECT * FROM keys WHERE api_key = $1 LIMIT 1;`
 
 	key := server.Key{}
 
-	err := r.db.GetContext(ctx, &key, query, apiKey)
+	err := r.reader().GetContext(ctx, &key, query, apiKey)
+	if err != nil {
+		return server.Key{}, err
+	}
+
+	formatKeyTimestamp(&key)
+
+	err = r.decryptKey(&key)
+	if err != nil {
+		return server.Key{}, err
+	}
+
+	return key, nil
+}
+
+// GetKeyFold returns the key matching apiKey regardless of case. An exact match is preferred if
+// several keys differ only in case. The lookup uses the index on LOWER(api_key).
+func (r Repository) GetKeyFold(ctx context.Context, apiKey string) (server.Key, error) {
+	query := `SELECT * FROM keys WHERE LOWER(api_key) = LOWER($1) ORDER BY CASE WHEN api_key = $1 THEN 0 ELSE 1 END LIMIT 1;`
+
+	key := server.Key{}
+
+	err := r.reader().GetContext(ctx, &key, query, apiKey)
+	if err != nil {
+		return server.Key{}, err
+	}
+
+	formatKeyTimestamp(&key)
+
+	err = r.decryptKey(&key)
 	if err != nil {
 		return server.Key{}, err
 	}
@@ -50,160 +366,1563 @@ func (r Repository) GetKey(ctx context.Context, apiKey string) (server.Key, erro
 	return key, nil
 }
 
+// GetKeyMeta returns the key without loading its public and private key.
+func (r Repository) GetKeyMeta(ctx context.Context, apiKey string) (server.KeyMeta, error) {
+	query := `SELECT api_key, address, created_at, revoked_at FROM keys WHERE api_key = $1 LIMIT 1;`
+
+	key := server.KeyMeta{}
+
+	err := r.reader().GetContext(ctx, &key, query, apiKey)
+	if err != nil {
+		return server.KeyMeta{}, err
+	}
+
+	key.CreatedAt = formatDBTimestamp(key.CreatedAt)
+	if key.RevokedAt != nil {
+		revokedAt := formatDBTimestamp(*key.RevokedAt)
+		key.RevokedAt = &revokedAt
+	}
+
+	return key, nil
+}
+
 func (r Repository) GetAllKeysUsage(ctx context.Context) ([]server.KeyUsage, error) {
-	query := `SELECT k.api_key, k.public_key, k.private_key, k.address, k.created_at, k.revoked_at, SUM(COALESCE(t.data_bytes,0)) as data_bytes 
-	FROM keys k LEFT JOIN transactions t ON t.api_key = k.api_key WHERE k.revoked_at IS NULL GROUP BY k.api_key ORDER BY k.created_at;`
+	return r.GetAllKeysUsageWithFilter(ctx, false)
+}
+
+// GetAllKeysUsageWithFilter returns the usage of the active keys like GetAllKeysUsage, leaving
+// out the keys which have not written any data if onlyUsed is set.
+func (r Repository) GetAllKeysUsageWithFilter(ctx context.Context, onlyUsed bool) ([]server.KeyUsage, error) {
+	query := `SELECT k.api_key, k.public_key, k.private_key, k.private_key_encrypted, k.address, k.created_at, k.revoked_at, SUM(COALESCE(t.data_bytes,0)) as data_bytes,
+	SUM(COALESCE(t.fee_satoshis,0)) AS total_fees
+	FROM keys k LEFT JOIN transactions t ON t.api_key = k.api_key WHERE k.revoked_at IS NULL GROUP BY k.api_key`
+
+	if onlyUsed {
+		query += ` HAVING SUM(COALESCE(t.data_bytes,0)) > 0`
+	}
+
+	query += ` ORDER BY k.created_at;`
 
 	keys := make([]server.KeyUsage, 0)
 
-	err := r.db.SelectContext(ctx, &keys, query)
+	err := r.reader().SelectContext(ctx, &keys, query)
 	if err != nil {
 		return nil, err
 	}
 
 	for idx := range keys {
-		parsedTime, err := time.Parse(ISO8601Sqlite, keys[idx].CreatedAt)
-		if err == nil {
-			createdAtFormatted := parsedTime.Format(ISO8601DBOutput)
-			keys[idx].CreatedAt = createdAtFormatted
+		keys[idx].CreatedAt = formatDBTimestamp(keys[idx].CreatedAt)
+
+		err = r.decryptKey(&keys[idx].Key)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	return keys, nil
 }
 
-func (r Repository) GetAllKeys(ctx context.Context) ([]server.Key, error) {
-	query := `SELECT * FROM keys WHERE revoked_at IS NULL ORDER BY created_at;`
+// GetAllKeysUsageSince returns the usage of the active keys like GetAllKeysUsage, with
+// RecentDataBytes set to the data written in the last sinceWindow. Both totals are computed by
+// the same query, so they are consistent with each other.
+func (r Repository) GetAllKeysUsageSince(ctx context.Context, sinceWindow time.Duration) ([]server.KeyUsage, error) {
+	query := `SELECT k.api_key, k.public_key, k.private_key, k.private_key_encrypted, k.address, k.created_at, k.revoked_at, SUM(COALESCE(t.data_bytes,0)) as data_bytes,
+	SUM(COALESCE(t.fee_satoshis,0)) AS total_fees, SUM(CASE WHEN t.created_at >= $1 THEN t.data_bytes ELSE 0 END) AS recent_data_bytes
+	FROM keys k LEFT JOIN transactions t ON t.api_key = k.api_key WHERE k.revoked_at IS NULL GROUP BY k.api_key ORDER BY k.created_at;`
+
+	since := r.now().Add(-sinceWindow).UTC().Format(ISO8601)
 
-	keys := make([]server.Key, 0)
+	keys := make([]server.KeyUsage, 0)
 
-	err := r.db.SelectContext(ctx, &keys, query)
+	err := r.reader().SelectContext(ctx, &keys, query, since)
 	if err != nil {
 		return nil, err
 	}
 
 	for idx := range keys {
-		parsedTime, err := time.Parse(ISO8601Sqlite, keys[idx].CreatedAt)
-		if err == nil {
-			createdAtFormatted := parsedTime.Format(ISO8601DBOutput)
-			keys[idx].CreatedAt = createdAtFormatted
+		keys[idx].CreatedAt = formatDBTimestamp(keys[idx].CreatedAt)
+
+		err = r.decryptKey(&keys[idx].Key)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	return keys, nil
 }
 
-func (r Repository) InsertTransaction(ctx context.Context, tx server.Transaction) error {
-	createdAt := r.now().UTC().Format(ISO8601)
-	query := `INSERT INTO transactions (created_at, id, api_key, data_bytes, filename, secret, is_hash) VALUES ($1, $2, $3, $4, $5, $6, $7);`
-	_, err := r.db.ExecContext(ctx, query, createdAt, tx.ID, tx.ApiKey, tx.DataBytes, tx.Filename, tx.Secret, bool2integer(tx.IsHash))
+// ForEachKeyUsage calls fn with the usage of each active key in the same order as
+// GetAllKeysUsage, while the rows are read from the database. It stops at and returns the first
+// error returned by fn.
+func (r Repository) ForEachKeyUsage(ctx context.Context, fn func(server.KeyUsage) error) error {
+	query := `SELECT k.api_key, k.public_key, k.private_key, k.private_key_encrypted, k.address, k.created_at, k.revoked_at, SUM(COALESCE(t.data_bytes,0)) as data_bytes,
+	SUM(COALESCE(t.fee_satoshis,0)) AS total_fees
+	FROM keys k LEFT JOIN transactions t ON t.api_key = k.api_key WHERE k.revoked_at IS NULL GROUP BY k.api_key ORDER BY k.created_at;`
 
-	return err
+	rows, err := r.reader().QueryxContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key server.KeyUsage
+		if err := rows.StructScan(&key); err != nil {
+			return err
+		}
+
+		key.CreatedAt = formatDBTimestamp(key.CreatedAt)
+
+		if err := r.decryptKey(&key.Key); err != nil {
+			return err
+		}
+
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
 }
 
-func (r Repository) GetTransaction(ctx context.Context, txid string) (*server.Transaction, error) {
-	query := `SELECT * FROM transactions WHERE id = $1;`
+// GetTotalDataBytes returns the summed size of all stored transactions.
+func (r Repository) GetTotalDataBytes(ctx context.Context) (int64, error) {
+	query := `SELECT COALESCE(SUM(data_bytes),0) FROM transactions WHERE ` + notReserving + `;`
 
-	txs := make([]server.Transaction, 0)
+	var total int64
 
-	err := r.db.SelectContext(ctx, &txs, query, txid)
+	err := r.reader().GetContext(ctx, &total, query)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	if len(txs) > 0 {
-		return &txs[0], nil
+	return total, nil
+}
+
+// GetKeyWithUsage returns the key together with the number and size of its transactions, also
+// for a revoked key. The private key is not loaded, as the usage is shown to users and never used
+// for signing, so PrivateKey is always empty.
+func (r Repository) GetKeyWithUsage(ctx context.Context, apiKey string) (server.KeyUsage, error) {
+	query := `SELECT k.api_key, k.public_key, k.address, k.created_at, k.revoked_at, k.revoked_reason,
+	SUM(COALESCE(t.data_bytes,0)) AS data_bytes, COUNT(t.id) AS transaction_count, SUM(COALESCE(t.fee_satoshis,0)) AS total_fees
+	FROM keys k LEFT JOIN transactions t ON t.api_key = k.api_key WHERE k.api_key = $1 GROUP BY k.api_key;`
+
+	key := server.KeyUsage{}
+
+	err := r.reader().GetContext(ctx, &key, query, apiKey)
+	if err != nil {
+		return server.KeyUsage{}, err
 	}
 
-	return nil, sql.ErrNoRows
+	keys := []server.Key{key.Key}
+	formatKeyTimestamps(keys)
+	key.Key = keys[0]
+
+	return key, nil
 }
 
-func (r Repository) GetAllTransactions(ctx context.Context, all bool, hoursBack int) ([]server.Transaction, error) {
-	txs := make([]server.Transaction, 0)
-	var err error
+// GetKeysUsage returns the usage of the given keys in the same way as GetAllKeysUsage. Keys which
+// do not exist or are revoked are absent from the result.
+func (r Repository) GetKeysUsage(ctx context.Context, apiKeys []string) ([]server.KeyUsage, error) {
+	keys := make([]server.KeyUsage, 0)
 
-	if all {
-		query := `SELECT * FROM transactions ORDER BY created_at DESC;`
-		err = r.db.SelectContext(ctx, &txs, query)
-	} else {
-		now := r.now()
-		timeBack := now.Add(-1 * time.Duration(hoursBack) * time.Hour).UTC().Format(ISO8601)
-		query := `SELECT * FROM transactions WHERE created_at >= $1 ORDER BY created_at DESC;`
-		err = r.db.SelectContext(ctx, &txs, query, timeBack)
+	if len(apiKeys) == 0 {
+		return keys, nil
 	}
 
+	query, args, err := sqlx.In(`SELECT k.api_key, k.public_key, k.private_key, k.private_key_encrypted, k.address, k.created_at, k.revoked_at, SUM(COALESCE(t.data_bytes,0)) as data_bytes,
+	SUM(COALESCE(t.fee_satoshis,0)) AS total_fees
+	FROM keys k LEFT JOIN transactions t ON t.api_key = k.api_key WHERE k.revoked_at IS NULL AND k.api_key IN (?) GROUP BY k.api_key ORDER BY k.created_at;`, apiKeys)
 	if err != nil {
 		return nil, err
 	}
 
-	for idx := range txs {
-		parsedTime, err := time.Parse(ISO8601Sqlite, txs[idx].CreatedAt)
-		if err == nil {
-			createdAtFormatted := parsedTime.Format(ISO8601DBOutput)
-			txs[idx].CreatedAt = createdAtFormatted
+	err = r.reader().SelectContext(ctx, &keys, r.reader().Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range keys {
+		keys[idx].CreatedAt = formatDBTimestamp(keys[idx].CreatedAt)
+
+		err = r.decryptKey(&keys[idx].Key)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return txs, nil
+	return keys, nil
+}
+
+// GetUsageDelta returns the bytes written per api key at or after from and before to. Keys
+// without transactions in the window are not part of the result.
+func (r Repository) GetUsageDelta(ctx context.Context, from time.Time, to time.Time) (map[string]int64, error) {
+	query := `SELECT api_key, SUM(data_bytes) AS data_bytes FROM transactions WHERE created_at >= $1 AND created_at < $2 AND ` + notReserving + ` GROUP BY api_key;`
+
+	usages := make([]struct {
+		ApiKey    string `db:"api_key"`
+		DataBytes int64  `db:"data_bytes"`
+	}, 0)
+
+	err := r.reader().SelectContext(ctx, &usages, query, from.UTC().Format(ISO8601), to.UTC().Format(ISO8601))
+	if err != nil {
+		return nil, err
+	}
+
+	delta := make(map[string]int64, len(usages))
+	for _, usage := range usages {
+		delta[usage.ApiKey] = usage.DataBytes
+	}
+
+	return delta, nil
+}
+
+// GetAllKeys returns the active keys by default. With includeRevoked set the revoked keys are
+// returned as well, with revokedOnly set only the revoked keys are returned.
+func (r Repository) GetAllKeys(ctx context.Context, includeRevoked bool, revokedOnly bool) ([]server.Key, error) {
+	var query string
+
+	switch {
+	case revokedOnly:
+		query = `SELECT * FROM keys WHERE revoked_at IS NOT NULL ORDER BY created_at`
+	case includeRevoked:
+		query = `SELECT * FROM keys ORDER BY created_at`
+	default:
+		query = `SELECT * FROM keys WHERE revoked_at IS NULL ORDER BY created_at`
+	}
+
+	keys := make([]server.Key, 0)
+
+	err := r.reader().SelectContext(ctx, &keys, r.limitRows(query))
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.checkRows(len(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	formatKeyTimestamps(keys)
+
+	err = r.decryptKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
 }
 
-func (r Repository) GetTransactionInfo(ctx context.Context, from time.Time, to time.Time, granularity server.Granularity) ([]server.TransactionInfo, error) {
+// GetKeysMissingAddress returns the active keys without an address.
+func (r Repository) GetKeysMissingAddress(ctx context.Context) ([]server.Key, error) {
+	query := `SELECT * FROM keys WHERE revoked_at IS NULL AND (address IS NULL OR address = '') ORDER BY created_at;`
+
+	keys := make([]server.Key, 0)
+
+	err := r.reader().SelectContext(ctx, &keys, query)
+	if err != nil {
+		return nil, err
+	}
 
-	query := `SELECT SUBSTR(created_at, 0, $1) AS timestamp, count(*) as count, sum(data_bytes) AS data_bytes FROM transactions WHERE created_at > $2 AND created_at < $3 GROUP BY timestamp ORDER BY timestamp DESC;`
+	formatKeyTimestamps(keys)
 
-	txs := make([]TransactionInfo, 0)
-	position, format := granularitySecondsToPositionAndFormat(granularity)
-	err := r.db.SelectContext(ctx, &txs, query, position, from.Format(ISO8601), to.Format(ISO8601))
+	err = r.decryptKeys(keys)
 	if err != nil {
 		return nil, err
 	}
 
-	txInfos := make([]server.TransactionInfo, len(txs))
+	return keys, nil
+}
+
+// SetKeyAddress sets the address of the key. It returns sql.ErrNoRows if there is no such key.
+func (r Repository) SetKeyAddress(ctx context.Context, apiKey string, address string) error {
+	if address == "" {
+		return errors.New("address must not be empty")
+	}
+
+	query := `UPDATE keys SET address = $1 WHERE api_key = $2;`
 
-	for i, tx := range txs {
-		timestamp, err := time.Parse(format, tx.Timestamp)
+	return r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		result, err := ex.ExecContext(ctx, query, address, apiKey)
 		if err != nil {
 			return nil, err
 		}
-		txInfos[i] = server.TransactionInfo{
-			Timestamp: timestamp,
-			Count:     tx.Count,
-			DataBytes: tx.DataBytes,
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	return txInfos, nil
-}
+		if rows == 0 {
+			return nil, sql.ErrNoRows
+		}
 
-func (r Repository) Health(ctx context.Context) error {
-	return r.db.Ping()
+		return []auditEntry{{operation: AuditKeyAddressSet, targetID: apiKey}}, nil
+	})
 }
 
-func granularitySecondsToPositionAndFormat(granularitySeconds server.Granularity) (int, string) {
-	switch granularitySeconds {
-	case server.None:
-		return 20, "2006-01-02T15:04:05"
-	case server.Minute:
-		return 17, "2006-01-02T15:04"
-	case server.Hour:
-		return 14, "2006-01-02T15"
+// QueryKeys returns the keys matching all conditions of the filter, oldest first. The offset only
+// applies together with a limit. Without a limit the query is guarded by WithMaxRows like GetAllKeys.
+func (r Repository) QueryKeys(ctx context.Context, filter server.KeyFilter) ([]server.Key, error) {
+	var conditions []string
+	var args []interface{}
+
+	if !filter.CreatedAfter.IsZero() {
+		conditions = append(conditions, `created_at > ?`)
+		args = append(args, filter.CreatedAfter.UTC().Format(ISO8601))
 	}
 
-	// Day
-	return 11, "2006-01-02"
-}
+	if !filter.CreatedBefore.IsZero() {
+		conditions = append(conditions, `created_at < ?`)
+		args = append(args, filter.CreatedBefore.UTC().Format(ISO8601))
+	}
+
+	if filter.Revoked != nil {
+		if *filter.Revoked {
+			conditions = append(conditions, `revoked_at IS NOT NULL`)
+		} else {
+			conditions = append(conditions, `revoked_at IS NULL`)
+		}
+	}
+
+	if filter.AddressPrefix != "" {
+		conditions = append(conditions, `address LIKE ? `+likeEscapeClause)
+		args = append(args, escapeLike(filter.AddressPrefix)+"%")
+	}
 
-func (r Repository) DeactivateKey(ctx context.Context, apikey string) error {
-	query := `UPDATE keys SET revoked_at = $1 WHERE api_key = $2;`
+	query := `SELECT * FROM keys`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	query += ` ORDER BY created_at, api_key`
+
+	if filter.Limit > 0 {
+		query += ` LIMIT ? OFFSET ?;`
+		args = append(args, filter.Limit, filter.Offset)
+	} else {
+		query = r.limitRows(query)
+	}
 
-	_, err := r.db.ExecContext(ctx, query, r.now().Format(ISO8601), apikey)
+	keys := make([]server.Key, 0)
+
+	err := r.reader().SelectContext(ctx, &keys, r.reader().Rebind(query), args...)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if filter.Limit <= 0 {
+		err = r.checkRows(len(keys))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	formatKeyTimestamps(keys)
+
+	err = r.decryptKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// SearchKeysByAddressPrefix returns up to limit keys, including revoked ones, whose address
+// starts with prefix. LIKE wildcards in prefix match literally.
+func (r Repository) SearchKeysByAddressPrefix(ctx context.Context, prefix string, limit int) ([]server.Key, error) {
+	return r.QueryKeys(ctx, server.KeyFilter{AddressPrefix: prefix, Limit: limit})
+}
+
+// GetRevokedKeysBetween returns the keys revoked at or after from and before to, ordered by
+// the time of revocation.
+func (r Repository) GetRevokedKeysBetween(ctx context.Context, from time.Time, to time.Time) ([]server.Key, error) {
+	query := `SELECT * FROM keys WHERE revoked_at >= $1 AND revoked_at < $2 ORDER BY revoked_at;`
+
+	keys := make([]server.Key, 0)
+
+	err := r.reader().SelectContext(ctx, &keys, query, from.UTC().Format(ISO8601), to.UTC().Format(ISO8601))
+	if err != nil {
+		return nil, err
+	}
+
+	formatKeyTimestamps(keys)
+
+	err = r.decryptKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetRevokedKeys returns a page of the revoked keys, most recently revoked first, together with the
+// total number of revoked keys. Without a limit the query is guarded by WithMaxRows like GetAllKeys.
+func (r Repository) GetRevokedKeys(ctx context.Context, limit int, offset int) ([]server.Key, int, error) {
+	query := `SELECT * FROM keys WHERE revoked_at IS NOT NULL ORDER BY revoked_at DESC, api_key`
+
+	var args []interface{}
+	if limit > 0 {
+		query += ` LIMIT $1 OFFSET $2;`
+		args = append(args, limit, offset)
+	} else {
+		query = r.limitRows(query)
+	}
+
+	keys := make([]server.Key, 0)
+	var total int
+
+	err := r.withReadTx(ctx, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &total, `SELECT count(*) FROM keys WHERE revoked_at IS NOT NULL;`)
+		if err != nil {
+			return err
+		}
+
+		return tx.SelectContext(ctx, &keys, query, args...)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if limit <= 0 {
+		err = r.checkRows(len(keys))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	formatKeyTimestamps(keys)
+
+	err = r.decryptKeys(keys)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return keys, total, nil
+}
+
+// InsertTransaction stores the transaction, which has been broadcast, with the broadcast status.
+// It returns a server.InvalidTransactionError if the transaction has no id, a negative size or,
+// when WithApiKeyCheck is set, an unknown api key.
+func (r Repository) InsertTransaction(ctx context.Context, tx server.Transaction) error {
+	if ctx.Err() != nil && r.insertGrace > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(detachedContext{ctx}, r.insertGrace)
+		defer cancel()
+	}
+
+	err := r.validateTransaction(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	createdAt := r.now().UTC().Format(ISO8601)
+	query := `INSERT INTO transactions (created_at, id, api_key, data_bytes, filename, secret, is_hash, content_hash, fee_satoshis, status) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);`
+
+	err = r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		_, err := ex.ExecContext(ctx, query, createdAt, tx.ID, tx.ApiKey, tx.DataBytes, tx.Filename, tx.Secret, bool2integer(tx.IsHash), tx.ContentHash, tx.FeeSatoshis, server.TransactionStatusBroadcast)
+		if err != nil {
+			return nil, err
+		}
+
+		return []auditEntry{{operation: AuditTransactionInserted, targetID: tx.ID}}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if r.infoCache != nil {
+		r.infoCache.clear()
+	}
+
+	return nil
+}
+
+// InsertTransactionIdempotent stores the transaction like InsertTransaction unless a transaction
+// was stored with the same idempotency key before, in which case that transaction is returned and
+// nothing is stored.
+func (r Repository) InsertTransactionIdempotent(ctx context.Context, tx server.Transaction, idempotencyKey string) (*server.Transaction, error) {
+	if idempotencyKey == "" {
+		return nil, server.InvalidTransactionError{Field: "idempotency_key", Reason: "must not be empty"}
+	}
+
+	err := r.validateTransaction(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt := r.now().UTC().Format(ISO8601)
+	query := `INSERT INTO transactions (created_at, id, api_key, data_bytes, filename, secret, is_hash, content_hash, fee_satoshis, status, idempotency_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	ON CONFLICT (idempotency_key) DO NOTHING;`
+
+	var existing *server.Transaction
+
+	err = r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		result, err := ex.ExecContext(ctx, query, createdAt, tx.ID, tx.ApiKey, tx.DataBytes, tx.Filename, tx.Secret, bool2integer(tx.IsHash), tx.ContentHash, tx.FeeSatoshis, server.TransactionStatusBroadcast, idempotencyKey)
+		if err != nil {
+			return nil, err
+		}
+
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+
+		if inserted > 0 {
+			return []auditEntry{{operation: AuditTransactionInserted, targetID: tx.ID}}, nil
+		}
+
+		existing = &server.Transaction{}
+		err = sqlx.GetContext(ctx, ex, existing, `SELECT * FROM transactions WHERE idempotency_key = $1;`, idempotencyKey)
+		if err != nil {
+			return nil, err
+		}
+
+		existing.CreatedAt = formatDBTimestamp(existing.CreatedAt)
+
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if existing == nil && r.infoCache != nil {
+		r.infoCache.clear()
+	}
+
+	return existing, nil
+}
+
+// RestoreTransactions stores the transactions from a backup in one database transaction. Unlike
+// InsertTransaction it keeps the created_at and status of each transaction as they are, and a
+// backup without a status is restored as broadcast. Transactions whose id already exists are
+// skipped.
+func (r Repository) RestoreTransactions(ctx context.Context, txs []server.Transaction) error {
+	for _, tx := range txs {
+		err := r.validateTransaction(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		if tx.CreatedAt == "" {
+			return server.InvalidTransactionError{Field: "created_at", Reason: "must not be empty"}
+		}
+
+		if tx.Status != "" && !server.ValidTransactionStatus(tx.Status) {
+			return server.InvalidStatusError{Status: tx.Status}
+		}
+	}
+
+	query := `INSERT INTO transactions (created_at, id, api_key, data_bytes, filename, secret, secret_hash, is_hash, content_hash, status, status_at, fee_satoshis) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) ON CONFLICT (id) DO NOTHING;`
+
+	err := r.WithTx(ctx, func(dbTx *sqlx.Tx) error {
+		var entries []auditEntry
+
+		for _, tx := range txs {
+			status := tx.Status
+			if status == "" {
+				status = server.TransactionStatusBroadcast
+			}
+
+			result, err := dbTx.ExecContext(ctx, query, tx.CreatedAt, tx.ID, tx.ApiKey, tx.DataBytes, tx.Filename, tx.Secret, tx.SecretHash, bool2integer(tx.IsHash), tx.ContentHash, status, tx.StatusAt, tx.FeeSatoshis)
+			if err != nil {
+				return errors.Wrapf(err, "failed to restore transaction %s", tx.ID)
+			}
+
+			restored, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+
+			if restored > 0 {
+				entries = append(entries, auditEntry{operation: AuditTransactionRestored, targetID: tx.ID})
+			}
+		}
+
+		return r.insertAuditEntries(ctx, dbTx, entries)
+	})
+	if err != nil {
+		return err
+	}
+
+	if r.infoCache != nil {
+		r.infoCache.clear()
+	}
+
+	return nil
+}
+
+func (r Repository) validateTransaction(ctx context.Context, tx server.Transaction) error {
+	if tx.ID == "" {
+		return server.InvalidTransactionError{Field: "id", Reason: "must not be empty"}
+	}
+
+	if tx.DataBytes < 0 {
+		return server.InvalidTransactionError{Field: "data_bytes", Reason: "must not be negative"}
+	}
+
+	if tx.FeeSatoshis < 0 {
+		return server.InvalidTransactionError{Field: "fee_satoshis", Reason: "must not be negative"}
+	}
+
+	if r.maxDataBytes > 0 && tx.DataBytes > r.maxDataBytes {
+		return errors.Wrapf(server.ErrDataTooLarge, "%d data bytes exceed the limit of %d", tx.DataBytes, r.maxDataBytes)
+	}
+
+	if r.checkApiKey {
+		var count int
+		err := r.db.GetContext(ctx, &count, `SELECT count(*) FROM keys WHERE api_key = $1;`, tx.ApiKey)
+		if err != nil {
+			return err
+		}
+
+		if count == 0 {
+			return server.InvalidTransactionError{Field: "api_key", Reason: "is unknown"}
+		}
+	}
+
+	return nil
+}
+
+func (r Repository) GetTransaction(ctx context.Context, txid string) (*server.Transaction, error) {
+	query := `SELECT * FROM transactions WHERE id = $1;`
+
+	txs := make([]server.Transaction, 0)
+
+	err := r.reader().SelectContext(ctx, &txs, query, txid)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(txs) > 0 {
+		return &txs[0], nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetTransactionsWithoutSecret returns the transactions of the api key which were written without
+// a recovery secret, newest first.
+func (r Repository) GetTransactionsWithoutSecret(ctx context.Context, apiKey string) ([]server.Transaction, error) {
+	query := `SELECT * FROM transactions WHERE api_key = $1 AND (secret IS NULL OR secret = '') ORDER BY created_at DESC, id;`
+
+	txs := make([]server.Transaction, 0)
+
+	err := r.reader().SelectContext(ctx, &txs, query, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range txs {
+		txs[idx].CreatedAt = formatDBTimestamp(txs[idx].CreatedAt)
+	}
+
+	return txs, nil
+}
+
+// GetTransactionEnriched returns the transaction with the address and public key of its api key,
+// which are empty if the key is not stored. The secret of the transaction and the private key are
+// never returned. It returns sql.ErrNoRows if there is no transaction with the id.
+func (r Repository) GetTransactionEnriched(ctx context.Context, txid string) (server.EnrichedTransaction, error) {
+	query := `SELECT t.*, COALESCE(k.address, '') AS address, COALESCE(k.public_key, '') AS public_key
+	FROM transactions t LEFT JOIN keys k ON k.api_key = t.api_key WHERE t.id = $1;`
+
+	var tx server.EnrichedTransaction
+
+	err := r.reader().GetContext(ctx, &tx, query, txid)
+	if err != nil {
+		return server.EnrichedTransaction{}, err
+	}
+
+	tx.Secret = ""
+	tx.SecretHash = ""
+	tx.CreatedAt = formatDBTimestamp(tx.CreatedAt)
+
+	return tx, nil
+}
+
+// CountKeyTransactionsSince returns the number of transactions written with the api key at or
+// after since.
+func (r Repository) CountKeyTransactionsSince(ctx context.Context, apiKey string, since time.Time) (int64, error) {
+	query := `SELECT count(*) FROM transactions WHERE api_key = $1 AND created_at >= $2;`
+
+	var count int64
+
+	err := r.reader().GetContext(ctx, &count, query, apiKey, since.UTC().Format(ISO8601))
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// EstimateCost returns the cost of the transactions of apiKey created from (inclusive) to to
+// (exclusive), charging perByte for each data byte and perTx for each transaction.
+func (r Repository) EstimateCost(ctx context.Context, apiKey string, from time.Time, to time.Time, perByte float64, perTx float64) (float64, error) {
+	query := `SELECT COALESCE(SUM(data_bytes), 0) * CAST($1 AS DOUBLE PRECISION) + COUNT(*) * CAST($2 AS DOUBLE PRECISION) FROM transactions WHERE api_key = $3 AND created_at >= $4 AND created_at < $5 AND ` + notReserving + `;`
+
+	var cost float64
+
+	err := r.reader().GetContext(ctx, &cost, query, perByte, perTx, apiKey, from.UTC().Format(ISO8601), to.UTC().Format(ISO8601))
+	if err != nil {
+		return 0, err
+	}
+
+	return cost, nil
+}
+
+// GetTransactionWithAge returns the transaction and the time passed since it was created
+// according to the clock of the repository.
+func (r Repository) GetTransactionWithAge(ctx context.Context, txid string) (server.Transaction, time.Duration, error) {
+	tx, err := r.GetTransaction(ctx, txid)
+	if err != nil {
+		return server.Transaction{}, 0, err
+	}
+
+	createdAt, err := parseDBTimestamp(tx.CreatedAt)
+	if err != nil {
+		return server.Transaction{}, 0, errors.Wrapf(err, "invalid created_at of transaction %s", txid)
+	}
+
+	tx.CreatedAt = formatDBTimestamp(tx.CreatedAt)
+
+	return *tx, r.now().Sub(createdAt), nil
+}
+
+// GetTransactionWithKeyStatus returns the transaction and whether the key it was written with is
+// still active. A key which is no longer stored is reported as inactive.
+func (r Repository) GetTransactionWithKeyStatus(ctx context.Context, txid string) (server.Transaction, bool, error) {
+	query := `SELECT t.*, CASE WHEN k.api_key IS NOT NULL AND k.revoked_at IS NULL THEN 1 ELSE 0 END AS key_active
+	FROM transactions t LEFT JOIN keys k ON k.api_key = t.api_key WHERE t.id = $1;`
+
+	result := struct {
+		server.Transaction
+		KeyActive bool `db:"key_active"`
+	}{}
+
+	err := r.reader().GetContext(ctx, &result, query, txid)
+	if err != nil {
+		return server.Transaction{}, false, err
+	}
+
+	result.Transaction.CreatedAt = formatDBTimestamp(result.Transaction.CreatedAt)
+
+	return result.Transaction, result.KeyActive, nil
+}
+
+// GetTransactionForUpdate reads a transaction within tx and locks its row until tx is committed
+// or rolled back, so that concurrent workers updating the same transaction are serialized.
+// On PostgreSQL this uses SELECT ... FOR UPDATE. SQLite does not support row locks; there the
+// plain SELECT is used, as SQLite already serializes write transactions on the whole database.
+func (r Repository) GetTransactionForUpdate(ctx context.Context, tx *sqlx.Tx, txid string) (*server.Transaction, error) {
+	query := `SELECT * FROM transactions WHERE id = $1`
+	if r.isPostgres() {
+		query += ` FOR UPDATE`
+	}
+
+	transaction := server.Transaction{}
+
+	err := tx.GetContext(ctx, &transaction, query+`;`, txid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transaction, nil
+}
+
+func (r Repository) GetAllTransactions(ctx context.Context, all bool, hoursBack int) ([]server.Transaction, error) {
+	txs := make([]server.Transaction, 0)
+	var err error
+
+	if all {
+		query := `SELECT * FROM transactions WHERE ` + notReserving + ` ORDER BY created_at DESC`
+		err = r.reader().SelectContext(ctx, &txs, r.limitRows(query))
+	} else {
+		now := r.now()
+		timeBack := now.Add(-1 * time.Duration(hoursBack) * time.Hour).UTC().Format(ISO8601)
+		query := `SELECT * FROM transactions WHERE created_at >= $1 AND ` + notReserving + ` ORDER BY created_at DESC`
+		err = r.reader().SelectContext(ctx, &txs, r.limitRows(query), timeBack)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.checkRows(len(txs))
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range txs {
+		txs[idx].CreatedAt = formatDBTimestamp(txs[idx].CreatedAt)
+	}
+
+	return txs, nil
+}
+
+// GetTransactionSummaries returns the same transactions as GetAllTransactions, newest first, but
+// reads only the columns of server.TransactionSummary. It returns the page given by limit and
+// offset, or like GetAllTransactions all transactions guarded by WithMaxRows if limit is not
+// positive.
+func (r Repository) GetTransactionSummaries(ctx context.Context, all bool, hoursBack int, limit int, offset int) ([]server.TransactionSummary, error) {
+	query := `SELECT id, api_key, data_bytes, filename, created_at FROM transactions`
+
+	var args []interface{}
+	if !all {
+		query += ` WHERE created_at >= $1`
+		args = append(args, r.now().Add(-1*time.Duration(hoursBack)*time.Hour).UTC().Format(ISO8601))
+	}
+
+	query += ` ORDER BY created_at DESC, id`
+
+	if limit > 0 {
+		query += fmt.Sprintf(` LIMIT $%d OFFSET $%d;`, len(args)+1, len(args)+2)
+		args = append(args, limit, offset)
+	} else {
+		query = r.limitRows(query)
+	}
+
+	summaries := make([]server.TransactionSummary, 0)
+
+	err := r.reader().SelectContext(ctx, &summaries, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit <= 0 {
+		err = r.checkRows(len(summaries))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for idx := range summaries {
+		summaries[idx].CreatedAt = formatDBTimestamp(summaries[idx].CreatedAt)
+	}
+
+	return summaries, nil
+}
+
+// GetRecentTransactions returns the n newest transactions, newest first. The index on created_at
+// lets the database read just these rows.
+func (r Repository) GetRecentTransactions(ctx context.Context, n int) ([]server.Transaction, error) {
+	txs := make([]server.Transaction, 0)
+
+	if n <= 0 {
+		return txs, nil
+	}
+
+	query := `SELECT * FROM transactions ORDER BY created_at DESC, id LIMIT $1;`
+
+	err := r.reader().SelectContext(ctx, &txs, query, n)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range txs {
+		txs[idx].CreatedAt = formatDBTimestamp(txs[idx].CreatedAt)
+	}
+
+	return txs, nil
+}
+
+// GetTransactionsSince returns up to limit transactions created after since, oldest first. Pass
+// the created_at of the last transaction returned to get the next ones. Transactions created
+// within the same millisecond as that one and cut off by the limit are skipped.
+func (r Repository) GetTransactionsSince(ctx context.Context, since time.Time, limit int) ([]server.Transaction, error) {
+	query := `SELECT * FROM transactions WHERE created_at > $1 ORDER BY created_at, id LIMIT $2;`
+
+	txs := make([]server.Transaction, 0)
+
+	err := r.reader().SelectContext(ctx, &txs, query, since.UTC().Format(ISO8601), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range txs {
+		txs[idx].CreatedAt = formatDBTimestamp(txs[idx].CreatedAt)
+	}
+
+	return txs, nil
+}
+
+// GetTransactionsForDay returns the transactions created on the UTC calendar day, given as
+// YYYY-MM-DD, oldest first. It returns server.ErrInvalidDay for any other format.
+func (r Repository) GetTransactionsForDay(ctx context.Context, day string) ([]server.Transaction, error) {
+	parsed, err := time.Parse("2006-01-02", day)
+	if err != nil || parsed.Format("2006-01-02") != day {
+		return nil, errors.Wrapf(server.ErrInvalidDay, "%q", day)
+	}
+
+	query := `SELECT * FROM transactions WHERE created_at LIKE $1 ORDER BY created_at, id;`
+
+	txs := make([]server.Transaction, 0)
+
+	err = r.reader().SelectContext(ctx, &txs, query, day+"%")
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range txs {
+		txs[idx].CreatedAt = formatDBTimestamp(txs[idx].CreatedAt)
+	}
+
+	return txs, nil
+}
+
+// QueryTransactions returns the transactions matching all set fields of filter together with the
+// total number of matches, which ignores Limit and Offset. Both are read from one snapshot.
+// Without a limit the query is guarded by WithMaxRows like GetAllTransactions.
+func (r Repository) QueryTransactions(ctx context.Context, filter server.TransactionFilter) ([]server.Transaction, int, error) {
+	var order string
+	switch filter.SortOrder {
+	case "", server.SortDescending:
+		order = "DESC"
+	case server.SortAscending:
+		order = "ASC"
+	default:
+		return nil, 0, errors.Wrapf(server.ErrInvalidSortOrder, "%q", filter.SortOrder)
+	}
+
+	conditions := []string{notReserving}
+	var args []interface{}
+
+	if !filter.From.IsZero() {
+		conditions = append(conditions, `created_at >= ?`)
+		args = append(args, filter.From.UTC().Format(ISO8601))
+	}
+
+	if !filter.To.IsZero() {
+		conditions = append(conditions, `created_at < ?`)
+		args = append(args, filter.To.UTC().Format(ISO8601))
+	}
+
+	if filter.MinBytes > 0 {
+		conditions = append(conditions, `data_bytes >= ?`)
+		args = append(args, filter.MinBytes)
+	}
+
+	if filter.MaxBytes > 0 {
+		conditions = append(conditions, `data_bytes <= ?`)
+		args = append(args, filter.MaxBytes)
+	}
+
+	if filter.ApiKey != "" {
+		conditions = append(conditions, `api_key = ?`)
+		args = append(args, filter.ApiKey)
+	}
+
+	if filter.IsHash != nil {
+		conditions = append(conditions, `is_hash = ?`)
+		args = append(args, bool2integer(*filter.IsHash))
+	}
+
+	where := ` WHERE ` + strings.Join(conditions, ` AND `)
+
+	query := `SELECT * FROM transactions` + where + ` ORDER BY created_at ` + order + `, id`
+	queryArgs := args
+
+	if filter.Limit > 0 {
+		query += ` LIMIT ? OFFSET ?;`
+		queryArgs = append(append([]interface{}{}, args...), filter.Limit, filter.Offset)
+	} else {
+		query = r.limitRows(query)
+	}
+
+	txs := make([]server.Transaction, 0)
+	var total int
+
+	err := r.withReadTx(ctx, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &total, tx.Rebind(`SELECT count(*) FROM transactions`+where+`;`), args...)
+		if err != nil {
+			return err
+		}
+
+		return tx.SelectContext(ctx, &txs, tx.Rebind(query), queryArgs...)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if filter.Limit <= 0 {
+		err = r.checkRows(len(txs))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	for idx := range txs {
+		txs[idx].CreatedAt = formatDBTimestamp(txs[idx].CreatedAt)
+	}
+
+	return txs, total, nil
+}
+
+// GetOrphanedTransactions returns the transactions whose api key has no stored key.
+func (r Repository) GetOrphanedTransactions(ctx context.Context) ([]server.Transaction, error) {
+	query := `SELECT t.* FROM transactions t WHERE NOT EXISTS (SELECT 1 FROM keys k WHERE k.api_key = t.api_key) ORDER BY t.created_at DESC;`
+
+	txs := make([]server.Transaction, 0)
+
+	err := r.reader().SelectContext(ctx, &txs, query)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range txs {
+		txs[idx].CreatedAt = formatDBTimestamp(txs[idx].CreatedAt)
+	}
+
+	return txs, nil
+}
+
+// ReattributeTransactions moves all transactions of fromApiKey to toApiKey and returns the number
+// of transactions moved.
+func (r Repository) ReattributeTransactions(ctx context.Context, fromApiKey string, toApiKey string) (int64, error) {
+	query := `UPDATE transactions SET api_key = $1 WHERE api_key = $2;`
+
+	var reattributed int64
+
+	err := r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		result, err := ex.ExecContext(ctx, query, toApiKey, fromApiKey)
+		if err != nil {
+			return nil, err
+		}
+
+		reattributed, err = result.RowsAffected()
+		if err != nil || reattributed == 0 {
+			return nil, err
+		}
+
+		return []auditEntry{{operation: AuditTransactionsReattributed, targetID: fromApiKey}}, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return reattributed, nil
+}
+
+// SearchTransactionsByFilename returns the transactions whose filename contains the given text.
+// The text is matched literally, LIKE wildcards in it have no special meaning.
+func (r Repository) SearchTransactionsByFilename(ctx context.Context, filename string) ([]server.Transaction, error) {
+	query := `SELECT * FROM transactions WHERE filename LIKE $1 ` + likeEscapeClause + ` ORDER BY created_at DESC;`
+
+	txs := make([]server.Transaction, 0)
+
+	err := r.reader().SelectContext(ctx, &txs, query, "%"+escapeLike(filename)+"%")
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range txs {
+		txs[idx].CreatedAt = formatDBTimestamp(txs[idx].CreatedAt)
+	}
+
+	return txs, nil
+}
+
+// GetTopFilenames returns the limit filenames with the most transactions, most first. Transactions
+// without a filename are not counted.
+func (r Repository) GetTopFilenames(ctx context.Context, limit int) ([]server.FilenameCount, error) {
+	query := `SELECT filename, count(*) AS count FROM transactions WHERE filename IS NOT NULL AND filename <> ''
+	GROUP BY filename ORDER BY count DESC, filename LIMIT $1;`
+
+	counts := make([]server.FilenameCount, 0)
+
+	err := r.reader().SelectContext(ctx, &counts, query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// GetThroughput returns the data bytes and transactions written per second, averaged over the
+// window up to now. The window must be positive.
+func (r Repository) GetThroughput(ctx context.Context, window time.Duration) (bytesPerSec float64, txPerSec float64, err error) {
+	if window <= 0 {
+		return 0, 0, errors.Wrapf(server.ErrInvalidRange, "window must be positive, got %s", window)
+	}
+
+	query := `SELECT count(*) AS count, COALESCE(sum(data_bytes), 0) AS data_bytes FROM transactions WHERE created_at >= $1 AND created_at < $2 AND ` + notReserving + `;`
+
+	now := r.now().UTC()
+
+	var totals server.TransactionInfoSummary
+
+	err = r.reader().GetContext(ctx, &totals, query, now.Add(-window).Format(ISO8601), now.Format(ISO8601))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	seconds := window.Seconds()
+
+	return float64(totals.TotalDataBytes) / seconds, float64(totals.TotalCount) / seconds, nil
+}
+
+// GetKeyUsageShares returns for each api key with transactions the percentage of the data
+// bytes of all transactions written with it, most first. All percentages are 0 if no data was
+// written.
+func (r Repository) GetKeyUsageShares(ctx context.Context) ([]server.KeyUsageShare, error) {
+	isPostgres := r.reader().DriverName() == "postgres"
+
+	columns := `api_key, COALESCE(SUM(data_bytes),0) AS data_bytes`
+	if isPostgres {
+		columns += `, COALESCE(SUM(data_bytes) * 100.0 / NULLIF(SUM(SUM(data_bytes)) OVER (), 0), 0) AS percent`
+	}
+
+	query := `SELECT ` + columns + ` FROM transactions WHERE ` + notReserving + ` GROUP BY api_key ORDER BY data_bytes DESC, api_key;`
+
+	shares := make([]server.KeyUsageShare, 0)
+
+	err := r.reader().SelectContext(ctx, &shares, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isPostgres {
+		// The grand total is summed from the grouped rows, so it matches them.
+		var total int64
+		for _, share := range shares {
+			total += share.DataBytes
+		}
+
+		if total > 0 {
+			for idx := range shares {
+				shares[idx].Percent = float64(shares[idx].DataBytes) * 100 / float64(total)
+			}
+		}
+	}
+
+	return shares, nil
+}
+
+// GetWriteGaps returns the intervals longer than minGap between consecutive transactions of
+// apiKey, oldest first. PostgreSQL pairs the transactions with a window function, SQLite returns
+// the creation times in order and they are paired in a single pass.
+func (r Repository) GetWriteGaps(ctx context.Context, apiKey string, minGap time.Duration) ([]server.Gap, error) {
+	type gapRow struct {
+		From string `db:"gap_from"`
+		To   string `db:"gap_to"`
+	}
+
+	rows := make([]gapRow, 0)
+
+	if r.reader().DriverName() == "postgres" {
+		query := `SELECT gap_from, gap_to FROM (
+			SELECT LAG(created_at) OVER (ORDER BY created_at, id) AS gap_from, created_at AS gap_to FROM transactions WHERE api_key = $1
+		) g WHERE gap_from IS NOT NULL AND EXTRACT(EPOCH FROM gap_to::timestamptz - gap_from::timestamptz) > $2
+		ORDER BY gap_to;`
+
+		err := r.reader().SelectContext(ctx, &rows, query, apiKey, minGap.Seconds())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		query := `SELECT created_at FROM transactions WHERE api_key = $1 ORDER BY created_at, id;`
+
+		var createdAts []string
+
+		err := r.reader().SelectContext(ctx, &createdAts, query, apiKey)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 1; i < len(createdAts); i++ {
+			rows = append(rows, gapRow{From: createdAts[i-1], To: createdAts[i]})
+		}
+	}
+
+	gaps := make([]server.Gap, 0)
+
+	for _, row := range rows {
+		from, err := parseDBTimestamp(row.From)
+		if err != nil {
+			return nil, err
+		}
+
+		to, err := parseDBTimestamp(row.To)
+		if err != nil {
+			return nil, err
+		}
+
+		// PostgreSQL has filtered the gaps already, which this repeats with the same result.
+		if to.Sub(from) > minGap {
+			gaps = append(gaps, server.Gap{From: from, To: to, Duration: to.Sub(from)})
+		}
+	}
+
+	return gaps, nil
+}
+
+// GetTransactionsByKeyAndType returns a page of the transactions of apiKey which either are or
+// are not hash-only writes, newest first.
+func (r Repository) GetTransactionsByKeyAndType(ctx context.Context, apiKey string, isHash bool, limit int, offset int) ([]server.Transaction, error) {
+	query := `SELECT * FROM transactions WHERE api_key = $1 AND is_hash = $2 ORDER BY created_at DESC, id LIMIT $3 OFFSET $4;`
+
+	txs := make([]server.Transaction, 0)
+
+	err := r.reader().SelectContext(ctx, &txs, query, apiKey, bool2integer(isHash), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range txs {
+		txs[idx].CreatedAt = formatDBTimestamp(txs[idx].CreatedAt)
+	}
+
+	return txs, nil
+}
+
+// FindDuplicateContent returns the ids of the transactions of apiKey by the content hash which
+// they share, oldest first. Content hashes of only one transaction are left out.
+func (r Repository) FindDuplicateContent(ctx context.Context, apiKey string) (map[string][]string, error) {
+	query := `SELECT content_hash, id FROM transactions WHERE api_key = $1 AND content_hash IN (
+		SELECT content_hash FROM transactions WHERE api_key = $1 AND content_hash <> '' GROUP BY content_hash HAVING count(*) > 1
+	) ORDER BY content_hash, created_at, id;`
+
+	rows := make([]struct {
+		ContentHash string `db:"content_hash"`
+		ID          string `db:"id"`
+	}, 0)
+
+	err := r.reader().SelectContext(ctx, &rows, query, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	duplicates := make(map[string][]string)
+	for _, row := range rows {
+		duplicates[row.ContentHash] = append(duplicates[row.ContentHash], row.ID)
+	}
+
+	return duplicates, nil
+}
+
+// FindDuplicateAddresses returns the api keys by the address which they share, oldest first.
+// Only active keys are considered, so an address shared with a revoked key is left out.
+func (r Repository) FindDuplicateAddresses(ctx context.Context) (map[string][]string, error) {
+	query := `SELECT address, api_key FROM keys WHERE revoked_at IS NULL AND address IN (
+		SELECT address FROM keys WHERE revoked_at IS NULL GROUP BY address HAVING count(*) > 1
+	) ORDER BY address, created_at, api_key;`
+
+	rows := make([]struct {
+		Address string `db:"address"`
+		ApiKey  string `db:"api_key"`
+	}, 0)
+
+	err := r.reader().SelectContext(ctx, &rows, query)
+	if err != nil {
+		return nil, err
+	}
+
+	duplicates := make(map[string][]string)
+	for _, row := range rows {
+		duplicates[row.Address] = append(duplicates[row.Address], row.ApiKey)
+	}
+
+	return duplicates, nil
+}
+
+// Health checks that the database is reachable and, if WithSchemaVersionCheck is set, that its
+// schema has the expected version.
+func (r Repository) Health(ctx context.Context) error {
+	err := r.db.PingContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if r.schemaVersion > 0 {
+		return r.CheckSchemaVersion(ctx, r.schemaVersion)
+	}
+
+	return nil
+}
+
+// CheckSchemaVersion returns server.ErrSchemaMismatch if the version of the applied migrations
+// differs from expected or the last migration failed halfway.
+func (r Repository) CheckSchemaVersion(ctx context.Context, expected int) error {
+	query := `SELECT version, dirty FROM schema_migrations LIMIT 1;`
+
+	migration := struct {
+		Version int  `db:"version"`
+		Dirty   bool `db:"dirty"`
+	}{}
+
+	err := r.db.GetContext(ctx, &migration, query)
+	if err == sql.ErrNoRows {
+		return errors.Wrapf(server.ErrSchemaMismatch, "expected version %d, found no migrations", expected)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read schema version")
+	}
+
+	if migration.Dirty {
+		return errors.Wrapf(server.ErrSchemaMismatch, "expected version %d, found dirty version %d", expected, migration.Version)
+	}
+
+	if migration.Version != expected {
+		return errors.Wrapf(server.ErrSchemaMismatch, "expected version %d, found version %d", expected, migration.Version)
+	}
+
+	return nil
+}
+
+// DeactivateKey revokes the key. The reason is stored alongside the time of revocation, an empty
+// reason is stored as NULL.
+func (r Repository) DeactivateKey(ctx context.Context, apikey string, reason string) error {
+	query := `UPDATE keys SET revoked_at = $1, revoked_reason = $2 WHERE api_key = $3;`
+
+	return r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		_, err := ex.ExecContext(ctx, query, r.now().UTC().Format(ISO8601), nullString(reason), apikey)
+		if err != nil {
+			return nil, err
+		}
+
+		return []auditEntry{{operation: AuditKeyRevoked, targetID: apikey}}, nil
+	})
+}
+
+// DeactivateKeys revokes all given keys in one transaction and returns the number of keys revoked.
+// Keys which are already revoked keep their original time and reason of revocation.
+func (r Repository) DeactivateKeys(ctx context.Context, apiKeys []string, reason string) (int64, error) {
+	if len(apiKeys) == 0 {
+		return 0, nil
+	}
+
+	revokedAt := r.now().UTC().Format(ISO8601)
+
+	var revoked []string
+
+	err := r.WithTx(ctx, func(tx *sqlx.Tx) error {
+		revoked = revoked[:0]
+
+		update := `UPDATE keys SET revoked_at = ?, revoked_reason = ? WHERE revoked_at IS NULL AND api_key IN (?)`
+
+		if r.isPostgres() {
+			query, args, err := sqlx.In(update+` RETURNING api_key;`, revokedAt, nullString(reason), apiKeys)
+			if err != nil {
+				return err
+			}
+
+			err = tx.SelectContext(ctx, &revoked, tx.Rebind(query), args...)
+			if err != nil {
+				return err
+			}
+		} else {
+			// The bundled SQLite has no RETURNING. It fails the transaction rather than let another
+			// writer commit between the two statements, so the active keys read are the ones revoked.
+			query, args, err := sqlx.In(`SELECT api_key FROM keys WHERE revoked_at IS NULL AND api_key IN (?);`, apiKeys)
+			if err != nil {
+				return err
+			}
+
+			err = tx.SelectContext(ctx, &revoked, tx.Rebind(query), args...)
+			if err != nil {
+				return err
+			}
+
+			query, args, err = sqlx.In(update+`;`, revokedAt, nullString(reason), apiKeys)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.ExecContext(ctx, tx.Rebind(query), args...)
+			if err != nil {
+				return err
+			}
+		}
+
+		entries := make([]auditEntry, len(revoked))
+		for i, apiKey := range revoked {
+			entries[i] = auditEntry{operation: AuditKeyRevoked, targetID: apiKey}
+		}
+
+		return r.insertAuditEntries(ctx, tx, entries)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(revoked)), nil
+}
+
+// PreviewDeactivateKeys returns how many of the given keys DeactivateKeys would revoke, without
+// revoking them.
+func (r Repository) PreviewDeactivateKeys(ctx context.Context, apiKeys []string) (int64, error) {
+	if len(apiKeys) == 0 {
+		return 0, nil
+	}
+
+	query, args, err := sqlx.In(`SELECT count(*) FROM keys WHERE revoked_at IS NULL AND api_key IN (?);`, apiKeys)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+
+	err = r.db.GetContext(ctx, &count, r.db.Rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// WithTx runs fn within a database transaction. The transaction is committed if fn returns
+// nil and rolled back otherwise.
+func (r Repository) WithTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	return r.withTxOptions(ctx, nil, fn)
+}
+
+// readSnapshotTxOptions is used for multi-statement reads which have to see one consistent snapshot.
+// SQLite ignores the options, its transactions are serializable anyway.
+var readSnapshotTxOptions = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+// withTxOptions runs fn within a transaction. On PostgreSQL the whole transaction is retried on
+// serialization failures and deadlocks if WithSerializationRetries is set.
+func (r Repository) withTxOptions(ctx context.Context, opts *sql.TxOptions, fn func(tx *sqlx.Tx) error) error {
+	run := func() error {
+		tx, err := r.db.BeginTxx(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		err = r.setStatementTimeout(ctx, tx)
+		if err == nil {
+			err = fn(tx)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	if !r.isPostgres() {
+		return run()
+	}
+
+	return retry(ctx, r.txRetries, r.txRetryBackoff, isSerializationFailure, run)
+}
+
+// withReadTx runs the read-only fn on one consistent snapshot of the read database.
+func (r Repository) withReadTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := r.reader().BeginTxx(ctx, readSnapshotTxOptions)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	err = r.setStatementTimeout(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	return fn(tx)
+}
+
+// setStatementTimeout applies WithStatementTimeout to the transaction on PostgreSQL.
+func (r Repository) setStatementTimeout(ctx context.Context, tx *sqlx.Tx) error {
+	if r.statementTimeout <= 0 || tx.DriverName() != "postgres" {
+		return nil
+	}
+
+	// SET does not take parameters
+	_, err := tx.ExecContext(ctx, `SET LOCAL statement_timeout = `+strconv.FormatInt(r.statementTimeout.Milliseconds(), 10)+`;`)
+
+	return err
+}
+
+// queryer is implemented by both *sqlx.DB and *sqlx.Tx.
+type queryer interface {
+	sqlx.QueryerContext
+	DriverName() string
+}
+
+// limitRows terminates the query, limiting it to one row more than WithMaxRows allows so that
+// checkRows can tell whether the result was cut off.
+func (r Repository) limitRows(query string) string {
+	if r.maxRows <= 0 {
+		return query + `;`
+	}
+
+	return query + ` LIMIT ` + strconv.Itoa(r.maxRows+1) + `;`
+}
+
+// checkRows returns server.ErrResultTooLarge if a query terminated by limitRows returned more
+// rows than WithMaxRows allows.
+func (r Repository) checkRows(count int) error {
+	if r.maxRows > 0 && count > r.maxRows {
+		return errors.Wrapf(server.ErrResultTooLarge, "more than %d rows", r.maxRows)
 	}
 
 	return nil
 }
 
+// reader returns the database for read-only queries, which is the read replica if there is one.
+func (r Repository) reader() *database {
+	if r.readDB != nil {
+		return r.readDB
+	}
+
+	return r.db
+}
+
+func (r Repository) isPostgres() bool {
+	return r.db.DriverName() == "postgres"
+}
+
+// formatDBTimestamp converts timestamps as returned by SQLite into the format returned by PostgreSQL.
+// Timestamps in any other format are returned unchanged.
+func formatDBTimestamp(ts string) string {
+	parsedTime, err := time.Parse(ISO8601Sqlite, ts)
+	if err != nil {
+		return ts
+	}
+
+	return parsedTime.Format(ISO8601DBOutput)
+}
+
+// parseDBTimestamp parses a timestamp as written by the Repository or as returned by SQLite or
+// PostgreSQL for timestamps written by other clients.
+func parseDBTimestamp(ts string) (time.Time, error) {
+	var err error
+
+	for _, layout := range []string{ISO8601, iso8601Variable, ISO8601DBOutput, ISO8601Sqlite} {
+		var parsedTime time.Time
+
+		parsedTime, err = time.Parse(layout, ts)
+		if err == nil {
+			return parsedTime.UTC(), nil
+		}
+	}
+
+	return time.Time{}, err
+}
+
+func formatKeyTimestamps(keys []server.Key) {
+	for idx := range keys {
+		formatKeyTimestamp(&keys[idx])
+	}
+}
+
+func formatKeyTimestamp(key *server.Key) {
+	key.CreatedAt = formatDBTimestamp(key.CreatedAt)
+	if key.RevokedAt != nil {
+		revokedAt := formatDBTimestamp(*key.RevokedAt)
+		key.RevokedAt = &revokedAt
+	}
+}
+
+// nullString maps an empty string to NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
 func bool2integer(b bool) int {
 	if b {
 		return 1
@@ -1,21 +1,39 @@
 package repository_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"log"
+	"math"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"taal-client/database"
+	"taal-client/encryption"
 	"taal-client/repository"
 	"taal-client/server"
 	"testing"
 	"time"
 
+	"github.com/bitcoinsv/bsvd/bsvec"
 	"github.com/go-testfixtures/testfixtures/v3"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/matryer/is"
+	"github.com/mattn/go-sqlite3"
 
 	"github.com/ory/dockertest"
 	"github.com/ory/dockertest/docker"
@@ -203,46 +221,79 @@ func TestInsertKey(t *testing.T) {
 }
 
 func TestGetAllKeys(t *testing.T) {
-	t.Run("Get all keys", func(t *testing.T) {
-		is := is.New(t)
-		err := prepareTestDatabase()
-		is.NoErr(err)
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
 
-		now := func() time.Time {
-			return time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
-		}
+	now := func() time.Time {
+		return time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	}
 
-		repo := repository.NewRepository(db, now)
-		ctx := context.Background()
-		keys, err := repo.GetAllKeys(ctx)
-		is.NoErr(err)
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
 
-		expectedKeys := []server.Key{
-			{
-				ApiKey:     "api_key_1",
-				PublicKey:  "xskd023k3",
-				PrivateKey: "2099n2dskd",
-				Address:    "ke992kfj0",
-				CreatedAt:  "2022-05-21 15:10:58.022Z",
-			},
-			{
-				ApiKey:     "api_key_2",
-				PublicKey:  "adlkfsd9",
-				PrivateKey: "xp3k0cj3m",
-				Address:    "20fk2pdkf",
-				CreatedAt:  "2022-05-24 15:10:58.022Z",
-			},
-			{
-				ApiKey:     "api_key_4",
-				PublicKey:  "7a2f1cb9",
-				PrivateKey: "cb7168ab",
-				Address:    "5ec39af2",
-				CreatedAt:  "2022-06-10 15:10:58.022Z",
-			},
-		}
+	revokedAt := "2022-06-24 15:10:58.022Z"
 
-		is.Equal(expectedKeys, keys)
-	})
+	key1 := server.Key{
+		ApiKey:     "api_key_1",
+		PublicKey:  "xskd023k3",
+		PrivateKey: "2099n2dskd",
+		Address:    "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH",
+		CreatedAt:  "2022-05-21 15:10:58.022Z",
+	}
+	key2 := server.Key{
+		ApiKey:     "api_key_2",
+		PublicKey:  "adlkfsd9",
+		PrivateKey: "xp3k0cj3m",
+		Address:    "1cMh228HTCiwS8ZsaakH8A8wze1JR5ZsP",
+		CreatedAt:  "2022-05-24 15:10:58.022Z",
+	}
+	key3 := server.Key{
+		ApiKey:     "api_key_3",
+		PublicKey:  "1f01a7c1",
+		PrivateKey: "03927ad3",
+		Address:    "1CUNEBjYrCn2y1SdiUMohaKUi4wpP326Lb",
+		CreatedAt:  "2022-05-10 15:10:58.022Z",
+		RevokedAt:  &revokedAt,
+	}
+	key4 := server.Key{
+		ApiKey:     "api_key_4",
+		PublicKey:  "7a2f1cb9",
+		PrivateKey: "cb7168ab",
+		Address:    "5ec39af2",
+		CreatedAt:  "2022-06-10 15:10:58.022Z",
+	}
+
+	tt := []struct {
+		name           string
+		includeRevoked bool
+		revokedOnly    bool
+		expectedKeys   []server.Key
+	}{
+		{
+			name:         "active keys",
+			expectedKeys: []server.Key{key1, key2, key4},
+		},
+		{
+			name:           "all keys",
+			includeRevoked: true,
+			expectedKeys:   []server.Key{key3, key1, key2, key4},
+		},
+		{
+			name:         "revoked keys",
+			revokedOnly:  true,
+			expectedKeys: []server.Key{key3},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := repo.GetAllKeys(ctx, tc.includeRevoked, tc.revokedOnly)
+			is.NoErr(err)
+
+			is.Equal(tc.expectedKeys, keys)
+		})
+	}
 }
 
 func TestGetAllKeyUsages(t *testing.T) {
@@ -266,7 +317,7 @@ func TestGetAllKeyUsages(t *testing.T) {
 					ApiKey:     "api_key_1",
 					PublicKey:  "xskd023k3",
 					PrivateKey: "2099n2dskd",
-					Address:    "ke992kfj0",
+					Address:    "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH",
 					CreatedAt:  "2022-05-21 15:10:58.022Z",
 				},
 				DataBytes: 523,
@@ -276,7 +327,7 @@ func TestGetAllKeyUsages(t *testing.T) {
 					ApiKey:     "api_key_2",
 					PublicKey:  "adlkfsd9",
 					PrivateKey: "xp3k0cj3m",
-					Address:    "20fk2pdkf",
+					Address:    "1cMh228HTCiwS8ZsaakH8A8wze1JR5ZsP",
 					CreatedAt:  "2022-05-24 15:10:58.022Z",
 				},
 				DataBytes: 300,
@@ -307,14 +358,34 @@ func TestDeactivateKey(t *testing.T) {
 		repo := repository.NewRepository(db, now)
 		ctx := context.Background()
 
-		err := repo.DeactivateKey(ctx, "api_key_2")
+		err := repo.DeactivateKey(ctx, "api_key_2", "")
 		is.NoErr(err)
 
 		key, err := repo.GetKey(ctx, "api_key_2")
 		is.NoErr(err)
 
-		is.Equal("2022-06-20T10:00:00Z", *key.RevokedAt)
+		is.Equal("2022-06-20T10:00:00.000Z", *key.RevokedAt)
+		is.Equal(nil, key.RevokedReason)
+
+	})
+
+	t.Run("Deactivate key with reason", func(t *testing.T) {
+		is := is.New(t)
+		now := func() time.Time {
+			return time.Date(2022, 6, 21, 10, 0, 0, 0, time.UTC)
+		}
+
+		repo := repository.NewRepository(db, now)
+		ctx := context.Background()
+
+		err := repo.DeactivateKey(ctx, "api_key_4", "compromised")
+		is.NoErr(err)
+
+		key, err := repo.GetKey(ctx, "api_key_4")
+		is.NoErr(err)
 
+		is.Equal("2022-06-21T10:00:00.000Z", *key.RevokedAt)
+		is.Equal("compromised", *key.RevokedReason)
 	})
 }
 
@@ -344,12 +415,55 @@ func TestInsertTransaction(t *testing.T) {
 		is.Equal(1, len(txsFromDB))
 
 		tx.CreatedAt = time.Date(2022, 6, 20, 10, 0, 0, 0, time.UTC).Format(repository.ISO8601)
+		tx.Status = server.TransactionStatusBroadcast
 
 		is.Equal(tx, txsFromDB[0])
 
 	})
 }
 
+func TestInsertTransactionMaxDataBytes(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now, repository.WithMaxDataBytes(100))
+	ctx := context.Background()
+
+	tcs := []struct {
+		name      string
+		txid      string
+		dataBytes int64
+		tooLarge  bool
+	}{
+		{name: "below", txid: "max0001", dataBytes: 99},
+		{name: "at", txid: "max0002", dataBytes: 100},
+		{name: "above", txid: "max0003", dataBytes: 101, tooLarge: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := repo.InsertTransaction(ctx, server.Transaction{ID: tc.txid, ApiKey: "api_key_1", DataBytes: tc.dataBytes})
+
+			_, getErr := repo.GetTransaction(ctx, tc.txid)
+			if tc.tooLarge {
+				is.True(errors.Is(err, server.ErrDataTooLarge))
+				is.True(errors.Is(getErr, sql.ErrNoRows))
+			} else {
+				is.NoErr(err)
+				is.NoErr(getErr)
+			}
+		})
+	}
+
+	t.Run("unlimited", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now)
+
+		err := repo.InsertTransaction(ctx, server.Transaction{ID: "max0004", ApiKey: "api_key_1", DataBytes: 1 << 40})
+		is.NoErr(err)
+	})
+}
+
 func TestGetTransactions(t *testing.T) {
 	is := is.New(t)
 	err := prepareTestDatabase()
@@ -381,6 +495,7 @@ func TestGetTransactions(t *testing.T) {
 					ApiKey:    "api_key_2",
 					DataBytes: 100,
 					CreatedAt: "2022-05-25 15:10:58.022Z",
+					Status:    server.TransactionStatusPending,
 					Filename:  "somepicture2.png",
 				},
 				{
@@ -388,6 +503,7 @@ func TestGetTransactions(t *testing.T) {
 					ApiKey:    "api_key_1",
 					DataBytes: 50,
 					CreatedAt: "2022-05-23 15:10:58.022Z",
+					Status:    server.TransactionStatusPending,
 					Filename:  "textfile2.txt",
 					Secret:    "1234",
 				},
@@ -396,6 +512,7 @@ func TestGetTransactions(t *testing.T) {
 					ApiKey:    "api_key_1",
 					DataBytes: 333,
 					CreatedAt: "2022-05-12 22:10:58.022Z",
+					Status:    server.TransactionStatusPending,
 					Filename:  "somepicture5.png",
 				},
 				{
@@ -403,6 +520,7 @@ func TestGetTransactions(t *testing.T) {
 					ApiKey:    "api_key_2",
 					DataBytes: 200,
 					CreatedAt: "2022-05-12 15:10:58.022Z",
+					Status:    server.TransactionStatusPending,
 					Filename:  "somepicture1.png",
 				},
 				{
@@ -410,6 +528,7 @@ func TestGetTransactions(t *testing.T) {
 					ApiKey:    "api_key_1",
 					DataBytes: 100,
 					CreatedAt: "2022-05-10 15:10:58.022Z",
+					Status:    server.TransactionStatusPending,
 					Filename:  "textfile1.txt",
 				},
 			},
@@ -423,6 +542,7 @@ func TestGetTransactions(t *testing.T) {
 					ApiKey:    "api_key_2",
 					DataBytes: 100,
 					CreatedAt: "2022-05-25 15:10:58.022Z",
+					Status:    server.TransactionStatusPending,
 					Filename:  "somepicture2.png",
 				},
 				{
@@ -430,6 +550,7 @@ func TestGetTransactions(t *testing.T) {
 					ApiKey:    "api_key_1",
 					DataBytes: 50,
 					CreatedAt: "2022-05-23 15:10:58.022Z",
+					Status:    server.TransactionStatusPending,
 					Filename:  "textfile2.txt",
 					Secret:    "1234",
 				},
@@ -438,6 +559,7 @@ func TestGetTransactions(t *testing.T) {
 					ApiKey:    "api_key_1",
 					DataBytes: 333,
 					CreatedAt: "2022-05-12 22:10:58.022Z",
+					Status:    server.TransactionStatusPending,
 					Filename:  "somepicture5.png",
 				},
 				{
@@ -445,6 +567,7 @@ func TestGetTransactions(t *testing.T) {
 					ApiKey:    "api_key_2",
 					DataBytes: 200,
 					CreatedAt: "2022-05-12 15:10:58.022Z",
+					Status:    server.TransactionStatusPending,
 					Filename:  "somepicture1.png",
 				},
 				{
@@ -452,6 +575,7 @@ func TestGetTransactions(t *testing.T) {
 					ApiKey:    "api_key_1",
 					DataBytes: 100,
 					CreatedAt: "2022-05-10 15:10:58.022Z",
+					Status:    server.TransactionStatusPending,
 					Filename:  "textfile1.txt",
 				},
 				{
@@ -459,6 +583,7 @@ func TestGetTransactions(t *testing.T) {
 					ApiKey:    "api_key_1",
 					DataBytes: 40,
 					CreatedAt: "2022-04-28 15:10:58.022Z",
+					Status:    server.TransactionStatusPending,
 					Filename:  "textfile0.txt",
 				},
 			},
@@ -501,24 +626,40 @@ func TestGetTransactionsStats(t *testing.T) {
 			from: to.AddDate(0, 0, -30),
 			expectedTxs: []server.TransactionInfo{
 				{
-					Timestamp: time.Date(2022, 5, 25, 0, 0, 0, 0, time.UTC),
-					DataBytes: 100,
-					Count:     1,
+					Timestamp:    time.Date(2022, 5, 25, 0, 0, 0, 0, time.UTC),
+					DataBytes:    100,
+					Count:        1,
+					DataBytesP50: 100,
+					DataBytesP95: 100,
+					ActiveKeys:   1,
+					FullCount:    1,
 				},
 				{
-					Timestamp: time.Date(2022, 5, 23, 0, 0, 0, 0, time.UTC),
-					DataBytes: 50,
-					Count:     1,
+					Timestamp:    time.Date(2022, 5, 23, 0, 0, 0, 0, time.UTC),
+					DataBytes:    50,
+					Count:        1,
+					DataBytesP50: 50,
+					DataBytesP95: 50,
+					ActiveKeys:   1,
+					FullCount:    1,
 				},
 				{
-					Timestamp: time.Date(2022, 5, 12, 0, 0, 0, 0, time.UTC),
-					DataBytes: 533,
-					Count:     2,
+					Timestamp:    time.Date(2022, 5, 12, 0, 0, 0, 0, time.UTC),
+					DataBytes:    533,
+					Count:        2,
+					DataBytesP50: 266.5,
+					DataBytesP95: 326.35,
+					ActiveKeys:   2,
+					FullCount:    2,
 				},
 				{
-					Timestamp: time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC),
-					DataBytes: 100,
-					Count:     1,
+					Timestamp:    time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC),
+					DataBytes:    100,
+					Count:        1,
+					DataBytesP50: 100,
+					DataBytesP95: 100,
+					ActiveKeys:   1,
+					FullCount:    1,
 				},
 			},
 		},
@@ -527,24 +668,40 @@ func TestGetTransactionsStats(t *testing.T) {
 			from: to.AddDate(0, 0, -30),
 			expectedTxs: []server.TransactionInfo{
 				{
-					Timestamp: time.Date(2022, 5, 25, 0, 0, 0, 0, time.UTC),
-					DataBytes: 100,
-					Count:     1,
+					Timestamp:    time.Date(2022, 5, 25, 0, 0, 0, 0, time.UTC),
+					DataBytes:    100,
+					Count:        1,
+					DataBytesP50: 100,
+					DataBytesP95: 100,
+					ActiveKeys:   1,
+					FullCount:    1,
 				},
 				{
-					Timestamp: time.Date(2022, 5, 23, 0, 0, 0, 0, time.UTC),
-					DataBytes: 50,
-					Count:     1,
+					Timestamp:    time.Date(2022, 5, 23, 0, 0, 0, 0, time.UTC),
+					DataBytes:    50,
+					Count:        1,
+					DataBytesP50: 50,
+					DataBytesP95: 50,
+					ActiveKeys:   1,
+					FullCount:    1,
 				},
 				{
-					Timestamp: time.Date(2022, 5, 12, 0, 0, 0, 0, time.UTC),
-					DataBytes: 533,
-					Count:     2,
+					Timestamp:    time.Date(2022, 5, 12, 0, 0, 0, 0, time.UTC),
+					DataBytes:    533,
+					Count:        2,
+					DataBytesP50: 266.5,
+					DataBytesP95: 326.35,
+					ActiveKeys:   2,
+					FullCount:    2,
 				},
 				{
-					Timestamp: time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC),
-					DataBytes: 100,
-					Count:     1,
+					Timestamp:    time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC),
+					DataBytes:    100,
+					Count:        1,
+					DataBytesP50: 100,
+					DataBytesP95: 100,
+					ActiveKeys:   1,
+					FullCount:    1,
 				},
 			},
 		},
@@ -560,3 +717,4623 @@ func TestGetTransactionsStats(t *testing.T) {
 		})
 	}
 }
+
+func TestSearchTransactionsByFilename(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 6, 20, 10, 0, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	for i, filename := range []string{"report_2022.txt", "reportX2022.txt", "100%.png", "100x.png", `dir\file.txt`} {
+		err = repo.InsertTransaction(ctx, server.Transaction{
+			ID:        fmt.Sprintf("like_tx_%d", i),
+			ApiKey:    "api_key_1",
+			DataBytes: 10,
+			Filename:  filename,
+		})
+		is.NoErr(err)
+	}
+
+	tt := []struct {
+		name              string
+		search            string
+		expectedFilenames []string
+	}{
+		{
+			name:              "underscore is literal",
+			search:            "report_",
+			expectedFilenames: []string{"report_2022.txt"},
+		},
+		{
+			name:              "percent is literal",
+			search:            "100%",
+			expectedFilenames: []string{"100%.png"},
+		},
+		{
+			name:              "escape char is literal",
+			search:            `dir\file`,
+			expectedFilenames: []string{`dir\file.txt`},
+		},
+		{
+			name:              "no match",
+			search:            "%_%",
+			expectedFilenames: []string{},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			txs, err := repo.SearchTransactionsByFilename(ctx, tc.search)
+			is.NoErr(err)
+
+			filenames := make([]string, 0)
+			for _, tx := range txs {
+				filenames = append(filenames, tx.Filename)
+			}
+
+			is.Equal(tc.expectedFilenames, filenames)
+		})
+	}
+}
+
+func TestGetTransactionForUpdate(t *testing.T) {
+	t.Run("Get transaction for update", func(t *testing.T) {
+		is := is.New(t)
+		err := prepareTestDatabase()
+		is.NoErr(err)
+
+		repo := repository.NewRepository(db, time.Now)
+		ctx := context.Background()
+
+		err = repo.WithTx(ctx, func(tx *sqlx.Tx) error {
+			transaction, err := repo.GetTransactionForUpdate(ctx, tx, "2BDCFF23")
+			is.NoErr(err)
+			is.Equal("api_key_1", transaction.ApiKey)
+
+			_, err = repo.GetTransactionForUpdate(ctx, tx, "unknown")
+			is.Equal(sql.ErrNoRows, err)
+
+			return nil
+		})
+		is.NoErr(err)
+	})
+
+	t.Run("Second transaction waits for the row lock", func(t *testing.T) {
+		if db.DriverName() != "postgres" {
+			t.Skip("row locks are only supported on postgres")
+		}
+
+		is := is.New(t)
+		err := prepareTestDatabase()
+		is.NoErr(err)
+
+		repo := repository.NewRepository(db, time.Now)
+		ctx := context.Background()
+
+		tx1, err := db.BeginTxx(ctx, nil)
+		is.NoErr(err)
+
+		_, err = repo.GetTransactionForUpdate(ctx, tx1, "2BDCFF23")
+		is.NoErr(err)
+
+		locked := make(chan error, 1)
+		go func() {
+			locked <- repo.WithTx(ctx, func(tx2 *sqlx.Tx) error {
+				_, err := repo.GetTransactionForUpdate(ctx, tx2, "2BDCFF23")
+				return err
+			})
+		}()
+
+		select {
+		case <-locked:
+			t.Fatal("second transaction acquired the row lock while the first one held it")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		is.NoErr(tx1.Commit())
+
+		select {
+		case err := <-locked:
+			is.NoErr(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("second transaction did not acquire the row lock after the first one committed")
+		}
+	})
+}
+
+func TestGetTransactionInfoWithSummary(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	to := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	repo := repository.NewRepository(db, nil)
+	ctx := context.Background()
+
+	tt := []struct {
+		name            string
+		from            time.Time
+		expectedSummary server.TransactionInfoSummary
+	}{
+		{
+			name:            "0 hours back",
+			from:            to,
+			expectedSummary: server.TransactionInfoSummary{},
+		},
+		{
+			name: "30 days back",
+			from: to.AddDate(0, 0, -30),
+			expectedSummary: server.TransactionInfoSummary{
+				TotalCount:     5,
+				TotalDataBytes: 783,
+			},
+		},
+		{
+			name: "60 days back",
+			from: to.AddDate(0, 0, -60),
+			expectedSummary: server.TransactionInfoSummary{
+				TotalCount:     6,
+				TotalDataBytes: 823,
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			transactions, summary, err := repo.GetTransactionInfoWithSummary(ctx, tc.from, to, server.Day)
+			is.NoErr(err)
+
+			is.Equal(tc.expectedSummary, summary)
+
+			bucketSum := server.TransactionInfoSummary{}
+			for _, tx := range transactions {
+				bucketSum.TotalCount += tx.Count
+				bucketSum.TotalDataBytes += tx.DataBytes
+			}
+
+			is.Equal(bucketSum, summary)
+		})
+	}
+}
+
+func TestGetRevokedKeysBetween(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 6, 20, 10, 0, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	err = repo.DeactivateKey(ctx, "api_key_1", "customer request")
+	is.NoErr(err)
+
+	tt := []struct {
+		name            string
+		from            time.Time
+		to              time.Time
+		expectedApiKeys []string
+	}{
+		{
+			name:            "window before any revocation",
+			from:            time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC),
+			to:              time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC),
+			expectedApiKeys: []string{},
+		},
+		{
+			name:            "window containing one revocation",
+			from:            time.Date(2022, 6, 19, 0, 0, 0, 0, time.UTC),
+			to:              time.Date(2022, 6, 22, 0, 0, 0, 0, time.UTC),
+			expectedApiKeys: []string{"api_key_1"},
+		},
+		{
+			name:            "window containing both revocations",
+			from:            time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC),
+			to:              time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC),
+			expectedApiKeys: []string{"api_key_1", "api_key_3"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := repo.GetRevokedKeysBetween(ctx, tc.from, tc.to)
+			is.NoErr(err)
+
+			apiKeys := make([]string, 0)
+			for _, key := range keys {
+				is.True(key.RevokedAt != nil)
+				apiKeys = append(apiKeys, key.ApiKey)
+			}
+
+			is.Equal(tc.expectedApiKeys, apiKeys)
+		})
+	}
+}
+
+func TestGetTransactionInfoPercentiles(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	ctx := context.Background()
+
+	insert := func(createdAt time.Time, id string, dataBytes int64) {
+		repo := repository.NewRepository(db, func() time.Time { return createdAt })
+		err := repo.InsertTransaction(ctx, server.Transaction{ID: id, ApiKey: "api_key_1", DataBytes: dataBytes})
+		is.NoErr(err)
+	}
+
+	// 10:00 bucket: 1, 2, ..., 100 bytes
+	for i := 1; i <= 100; i++ {
+		insert(time.Date(2022, 7, 1, 10, 30, 0, 0, time.UTC), fmt.Sprintf("p_10_%d", i), int64(i))
+	}
+
+	// 11:00 bucket: 19 small writes and one spike
+	for i := 1; i <= 19; i++ {
+		insert(time.Date(2022, 7, 1, 11, 30, 0, 0, time.UTC), fmt.Sprintf("p_11_%d", i), 10)
+	}
+	insert(time.Date(2022, 7, 1, 11, 30, 0, 0, time.UTC), "p_11_spike", 10010)
+
+	repo := repository.NewRepository(db, time.Now)
+	from := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 7, 2, 0, 0, 0, 0, time.UTC)
+
+	transactions, err := repo.GetTransactionInfo(ctx, from, to, server.Hour)
+	is.NoErr(err)
+	is.Equal(2, len(transactions))
+
+	almostEqual := func(expected float64, actual float64) bool {
+		return math.Abs(expected-actual) < 1e-9
+	}
+
+	bucket11, bucket10 := transactions[0], transactions[1]
+
+	is.Equal(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC), bucket10.Timestamp)
+	is.True(almostEqual(50.5, bucket10.DataBytesP50))
+	is.True(almostEqual(95.05, bucket10.DataBytesP95))
+
+	is.Equal(time.Date(2022, 7, 1, 11, 0, 0, 0, time.UTC), bucket11.Timestamp)
+	is.True(almostEqual(10, bucket11.DataBytesP50))
+	is.True(almostEqual(10+0.05*10000, bucket11.DataBytesP95))
+}
+
+func TestInsertTransactionValidation(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 6, 20, 10, 0, 0, 0, time.UTC)
+	}
+
+	ctx := context.Background()
+
+	tt := []struct {
+		name          string
+		opts          []repository.Option
+		tx            server.Transaction
+		expectedField string
+	}{
+		{
+			name:          "empty id",
+			tx:            server.Transaction{ApiKey: "api_key_1", DataBytes: 10},
+			expectedField: "id",
+		},
+		{
+			name:          "negative data bytes",
+			tx:            server.Transaction{ID: "validation_1", ApiKey: "api_key_1", DataBytes: -1},
+			expectedField: "data_bytes",
+		},
+		{
+			name:          "unknown api key",
+			opts:          []repository.Option{repository.WithApiKeyCheck()},
+			tx:            server.Transaction{ID: "validation_2", ApiKey: "unknown_api_key", DataBytes: 10},
+			expectedField: "api_key",
+		},
+		{
+			name: "unknown api key without check",
+			tx:   server.Transaction{ID: "validation_3", ApiKey: "unknown_api_key", DataBytes: 10},
+		},
+		{
+			name: "valid transaction",
+			opts: []repository.Option{repository.WithApiKeyCheck()},
+			tx:   server.Transaction{ID: "validation_4", ApiKey: "api_key_1", DataBytes: 0},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			repo := repository.NewRepository(db, now, tc.opts...)
+
+			err := repo.InsertTransaction(ctx, tc.tx)
+
+			if tc.expectedField == "" {
+				is.NoErr(err)
+
+				_, err = repo.GetTransaction(ctx, tc.tx.ID)
+				is.NoErr(err)
+				return
+			}
+
+			is.True(errors.Is(err, server.ErrInvalidTransaction))
+
+			var invalidTxErr server.InvalidTransactionError
+			is.True(errors.As(err, &invalidTxErr))
+			is.Equal(tc.expectedField, invalidTxErr.Field)
+		})
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clock.Advance(time.Minute)
+			errs <- repo.InsertTransaction(ctx, server.Transaction{ID: fmt.Sprintf("clock_tx_%d", i), ApiKey: "api_key_1", DataBytes: 1})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		is.NoErr(err)
+	}
+
+	txs, err := repo.GetAllTransactions(ctx, false, 1)
+	is.NoErr(err)
+	is.Equal(10, len(txs))
+}
+
+func TestGetTransactionInfoCache(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	var queries int64
+	countQueries := func(ctx context.Context, info repository.QueryInfo) {
+		atomic.AddInt64(&queries, 1)
+	}
+
+	clock := server.NewManualClock(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil,
+		repository.WithClock(clock),
+		repository.WithQueryObserver(countQueries),
+		repository.WithTransactionInfoCache(time.Minute),
+	)
+	ctx := context.Background()
+
+	to := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, 0, -30)
+
+	expected, err := repo.GetTransactionInfo(ctx, from, to, server.Day)
+	is.NoErr(err)
+	is.True(atomic.LoadInt64(&queries) > 0)
+
+	t.Run("second call within ttl is cached", func(t *testing.T) {
+		before := atomic.LoadInt64(&queries)
+
+		clock.Advance(30 * time.Second)
+		transactions, err := repo.GetTransactionInfo(ctx, from, to, server.Day)
+		is.NoErr(err)
+
+		is.Equal(before, atomic.LoadInt64(&queries))
+		is.Equal(expected, transactions)
+	})
+
+	t.Run("call after ttl hits the database", func(t *testing.T) {
+		before := atomic.LoadInt64(&queries)
+
+		clock.Advance(time.Minute)
+		transactions, err := repo.GetTransactionInfo(ctx, from, to, server.Day)
+		is.NoErr(err)
+
+		is.True(atomic.LoadInt64(&queries) > before)
+		is.Equal(expected, transactions)
+	})
+
+	t.Run("insert invalidates the cache", func(t *testing.T) {
+		err := repo.InsertTransaction(ctx, server.Transaction{ID: "cache_tx", ApiKey: "api_key_1", DataBytes: 10})
+		is.NoErr(err)
+
+		before := atomic.LoadInt64(&queries)
+
+		_, err = repo.GetTransactionInfo(ctx, from, to, server.Day)
+		is.NoErr(err)
+
+		is.True(atomic.LoadInt64(&queries) > before)
+	})
+}
+
+func TestReattributeOrphanedTransactions(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 6, 20, 10, 0, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	orphans, err := repo.GetOrphanedTransactions(ctx)
+	is.NoErr(err)
+	is.Equal(0, len(orphans))
+
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "orphan_tx", ApiKey: "deleted_api_key", DataBytes: 77})
+	is.NoErr(err)
+
+	orphans, err = repo.GetOrphanedTransactions(ctx)
+	is.NoErr(err)
+	is.Equal(1, len(orphans))
+	is.Equal("orphan_tx", orphans[0].ID)
+
+	moved, err := repo.ReattributeTransactions(ctx, "deleted_api_key", "api_key_4")
+	is.NoErr(err)
+	is.Equal(int64(1), moved)
+
+	orphans, err = repo.GetOrphanedTransactions(ctx)
+	is.NoErr(err)
+	is.Equal(0, len(orphans))
+
+	tx, err := repo.GetTransaction(ctx, "orphan_tx")
+	is.NoErr(err)
+	is.Equal("api_key_4", tx.ApiKey)
+
+	keysUsage, err := repo.GetAllKeysUsage(ctx)
+	is.NoErr(err)
+	for _, keyUsage := range keysUsage {
+		if keyUsage.ApiKey == "api_key_4" {
+			is.Equal(int64(77), keyUsage.DataBytes)
+		}
+	}
+}
+
+func TestDeactivateKeys(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 6, 30, 10, 0, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	revoked, err := repo.DeactivateKeys(ctx, []string{"api_key_1", "api_key_3", "api_key_4", "unknown_api_key"}, "incident")
+	is.NoErr(err)
+	is.Equal(int64(2), revoked)
+
+	for _, apiKey := range []string{"api_key_1", "api_key_4"} {
+		key, err := repo.GetKey(ctx, apiKey)
+		is.NoErr(err)
+		is.Equal("2022-06-30T10:00:00.000Z", *key.RevokedAt)
+		is.Equal("incident", *key.RevokedReason)
+	}
+
+	// already revoked keys keep their revocation
+	key, err := repo.GetKey(ctx, "api_key_3")
+	is.NoErr(err)
+	is.Equal(nil, key.RevokedReason)
+
+	key, err = repo.GetKey(ctx, "api_key_2")
+	is.NoErr(err)
+	is.Equal(nil, key.RevokedAt)
+
+	revoked, err = repo.DeactivateKeys(ctx, []string{}, "incident")
+	is.NoErr(err)
+	is.Equal(int64(0), revoked)
+}
+
+func TestDeactivateKeysNonUTCClock(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	// 12:00 in UTC+2 is 10:00 UTC
+	now := func() time.Time {
+		return time.Date(2022, 6, 30, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	err = repo.DeactivateKey(ctx, "api_key_1", "customer request")
+	is.NoErr(err)
+
+	_, err = repo.DeactivateKeys(ctx, []string{"api_key_4"}, "incident")
+	is.NoErr(err)
+
+	for _, apiKey := range []string{"api_key_1", "api_key_4"} {
+		key, err := repo.GetKey(ctx, apiKey)
+		is.NoErr(err)
+		is.Equal("2022-06-30T10:00:00.000Z", *key.RevokedAt)
+	}
+
+	keys, err := repo.GetRevokedKeysBetween(ctx, time.Date(2022, 6, 30, 9, 30, 0, 0, time.UTC), time.Date(2022, 6, 30, 10, 30, 0, 0, time.UTC))
+	is.NoErr(err)
+	is.Equal(2, len(keys))
+}
+
+func TestGetKeyRevocation(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 7, 2, 10, 0, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	t.Run("revoked key", func(t *testing.T) {
+		key, err := repo.GetKey(ctx, "api_key_3")
+		is.NoErr(err)
+		is.Equal("2022-06-24 15:10:58.022Z", *key.RevokedAt)
+		is.Equal(nil, key.RevokedReason)
+
+		err = repo.DeactivateKey(ctx, "api_key_1", "disputed")
+		is.NoErr(err)
+
+		key, err = repo.GetKey(ctx, "api_key_1")
+		is.NoErr(err)
+		is.Equal("2022-07-02T10:00:00.000Z", *key.RevokedAt)
+		is.Equal("disputed", *key.RevokedReason)
+	})
+
+	t.Run("active key", func(t *testing.T) {
+		key, err := repo.GetKey(ctx, "api_key_2")
+		is.NoErr(err)
+		is.Equal(nil, key.RevokedAt)
+		is.Equal(nil, key.RevokedReason)
+	})
+}
+
+func TestExportTransactionsJSONL(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	from := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	err = repo.ExportTransactionsJSONL(ctx, &buf, from, to)
+	is.NoErr(err)
+
+	var count int
+	err = db.GetContext(ctx, &count, `SELECT count(*) FROM transactions WHERE created_at >= $1 AND created_at < $2;`, from.Format(repository.ISO8601), to.Format(repository.ISO8601))
+	is.NoErr(err)
+	is.Equal(5, count)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	is.Equal(count, len(lines))
+
+	for _, line := range lines {
+		var exported map[string]interface{}
+		is.NoErr(json.Unmarshal([]byte(line), &exported))
+
+		_, hasSecret := exported["secret"]
+		is.True(!hasSecret)
+
+		createdAt, ok := exported["created_at"].(string)
+		is.True(ok)
+		_, err := time.Parse(time.RFC3339, createdAt)
+		is.NoErr(err)
+	}
+
+	is.True(!strings.Contains(buf.String(), "1234"))
+}
+
+func TestGetUsageDelta(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	tt := []struct {
+		name          string
+		from          time.Time
+		to            time.Time
+		expectedDelta map[string]int64
+	}{
+		{
+			name:          "empty window",
+			from:          time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+			to:            time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC),
+			expectedDelta: map[string]int64{},
+		},
+		{
+			name: "window with writes of both keys",
+			from: time.Date(2022, 5, 11, 0, 0, 0, 0, time.UTC),
+			to:   time.Date(2022, 5, 24, 0, 0, 0, 0, time.UTC),
+			expectedDelta: map[string]int64{
+				"api_key_1": 383,
+				"api_key_2": 200,
+			},
+		},
+		{
+			name: "window with writes of one key",
+			from: time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC),
+			to:   time.Date(2022, 5, 11, 0, 0, 0, 0, time.UTC),
+			expectedDelta: map[string]int64{
+				"api_key_1": 140,
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			delta, err := repo.GetUsageDelta(ctx, tc.from, tc.to)
+			is.NoErr(err)
+
+			is.Equal(tc.expectedDelta, delta)
+		})
+	}
+}
+
+func TestGetTransactionWithKeyStatus(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 6, 20, 10, 0, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "revoked_key_tx", ApiKey: "api_key_3", DataBytes: 1})
+	is.NoErr(err)
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "missing_key_tx", ApiKey: "deleted_api_key", DataBytes: 1})
+	is.NoErr(err)
+
+	tt := []struct {
+		name              string
+		txid              string
+		expectedApiKey    string
+		expectedKeyActive bool
+	}{
+		{name: "active key", txid: "2BDCFF23", expectedApiKey: "api_key_1", expectedKeyActive: true},
+		{name: "revoked key", txid: "revoked_key_tx", expectedApiKey: "api_key_3", expectedKeyActive: false},
+		{name: "missing key", txid: "missing_key_tx", expectedApiKey: "deleted_api_key", expectedKeyActive: false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tx, keyActive, err := repo.GetTransactionWithKeyStatus(ctx, tc.txid)
+			is.NoErr(err)
+
+			is.Equal(tc.txid, tx.ID)
+			is.Equal(tc.expectedApiKey, tx.ApiKey)
+			is.Equal(tc.expectedKeyActive, keyActive)
+		})
+	}
+
+	t.Run("unknown transaction", func(t *testing.T) {
+		_, _, err := repo.GetTransactionWithKeyStatus(ctx, "unknown")
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestWithTxSerializationRetries(t *testing.T) {
+	is := is.New(t)
+
+	repo := repository.NewRepository(db, time.Now, repository.WithSerializationRetries(3, time.Millisecond))
+	ctx := context.Background()
+
+	calls := 0
+	err := repo.WithTx(ctx, func(tx *sqlx.Tx) error {
+		calls++
+		if calls == 1 {
+			return &pq.Error{Code: "40001"}
+		}
+		return nil
+	})
+
+	if db.DriverName() == "postgres" {
+		is.NoErr(err)
+		is.Equal(2, calls)
+	} else {
+		// SQLite paths are never retried
+		is.True(err != nil)
+		is.Equal(1, calls)
+	}
+}
+
+func TestCountKeyTransactionsSince(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	ctx := context.Background()
+	since := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	for i, createdAt := range []time.Time{since.Add(-time.Second), since, since.Add(time.Second), since.Add(time.Minute)} {
+		createdAt := createdAt
+		repo := repository.NewRepository(db, func() time.Time { return createdAt })
+		err = repo.InsertTransaction(ctx, server.Transaction{ID: fmt.Sprintf("rate_tx_%d", i), ApiKey: "api_key_4", DataBytes: 1})
+		is.NoErr(err)
+	}
+
+	repo := repository.NewRepository(db, time.Now)
+
+	tt := []struct {
+		name          string
+		apiKey        string
+		since         time.Time
+		expectedCount int64
+	}{
+		{name: "before first write", apiKey: "api_key_4", since: since.Add(-time.Hour), expectedCount: 4},
+		{name: "at first write", apiKey: "api_key_4", since: since.Add(-time.Second), expectedCount: 4},
+		{name: "at boundary", apiKey: "api_key_4", since: since, expectedCount: 3},
+		{name: "just after boundary", apiKey: "api_key_4", since: since.Add(time.Second), expectedCount: 2},
+		{name: "after last write", apiKey: "api_key_4", since: since.Add(time.Hour), expectedCount: 0},
+		{name: "other key", apiKey: "api_key_2", since: since.Add(-time.Hour), expectedCount: 0},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			count, err := repo.CountKeyTransactionsSince(ctx, tc.apiKey, tc.since)
+			is.NoErr(err)
+
+			is.Equal(tc.expectedCount, count)
+		})
+	}
+}
+
+func TestDataBytesBeyondInt32(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	large := int64(math.MaxInt32) + 1
+	for _, id := range []string{"large_tx_1", "large_tx_2"} {
+		err = repo.InsertTransaction(ctx, server.Transaction{ID: id, ApiKey: "api_key_4", DataBytes: large})
+		is.NoErr(err)
+	}
+
+	tx, err := repo.GetTransaction(ctx, "large_tx_1")
+	is.NoErr(err)
+	is.Equal(large, tx.DataBytes)
+
+	keysUsage, err := repo.GetAllKeysUsage(ctx)
+	is.NoErr(err)
+	for _, keyUsage := range keysUsage {
+		if keyUsage.ApiKey == "api_key_4" {
+			is.Equal(2*large, keyUsage.DataBytes)
+		}
+	}
+
+	from := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 7, 2, 0, 0, 0, 0, time.UTC)
+
+	delta, err := repo.GetUsageDelta(ctx, from, to)
+	is.NoErr(err)
+	is.Equal(2*large, delta["api_key_4"])
+
+	transactions, summary, err := repo.GetTransactionInfoWithSummary(ctx, from, to, server.Day)
+	is.NoErr(err)
+	is.Equal(1, len(transactions))
+	is.Equal(2*large, transactions[0].DataBytes)
+	is.Equal(2*large, summary.TotalDataBytes)
+}
+
+func TestGetTransactionInfoCumulative(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	to := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, 0, -60)
+
+	transactions, summary, err := repo.GetTransactionInfoWithSummary(ctx, from, to, server.Day)
+	is.NoErr(err)
+
+	cumulative, err := repo.GetTransactionInfoWithOptions(ctx, from, to, server.Day, server.TransactionInfoOptions{Cumulative: true})
+	is.NoErr(err)
+	is.Equal(len(transactions), len(cumulative))
+
+	var runningTotal int64
+	for i, bucket := range cumulative {
+		if i > 0 {
+			is.True(bucket.Timestamp.After(cumulative[i-1].Timestamp))
+		}
+
+		runningTotal += bucket.DataBytes
+		is.Equal(runningTotal, bucket.CumulativeDataBytes)
+	}
+
+	is.Equal(summary.TotalDataBytes, cumulative[len(cumulative)-1].CumulativeDataBytes)
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	databaseName := "sqlite"
+	if db.DriverName() == "postgres" {
+		databaseName = "postgres"
+	}
+
+	latest, err := database.LatestVersion(databaseName)
+	is.NoErr(err)
+
+	t.Run("matching version", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now)
+
+		err := repo.CheckSchemaVersion(ctx, latest)
+		is.NoErr(err)
+	})
+
+	t.Run("mismatched version", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now)
+
+		err := repo.CheckSchemaVersion(ctx, latest+1)
+		is.True(errors.Is(err, server.ErrSchemaMismatch))
+		is.True(strings.Contains(err.Error(), fmt.Sprintf("expected version %d, found version %d", latest+1, latest)))
+	})
+
+	t.Run("health with matching version", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now, repository.WithSchemaVersionCheck(latest))
+
+		err := repo.Health(ctx)
+		is.NoErr(err)
+	})
+
+	t.Run("health with mismatched version", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now, repository.WithSchemaVersionCheck(latest+1))
+
+		err := repo.Health(ctx)
+		is.True(errors.Is(err, server.ErrSchemaMismatch))
+	})
+}
+
+func TestWithReadReplica(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	var primaryQueries, replicaQueries int64
+	countQueries := func(ctx context.Context, info repository.QueryInfo) {
+		if info.Replica {
+			atomic.AddInt64(&replicaQueries, 1)
+			return
+		}
+		atomic.AddInt64(&primaryQueries, 1)
+	}
+
+	// A second handle on the same database stands in for the replica.
+	replica := sqlx.NewDb(db.DB, db.DriverName())
+
+	repo := repository.NewRepository(db, time.Now,
+		repository.WithReadReplica(replica),
+		repository.WithQueryObserver(countQueries),
+	)
+	ctx := context.Background()
+
+	t.Run("reads hit the replica", func(t *testing.T) {
+		primaryBefore := atomic.LoadInt64(&primaryQueries)
+		replicaBefore := atomic.LoadInt64(&replicaQueries)
+
+		_, err := repo.GetKey(ctx, "api_key_1")
+		is.NoErr(err)
+
+		_, err = repo.GetAllTransactions(ctx, true, 0)
+		is.NoErr(err)
+
+		is.Equal(primaryBefore, atomic.LoadInt64(&primaryQueries))
+		is.Equal(replicaBefore+2, atomic.LoadInt64(&replicaQueries))
+	})
+
+	t.Run("writes hit the primary", func(t *testing.T) {
+		primaryBefore := atomic.LoadInt64(&primaryQueries)
+		replicaBefore := atomic.LoadInt64(&replicaQueries)
+
+		err := repo.InsertKey(ctx, server.Key{ApiKey: "api_key_replica", PrivateKey: "private", PublicKey: "public", Address: "address"})
+		is.NoErr(err)
+
+		is.True(atomic.LoadInt64(&primaryQueries) > primaryBefore)
+		is.Equal(replicaBefore, atomic.LoadInt64(&replicaQueries))
+	})
+
+	t.Run("nil replica falls back to the primary", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now,
+			repository.WithReadReplica(nil),
+			repository.WithQueryObserver(countQueries),
+		)
+
+		primaryBefore := atomic.LoadInt64(&primaryQueries)
+		replicaBefore := atomic.LoadInt64(&replicaQueries)
+
+		_, err := repo.GetKey(ctx, "api_key_1")
+		is.NoErr(err)
+
+		is.Equal(primaryBefore+1, atomic.LoadInt64(&primaryQueries))
+		is.Equal(replicaBefore, atomic.LoadInt64(&replicaQueries))
+	})
+}
+
+func TestGetTransactionInfoBucketLocation(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 14, 30, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	// 23:30 and 00:30 in Tokyo, but both on the same day in UTC
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "before_midnight_tx", ApiKey: "api_key_4", DataBytes: 10})
+	is.NoErr(err)
+
+	clock.Advance(time.Hour)
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "after_midnight_tx", ApiKey: "api_key_4", DataBytes: 20})
+	is.NoErr(err)
+
+	from := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 7, 2, 0, 0, 0, 0, time.UTC)
+
+	t.Run("utc", func(t *testing.T) {
+		transactions, err := repo.GetTransactionInfo(ctx, from, to, server.Day)
+		is.NoErr(err)
+		is.Equal(1, len(transactions))
+		is.True(transactions[0].Timestamp.Equal(from))
+		is.Equal(2, transactions[0].Count)
+	})
+
+	t.Run("tokyo", func(t *testing.T) {
+		transactions, err := repo.GetTransactionInfoWithOptions(ctx, from, to, server.Day, server.TransactionInfoOptions{BucketLocation: tokyo})
+		is.NoErr(err)
+		is.Equal(2, len(transactions))
+
+		is.True(transactions[0].Timestamp.Equal(time.Date(2022, 7, 2, 0, 0, 0, 0, tokyo)))
+		is.Equal(1, transactions[0].Count)
+		is.Equal(int64(20), transactions[0].DataBytes)
+
+		is.True(transactions[1].Timestamp.Equal(time.Date(2022, 7, 1, 0, 0, 0, 0, tokyo)))
+		is.Equal(1, transactions[1].Count)
+		is.Equal(int64(10), transactions[1].DataBytes)
+	})
+}
+
+func TestRestoreTransactions(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	backup := []server.Transaction{
+		{ID: "restored_tx_1", ApiKey: "api_key_1", DataBytes: 11, CreatedAt: "2021-01-02T03:04:05.678Z", Filename: "restored1.txt"},
+		{ID: "restored_tx_2", ApiKey: "api_key_2", DataBytes: 22, CreatedAt: "2021-12-31T23:59:59.999Z", IsHash: true},
+		// Already stored, must be left as it is
+		{ID: "2BDCFF23", ApiKey: "api_key_2", DataBytes: 99, CreatedAt: "2020-01-01T00:00:00.000Z"},
+	}
+
+	err = repo.RestoreTransactions(ctx, backup)
+	is.NoErr(err)
+
+	for _, expected := range backup[:2] {
+		tx, err := repo.GetTransaction(ctx, expected.ID)
+		is.NoErr(err)
+		is.Equal(expected.CreatedAt, tx.CreatedAt)
+		is.Equal(expected.ApiKey, tx.ApiKey)
+		is.Equal(expected.DataBytes, tx.DataBytes)
+		is.Equal(expected.Filename, tx.Filename)
+		is.Equal(expected.IsHash, tx.IsHash)
+	}
+
+	existing, err := repo.GetTransaction(ctx, "2BDCFF23")
+	is.NoErr(err)
+	is.Equal("api_key_1", existing.ApiKey)
+	is.Equal(int64(50), existing.DataBytes)
+
+	t.Run("missing created_at", func(t *testing.T) {
+		err := repo.RestoreTransactions(ctx, []server.Transaction{{ID: "restored_tx_3", ApiKey: "api_key_1"}})
+		is.True(errors.Is(err, server.ErrInvalidTransaction))
+
+		_, err = repo.GetTransaction(ctx, "restored_tx_3")
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestGetKeyFold(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	err = repo.InsertKey(ctx, server.Key{ApiKey: "Mixed_Case_Key", PrivateKey: "private", PublicKey: "public", Address: "address"})
+	is.NoErr(err)
+
+	_, err = repo.GetKey(ctx, "mixed_case_key")
+	is.Equal(sql.ErrNoRows, err)
+
+	for _, apiKey := range []string{"Mixed_Case_Key", "mixed_case_key", "MIXED_CASE_KEY"} {
+		key, err := repo.GetKeyFold(ctx, apiKey)
+		is.NoErr(err)
+		is.Equal("Mixed_Case_Key", key.ApiKey)
+	}
+
+	t.Run("exact match is preferred", func(t *testing.T) {
+		err := repo.InsertKey(ctx, server.Key{ApiKey: "mixed_case_key", PrivateKey: "private", PublicKey: "public", Address: "address"})
+		is.NoErr(err)
+
+		key, err := repo.GetKeyFold(ctx, "mixed_case_key")
+		is.NoErr(err)
+		is.Equal("mixed_case_key", key.ApiKey)
+
+		key, err = repo.GetKeyFold(ctx, "Mixed_Case_Key")
+		is.NoErr(err)
+		is.Equal("Mixed_Case_Key", key.ApiKey)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := repo.GetKeyFold(ctx, "unknown_key")
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock), repository.WithAuditLog())
+	ctx := repository.ContextWithActor(context.Background(), "admin")
+
+	from := time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 1)
+
+	err = repo.InsertKey(ctx, server.Key{ApiKey: "audited_key", PrivateKey: "private", PublicKey: "public", Address: "address"})
+	is.NoErr(err)
+
+	clock.Advance(time.Minute)
+	err = repo.DeactivateKey(ctx, "audited_key", "rotated")
+	is.NoErr(err)
+
+	entries, err := repo.GetAuditLog(ctx, from, to)
+	is.NoErr(err)
+	is.Equal(2, len(entries))
+
+	is.Equal(repository.AuditKeyCreated, entries[0].Operation)
+	is.Equal("audited_key", entries[0].TargetID)
+	is.Equal("admin", entries[0].Actor)
+	is.Equal("2023-03-01T10:00:00.000Z", entries[0].CreatedAt)
+
+	is.Equal(repository.AuditKeyRevoked, entries[1].Operation)
+	is.Equal("audited_key", entries[1].TargetID)
+	is.Equal("2023-03-01T10:01:00.000Z", entries[1].CreatedAt)
+
+	t.Run("only revoked keys are recorded by DeactivateKeys", func(t *testing.T) {
+		clock.Advance(time.Minute)
+		from := clock.Now()
+
+		revoked, err := repo.DeactivateKeys(ctx, []string{"api_key_1", "api_key_3"}, "")
+		is.NoErr(err)
+		is.Equal(int64(1), revoked)
+
+		entries, err := repo.GetAuditLog(ctx, from, to)
+		is.NoErr(err)
+		is.Equal(1, len(entries))
+		is.Equal(repository.AuditKeyRevoked, entries[0].Operation)
+		is.Equal("api_key_1", entries[0].TargetID)
+	})
+
+	t.Run("not recorded without the option", func(t *testing.T) {
+		repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+
+		clock.Advance(time.Minute)
+		from := clock.Now()
+
+		err := repo.InsertKey(ctx, server.Key{ApiKey: "unaudited_key", PrivateKey: "private", PublicKey: "public", Address: "address"})
+		is.NoErr(err)
+
+		entries, err := repo.GetAuditLog(ctx, from, to)
+		is.NoErr(err)
+		is.Equal(0, len(entries))
+	})
+}
+
+func TestGetTransactionsByKeyAndType(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	for _, tx := range []server.Transaction{
+		{ID: "hash_tx_1", ApiKey: "api_key_1", DataBytes: 32, IsHash: true},
+		{ID: "hash_tx_2", ApiKey: "api_key_1", DataBytes: 32, IsHash: true},
+		{ID: "hash_tx_3", ApiKey: "api_key_2", DataBytes: 32, IsHash: true},
+	} {
+		err = repo.InsertTransaction(ctx, tx)
+		is.NoErr(err)
+	}
+
+	tcs := []struct {
+		name        string
+		apiKey      string
+		isHash      bool
+		expectedIDs []string
+	}{
+		{name: "key 1 full data", apiKey: "api_key_1", isHash: false, expectedIDs: []string{"2BDCFF23", "27EC83F0", "BA93B557", "2C34AE2C"}},
+		{name: "key 1 hash only", apiKey: "api_key_1", isHash: true, expectedIDs: []string{"hash_tx_1", "hash_tx_2"}},
+		{name: "key 2 full data", apiKey: "api_key_2", isHash: false, expectedIDs: []string{"6A4410C3", "7650035F"}},
+		{name: "key 2 hash only", apiKey: "api_key_2", isHash: true, expectedIDs: []string{"hash_tx_3"}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			txs, err := repo.GetTransactionsByKeyAndType(ctx, tc.apiKey, tc.isHash, 10, 0)
+			is.NoErr(err)
+			is.Equal(len(tc.expectedIDs), len(txs))
+
+			for i, tx := range txs {
+				is.Equal(tc.expectedIDs[i], tx.ID)
+				is.Equal(tc.apiKey, tx.ApiKey)
+				is.Equal(tc.isHash, tx.IsHash)
+			}
+		})
+	}
+
+	t.Run("pagination", func(t *testing.T) {
+		txs, err := repo.GetTransactionsByKeyAndType(ctx, "api_key_1", false, 2, 1)
+		is.NoErr(err)
+		is.Equal(2, len(txs))
+		is.Equal("27EC83F0", txs[0].ID)
+		is.Equal("BA93B557", txs[1].ID)
+		is.Equal("2022-05-12 22:10:58.022Z", txs[0].CreatedAt)
+	})
+}
+
+func TestGetKeysUsage(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	keysUsage, err := repo.GetKeysUsage(ctx, []string{"api_key_1", "api_key_4", "api_key_3", "unknown_key"})
+	is.NoErr(err)
+	is.Equal(2, len(keysUsage))
+
+	usages := make(map[string]int64)
+	for _, keyUsage := range keysUsage {
+		usages[keyUsage.ApiKey] = keyUsage.DataBytes
+	}
+
+	is.Equal(int64(523), usages["api_key_1"])
+	is.Equal(int64(0), usages["api_key_4"])
+
+	t.Run("no keys", func(t *testing.T) {
+		keysUsage, err := repo.GetKeysUsage(ctx, nil)
+		is.NoErr(err)
+		is.Equal(0, len(keysUsage))
+	})
+}
+
+func TestWithMaxRows(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	ctx := context.Background()
+
+	t.Run("transactions at the limit", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now, repository.WithMaxRows(6))
+
+		txs, err := repo.GetAllTransactions(ctx, true, 0)
+		is.NoErr(err)
+		is.Equal(6, len(txs))
+	})
+
+	t.Run("transactions over the limit", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now, repository.WithMaxRows(5))
+
+		_, err := repo.GetAllTransactions(ctx, true, 0)
+		is.True(errors.Is(err, server.ErrResultTooLarge))
+	})
+
+	t.Run("keys at the limit", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now, repository.WithMaxRows(4))
+
+		keys, err := repo.GetAllKeys(ctx, true, false)
+		is.NoErr(err)
+		is.Equal(4, len(keys))
+	})
+
+	t.Run("keys over the limit", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now, repository.WithMaxRows(3))
+
+		_, err := repo.GetAllKeys(ctx, true, false)
+		is.True(errors.Is(err, server.ErrResultTooLarge))
+
+		// Only the active keys are within the limit
+		keys, err := repo.GetAllKeys(ctx, false, false)
+		is.NoErr(err)
+		is.Equal(3, len(keys))
+	})
+}
+
+func TestGetTransactionInfoInvalidRange(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	to := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, 0, -30)
+
+	tcs := []struct {
+		name string
+		from time.Time
+		to   time.Time
+	}{
+		{name: "swapped", from: to, to: from},
+		{name: "zero to", from: from, to: time.Time{}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := repo.GetTransactionInfo(ctx, tc.from, tc.to, server.Day)
+			is.True(errors.Is(err, server.ErrInvalidRange))
+
+			_, _, err = repo.GetTransactionInfoWithSummary(ctx, tc.from, tc.to, server.Day)
+			is.True(errors.Is(err, server.ErrInvalidRange))
+		})
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	from := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tcs := []struct {
+		name     string
+		apiKey   string
+		perByte  float64
+		perTx    float64
+		expected float64
+	}{
+		// 50 + 333 + 100 bytes in 3 transactions
+		{name: "bytes and transactions", apiKey: "api_key_1", perByte: 0.01, perTx: 0.5, expected: 483*0.01 + 3*0.5},
+		{name: "bytes only", apiKey: "api_key_1", perByte: 2, perTx: 0, expected: 966},
+		// 100 + 200 bytes in 2 transactions
+		{name: "other key", apiKey: "api_key_2", perByte: 0.25, perTx: 1.5, expected: 300*0.25 + 2*1.5},
+		{name: "no transactions", apiKey: "api_key_4", perByte: 0.01, perTx: 0.5, expected: 0},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			cost, err := repo.EstimateCost(ctx, tc.apiKey, from, to, tc.perByte, tc.perTx)
+			is.NoErr(err)
+			is.True(math.Abs(tc.expected-cost) < 1e-9)
+		})
+	}
+}
+
+func TestSubscribeTransactions(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if db.DriverName() != "postgres" {
+		repo := repository.NewRepository(db, time.Now)
+
+		_, err := repo.SubscribeTransactions(ctx)
+		is.True(errors.Is(err, server.ErrUnsupported))
+
+		t.Skip("change feed needs PostgreSQL")
+	}
+
+	connectionString := database.PostgreSqlConnectionString("localhost", dbport, dbuser, dbpassword, dbname)
+	repo := repository.NewRepository(db, time.Now, repository.WithChangeFeed(connectionString))
+
+	txs, err := repo.SubscribeTransactions(ctx)
+	is.NoErr(err)
+
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "feed_tx", ApiKey: "api_key_1", DataBytes: 12})
+	is.NoErr(err)
+
+	select {
+	case tx := <-txs:
+		is.Equal("feed_tx", tx.ID)
+		is.Equal(int64(12), tx.DataBytes)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no transaction received")
+	}
+
+	cancel()
+
+	_, open := <-txs
+	is.True(!open)
+}
+
+func TestGetTransactionInfoActiveKeys(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 7, 1, 10, 30, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	for _, tx := range []server.Transaction{
+		{ID: "active_tx_1", ApiKey: "api_key_1", DataBytes: 1},
+		{ID: "active_tx_2", ApiKey: "api_key_1", DataBytes: 2},
+		{ID: "active_tx_3", ApiKey: "api_key_2", DataBytes: 3},
+	} {
+		err = repo.InsertTransaction(ctx, tx)
+		is.NoErr(err)
+	}
+
+	from := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 7, 2, 0, 0, 0, 0, time.UTC)
+
+	transactions, err := repo.GetTransactionInfo(ctx, from, to, server.Hour)
+	is.NoErr(err)
+	is.Equal(1, len(transactions))
+	is.Equal(3, transactions[0].Count)
+	is.Equal(int64(6), transactions[0].DataBytes)
+	is.Equal(2, transactions[0].ActiveKeys)
+}
+
+func TestFindDuplicateContent(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	for _, tx := range []server.Transaction{
+		{ID: "content_tx_1", ApiKey: "api_key_1", DataBytes: 1, ContentHash: "aaaa"},
+		{ID: "content_tx_2", ApiKey: "api_key_1", DataBytes: 1, ContentHash: "bbbb"},
+		{ID: "content_tx_3", ApiKey: "api_key_1", DataBytes: 1, ContentHash: "aaaa"},
+		{ID: "content_tx_4", ApiKey: "api_key_1", DataBytes: 1, ContentHash: "cccc"},
+		{ID: "content_tx_5", ApiKey: "api_key_1", DataBytes: 1, ContentHash: "aaaa"},
+		// Same content as content_tx_2, but written with another key
+		{ID: "content_tx_6", ApiKey: "api_key_2", DataBytes: 1, ContentHash: "bbbb"},
+	} {
+		clock.Advance(time.Minute)
+		err = repo.InsertTransaction(ctx, tx)
+		is.NoErr(err)
+	}
+
+	t.Run("duplicate content", func(t *testing.T) {
+		duplicates, err := repo.FindDuplicateContent(ctx, "api_key_1")
+		is.NoErr(err)
+		is.Equal(map[string][]string{"aaaa": {"content_tx_1", "content_tx_3", "content_tx_5"}}, duplicates)
+	})
+
+	t.Run("unique content", func(t *testing.T) {
+		duplicates, err := repo.FindDuplicateContent(ctx, "api_key_2")
+		is.NoErr(err)
+		is.Equal(0, len(duplicates))
+	})
+
+	t.Run("transactions without content hash", func(t *testing.T) {
+		// The fixtures of api_key_1 have no content hash
+		duplicates, err := repo.FindDuplicateContent(ctx, "api_key_1")
+		is.NoErr(err)
+		_, ok := duplicates[""]
+		is.True(!ok)
+	})
+}
+
+func TestGetKeyMeta(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	t.Run("active key", func(t *testing.T) {
+		key, err := repo.GetKeyMeta(ctx, "api_key_1")
+		is.NoErr(err)
+		is.Equal(server.KeyMeta{ApiKey: "api_key_1", Address: "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", CreatedAt: "2022-05-21 15:10:58.022Z"}, key)
+
+		// The private and public key must not be loaded at all
+		encoded, err := json.Marshal(key)
+		is.NoErr(err)
+		is.True(!strings.Contains(string(encoded), "2099n2dskd"))
+		is.True(!strings.Contains(string(encoded), "xskd023k3"))
+	})
+
+	t.Run("revoked key", func(t *testing.T) {
+		key, err := repo.GetKeyMeta(ctx, "api_key_3")
+		is.NoErr(err)
+		is.True(key.RevokedAt != nil)
+		is.Equal("2022-06-24 15:10:58.022Z", *key.RevokedAt)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := repo.GetKeyMeta(ctx, "unknown_key")
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestTransactionStatus(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	tx, err := repo.GetTransaction(ctx, "2BDCFF23")
+	is.NoErr(err)
+	is.Equal(server.TransactionStatusPending, tx.Status)
+	is.True(tx.StatusAt == nil)
+
+	broadcastAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	confirmedAt := broadcastAt.Add(10 * time.Minute)
+
+	t.Run("broadcast", func(t *testing.T) {
+		err := repo.UpdateTransactionStatus(ctx, "2BDCFF23", server.TransactionStatusBroadcast, broadcastAt)
+		is.NoErr(err)
+
+		tx, err := repo.GetTransaction(ctx, "2BDCFF23")
+		is.NoErr(err)
+		is.Equal(server.TransactionStatusBroadcast, tx.Status)
+		is.Equal(broadcastAt.Format(repository.ISO8601), *tx.StatusAt)
+
+		txs, err := repo.GetTransactionsByStatus(ctx, server.TransactionStatusBroadcast)
+		is.NoErr(err)
+		is.Equal(1, len(txs))
+		is.Equal("2BDCFF23", txs[0].ID)
+	})
+
+	t.Run("confirmed", func(t *testing.T) {
+		err := repo.UpdateTransactionStatus(ctx, "2BDCFF23", server.TransactionStatusConfirmed, confirmedAt)
+		is.NoErr(err)
+
+		txs, err := repo.GetTransactionsByStatus(ctx, server.TransactionStatusBroadcast)
+		is.NoErr(err)
+		is.Equal(0, len(txs))
+
+		txs, err = repo.GetTransactionsByStatus(ctx, server.TransactionStatusConfirmed)
+		is.NoErr(err)
+		is.Equal(1, len(txs))
+		is.Equal(confirmedAt.Format(repository.ISO8601), *txs[0].StatusAt)
+
+		txs, err = repo.GetTransactionsByStatus(ctx, server.TransactionStatusPending)
+		is.NoErr(err)
+		is.Equal(5, len(txs))
+	})
+
+	t.Run("invalid status", func(t *testing.T) {
+		err := repo.UpdateTransactionStatus(ctx, "2BDCFF23", "lost", confirmedAt)
+		is.True(errors.Is(err, server.ErrInvalidStatus))
+
+		var statusErr server.InvalidStatusError
+		is.True(errors.As(err, &statusErr))
+		is.Equal("lost", statusErr.Status)
+
+		_, err = repo.GetTransactionsByStatus(ctx, "lost")
+		is.True(errors.Is(err, server.ErrInvalidStatus))
+	})
+
+	t.Run("back to reserving", func(t *testing.T) {
+		err := repo.UpdateTransactionStatus(ctx, "2BDCFF23", server.TransactionStatusReserving, confirmedAt)
+		is.True(errors.Is(err, server.ErrInvalidStatus))
+
+		tx, err := repo.GetTransaction(ctx, "2BDCFF23")
+		is.NoErr(err)
+		is.Equal(server.TransactionStatusConfirmed, tx.Status)
+	})
+
+	t.Run("unknown transaction", func(t *testing.T) {
+		err := repo.UpdateTransactionStatus(ctx, "unknown_tx", server.TransactionStatusRejected, confirmedAt)
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestCheckConsistency(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	t.Run("consistent", func(t *testing.T) {
+		repo := repository.NewRepository(db, func() time.Time { return now })
+
+		report, err := repo.CheckConsistency(ctx)
+		is.NoErr(err)
+		is.Equal(0, report.OrphanedTransactions.Count)
+		is.Equal(0, report.DuplicateAddresses.Count)
+		is.Equal(0, report.FutureTransactions.Count)
+		is.Equal(0, report.FutureKeys.Count)
+	})
+
+	// Rows seeded one day after now look future-dated to the check
+	future := repository.NewRepository(db, func() time.Time { return now.AddDate(0, 0, 1) })
+
+	err = future.InsertTransaction(ctx, server.Transaction{ID: "orphaned_tx", ApiKey: "deleted_api_key", DataBytes: 1})
+	is.NoErr(err)
+
+	err = future.InsertKey(ctx, server.Key{ApiKey: "duplicate_address_key", PrivateKey: "private", PublicKey: "public", Address: "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"})
+	is.NoErr(err)
+
+	t.Run("inconsistent", func(t *testing.T) {
+		repo := repository.NewRepository(db, func() time.Time { return now })
+
+		report, err := repo.CheckConsistency(ctx)
+		is.NoErr(err)
+
+		is.Equal(server.ConsistencyIssue{Count: 1, SampleIDs: []string{"orphaned_tx"}}, report.OrphanedTransactions)
+		is.Equal(server.ConsistencyIssue{Count: 2, SampleIDs: []string{"api_key_1", "duplicate_address_key"}}, report.DuplicateAddresses)
+		is.Equal(server.ConsistencyIssue{Count: 1, SampleIDs: []string{"orphaned_tx"}}, report.FutureTransactions)
+		is.Equal(server.ConsistencyIssue{Count: 1, SampleIDs: []string{"duplicate_address_key"}}, report.FutureKeys)
+		// Without a validator the addresses are not checked
+		is.Equal(server.ConsistencyIssue{Count: 0, SampleIDs: []string{}}, report.MalformedAddresses)
+	})
+
+	t.Run("malformed addresses", func(t *testing.T) {
+		repo := repository.NewRepository(db, func() time.Time { return now }, repository.WithAddressValidator(server.BSVAddressValidator{}))
+
+		report, err := repo.CheckConsistency(ctx)
+		is.NoErr(err)
+
+		// The fixture address of api_key_4 is malformed, duplicate_address_key shares a valid one
+		is.Equal(server.ConsistencyIssue{Count: 1, SampleIDs: []string{"api_key_4"}}, report.MalformedAddresses)
+	})
+}
+
+func TestGetTransactionsSince(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	start := clock.Now()
+
+	expectedIDs := []string{"since_tx_1", "since_tx_2", "since_tx_3", "since_tx_4", "since_tx_5"}
+	for _, id := range expectedIDs {
+		clock.Advance(time.Second)
+		err = repo.InsertTransaction(ctx, server.Transaction{ID: id, ApiKey: "api_key_1", DataBytes: 1})
+		is.NoErr(err)
+	}
+
+	var ids []string
+	since := start
+
+	for {
+		txs, err := repo.GetTransactionsSince(ctx, since, 2)
+		is.NoErr(err)
+		is.True(len(txs) <= 2)
+
+		if len(txs) == 0 {
+			break
+		}
+
+		for _, tx := range txs {
+			ids = append(ids, tx.ID)
+		}
+
+		since, err = time.Parse(repository.ISO8601, txs[len(txs)-1].CreatedAt)
+		is.NoErr(err)
+	}
+
+	is.Equal(expectedIDs, ids)
+}
+
+func TestMarkTransactionReplaced(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	err = repo.MarkTransactionReplaced(ctx, "2BDCFF23", "replacement_tx_1")
+	is.NoErr(err)
+
+	err = repo.MarkTransactionReplaced(ctx, "replacement_tx_1", "replacement_tx_2")
+	is.NoErr(err)
+
+	original, err := repo.GetTransaction(ctx, "2BDCFF23")
+	is.NoErr(err)
+	is.Equal("replacement_tx_1", *original.ReplacedBy)
+
+	replacement, err := repo.GetTransaction(ctx, "replacement_tx_2")
+	is.NoErr(err)
+	is.True(replacement.ReplacedBy == nil)
+	is.Equal(original.ApiKey, replacement.ApiKey)
+	is.Equal(original.DataBytes, replacement.DataBytes)
+	is.Equal(original.Filename, replacement.Filename)
+	is.Equal(original.Secret, replacement.Secret)
+	is.Equal(original.FeeSatoshis, replacement.FeeSatoshis)
+	is.Equal("2022-07-01T10:00:00.000Z", replacement.CreatedAt)
+	is.Equal(server.TransactionStatusBroadcast, replacement.Status)
+	is.Equal("2022-07-01T10:00:00.000Z", *replacement.StatusAt)
+
+	// The replacement has been broadcast, so it is never stuck pending
+	later := repository.NewRepository(db, func() time.Time { return now().Add(2 * time.Hour) })
+	stuck, err := later.GetStuckTransactions(ctx, server.TransactionStatusPending, time.Hour)
+	is.NoErr(err)
+	is.True(len(stuck) > 0) // the fixture transactions are pending
+	for _, tx := range stuck {
+		is.True(!strings.HasPrefix(tx.ID, "replacement_tx_"))
+	}
+
+	for _, txid := range []string{"2BDCFF23", "replacement_tx_1", "replacement_tx_2"} {
+		latest, err := repo.ResolveReplacement(ctx, txid)
+		is.NoErr(err)
+		is.Equal("replacement_tx_2", latest)
+	}
+
+	t.Run("not replaced", func(t *testing.T) {
+		latest, err := repo.ResolveReplacement(ctx, "27EC83F0")
+		is.NoErr(err)
+		is.Equal("27EC83F0", latest)
+	})
+
+	t.Run("unknown transaction", func(t *testing.T) {
+		err := repo.MarkTransactionReplaced(ctx, "unknown_tx", "replacement_tx_3")
+		is.Equal(sql.ErrNoRows, err)
+
+		_, err = repo.GetTransaction(ctx, "replacement_tx_3")
+		is.Equal(sql.ErrNoRows, err)
+
+		_, err = repo.ResolveReplacement(ctx, "unknown_tx")
+		is.Equal(sql.ErrNoRows, err)
+	})
+
+	t.Run("replaced by itself", func(t *testing.T) {
+		err := repo.MarkTransactionReplaced(ctx, "27EC83F0", "27EC83F0")
+		is.True(errors.Is(err, server.ErrInvalidTransaction))
+	})
+}
+
+func TestQueryKeys(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	revoked := true
+	active := false
+
+	tcs := []struct {
+		name         string
+		filter       server.KeyFilter
+		expectedKeys []string
+	}{
+		{name: "no filter", filter: server.KeyFilter{}, expectedKeys: []string{"api_key_3", "api_key_1", "api_key_2", "api_key_4"}},
+		{
+			name:         "created after and active",
+			filter:       server.KeyFilter{CreatedAfter: time.Date(2022, 5, 15, 0, 0, 0, 0, time.UTC), Revoked: &active},
+			expectedKeys: []string{"api_key_1", "api_key_2", "api_key_4"},
+		},
+		{
+			name: "created between",
+			filter: server.KeyFilter{
+				CreatedAfter:  time.Date(2022, 5, 15, 0, 0, 0, 0, time.UTC),
+				CreatedBefore: time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC),
+			},
+			expectedKeys: []string{"api_key_1", "api_key_2"},
+		},
+		{name: "revoked", filter: server.KeyFilter{Revoked: &revoked}, expectedKeys: []string{"api_key_3"}},
+		{name: "revoked created after", filter: server.KeyFilter{CreatedAfter: time.Date(2022, 5, 15, 0, 0, 0, 0, time.UTC), Revoked: &revoked}, expectedKeys: []string{}},
+		{name: "address prefix", filter: server.KeyFilter{AddressPrefix: "1Bg"}, expectedKeys: []string{"api_key_1"}},
+		{name: "address prefix is not a pattern", filter: server.KeyFilter{AddressPrefix: "%"}, expectedKeys: []string{}},
+		{name: "limit and offset", filter: server.KeyFilter{Revoked: &active, Limit: 2, Offset: 1}, expectedKeys: []string{"api_key_2", "api_key_4"}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := repo.QueryKeys(ctx, tc.filter)
+			is.NoErr(err)
+
+			apiKeys := make([]string, len(keys))
+			for i, key := range keys {
+				apiKeys[i] = key.ApiKey
+			}
+			is.Equal(tc.expectedKeys, apiKeys)
+		})
+	}
+}
+
+func TestQueryTransactions(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	hash := true
+	full := false
+
+	tcs := []struct {
+		name          string
+		filter        server.TransactionFilter
+		expectedIDs   []string
+		expectedTotal int
+	}{
+		{
+			name:          "no filter",
+			filter:        server.TransactionFilter{},
+			expectedIDs:   []string{"6A4410C3", "2BDCFF23", "27EC83F0", "7650035F", "BA93B557", "2C34AE2C"},
+			expectedTotal: 6,
+		},
+		{
+			name: "time range ascending",
+			filter: server.TransactionFilter{
+				From:      time.Date(2022, 5, 9, 0, 0, 0, 0, time.UTC),
+				To:        time.Date(2022, 5, 24, 0, 0, 0, 0, time.UTC),
+				SortOrder: server.SortAscending,
+			},
+			expectedIDs:   []string{"BA93B557", "7650035F", "27EC83F0", "2BDCFF23"},
+			expectedTotal: 4,
+		},
+		{
+			name:          "bytes and api key",
+			filter:        server.TransactionFilter{MinBytes: 50, MaxBytes: 200, ApiKey: "api_key_1"},
+			expectedIDs:   []string{"2BDCFF23", "BA93B557"},
+			expectedTotal: 2,
+		},
+		{name: "hash", filter: server.TransactionFilter{IsHash: &hash}, expectedIDs: []string{}, expectedTotal: 0},
+		{
+			name:          "full data with limit and offset",
+			filter:        server.TransactionFilter{IsHash: &full, ApiKey: "api_key_1", Limit: 2, Offset: 1},
+			expectedIDs:   []string{"27EC83F0", "BA93B557"},
+			expectedTotal: 4,
+		},
+		{
+			name:          "offset beyond total",
+			filter:        server.TransactionFilter{MaxBytes: 100, Limit: 10, Offset: 10},
+			expectedIDs:   []string{},
+			expectedTotal: 4,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			txs, total, err := repo.QueryTransactions(ctx, tc.filter)
+			is.NoErr(err)
+			is.Equal(tc.expectedTotal, total)
+
+			ids := make([]string, len(txs))
+			for i, tx := range txs {
+				ids[i] = tx.ID
+			}
+			is.Equal(tc.expectedIDs, ids)
+		})
+	}
+
+	t.Run("invalid sort order", func(t *testing.T) {
+		_, _, err := repo.QueryTransactions(ctx, server.TransactionFilter{SortOrder: "up"})
+		is.True(errors.Is(err, server.ErrInvalidSortOrder))
+	})
+}
+
+// TestQueryTransactionsIsHash matches rows on both values of the filter, as is_hash is an INTEGER
+// column which PostgreSQL does not compare with a bound bool.
+func TestQueryTransactionsIsHash(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "hash_tx", ApiKey: "api_key_1", DataBytes: 32, IsHash: true})
+	is.NoErr(err)
+
+	hash := true
+	txs, total, err := repo.QueryTransactions(ctx, server.TransactionFilter{IsHash: &hash})
+	is.NoErr(err)
+	is.Equal(1, total)
+	is.Equal("hash_tx", txs[0].ID)
+	is.True(txs[0].IsHash)
+
+	full := false
+	txs, total, err = repo.QueryTransactions(ctx, server.TransactionFilter{IsHash: &full})
+	is.NoErr(err)
+	is.Equal(6, total)
+	for _, tx := range txs {
+		is.True(!tx.IsHash)
+	}
+}
+
+func TestInsertTransactionIdempotent(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	t.Run("first use", func(t *testing.T) {
+		existing, err := repo.InsertTransactionIdempotent(ctx, server.Transaction{ID: "idempotent_tx_1", ApiKey: "api_key_1", DataBytes: 10}, "request_1")
+		is.NoErr(err)
+		is.True(existing == nil)
+
+		tx, err := repo.GetTransaction(ctx, "idempotent_tx_1")
+		is.NoErr(err)
+		is.Equal("request_1", *tx.IdempotencyKey)
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		clock.Advance(time.Minute)
+
+		// The retried request has computed another txid
+		existing, err := repo.InsertTransactionIdempotent(ctx, server.Transaction{ID: "idempotent_tx_2", ApiKey: "api_key_1", DataBytes: 10}, "request_1")
+		is.NoErr(err)
+		is.True(existing != nil)
+		is.Equal("idempotent_tx_1", existing.ID)
+		is.Equal("2022-07-01T10:00:00.000Z", existing.CreatedAt)
+
+		_, err = repo.GetTransaction(ctx, "idempotent_tx_2")
+		is.Equal(sql.ErrNoRows, err)
+	})
+
+	t.Run("another key", func(t *testing.T) {
+		existing, err := repo.InsertTransactionIdempotent(ctx, server.Transaction{ID: "idempotent_tx_3", ApiKey: "api_key_1", DataBytes: 10}, "request_2")
+		is.NoErr(err)
+		is.True(existing == nil)
+	})
+
+	t.Run("empty key", func(t *testing.T) {
+		_, err := repo.InsertTransactionIdempotent(ctx, server.Transaction{ID: "idempotent_tx_4", ApiKey: "api_key_1", DataBytes: 10}, "")
+		is.True(errors.Is(err, server.ErrInvalidTransaction))
+	})
+}
+
+func TestExportKeysEncrypted(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	original, err := repo.GetAllKeys(ctx, true, false)
+	is.NoErr(err)
+
+	var buf bytes.Buffer
+	err = repo.ExportKeysEncrypted(ctx, &buf, "correct horse")
+	is.NoErr(err)
+
+	exported := buf.Bytes()
+	is.True(!bytes.Contains(exported, []byte("2099n2dskd")))
+	is.True(!bytes.Contains(exported, []byte("api_key_1")))
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		err := repo.ImportKeysEncrypted(ctx, bytes.NewReader(exported), "wrong horse")
+		is.True(errors.Is(err, server.ErrDecryptionFailed))
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		_, err := db.ExecContext(ctx, `DELETE FROM keys;`)
+		is.NoErr(err)
+
+		err = repo.ImportKeysEncrypted(ctx, bytes.NewReader(exported), "correct horse")
+		is.NoErr(err)
+
+		restored, err := repo.GetAllKeys(ctx, true, false)
+		is.NoErr(err)
+		is.Equal(original, restored)
+
+		key, err := repo.GetKey(ctx, "api_key_1")
+		is.NoErr(err)
+		is.Equal("2099n2dskd", key.PrivateKey)
+	})
+
+	t.Run("existing keys are kept", func(t *testing.T) {
+		err := repo.ImportKeysEncrypted(ctx, bytes.NewReader(exported), "correct horse")
+		is.NoErr(err)
+
+		restored, err := repo.GetAllKeys(ctx, true, false)
+		is.NoErr(err)
+		is.Equal(original, restored)
+	})
+}
+
+func TestGetTransactionInfoWithoutFractionalSeconds(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	err = repo.RestoreTransactions(ctx, []server.Transaction{
+		{ID: "whole_second_tx", ApiKey: "api_key_1", DataBytes: 1, CreatedAt: "2022-07-01T10:30:15Z"},
+		{ID: "no_seconds_tx", ApiKey: "api_key_1", DataBytes: 2, CreatedAt: "2022-07-01T11:45Z"},
+	})
+	is.NoErr(err)
+
+	from := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	tcs := []struct {
+		granularity server.Granularity
+		expected    []time.Time
+	}{
+		{granularity: server.None, expected: []time.Time{time.Date(2022, 7, 1, 11, 45, 0, 0, time.UTC), time.Date(2022, 7, 1, 10, 30, 15, 0, time.UTC)}},
+		{granularity: server.Minute, expected: []time.Time{time.Date(2022, 7, 1, 11, 45, 0, 0, time.UTC), time.Date(2022, 7, 1, 10, 30, 0, 0, time.UTC)}},
+		{granularity: server.Hour, expected: []time.Time{time.Date(2022, 7, 1, 11, 0, 0, 0, time.UTC), time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)}},
+		{granularity: server.Day, expected: []time.Time{time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(strconv.Itoa(int(tc.granularity)), func(t *testing.T) {
+			transactions, err := repo.GetTransactionInfo(ctx, from, to, tc.granularity)
+			is.NoErr(err)
+			is.Equal(len(tc.expected), len(transactions))
+
+			for i, expected := range tc.expected {
+				is.True(expected.Equal(transactions[i].Timestamp))
+			}
+		})
+	}
+}
+
+func TestGetKeysMissingAddress(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	keys, err := repo.GetKeysMissingAddress(ctx)
+	is.NoErr(err)
+	is.Equal(0, len(keys))
+
+	err = repo.InsertKey(ctx, server.Key{ApiKey: "address_less_key", PrivateKey: "private", PublicKey: "public"})
+	is.NoErr(err)
+
+	keys, err = repo.GetKeysMissingAddress(ctx)
+	is.NoErr(err)
+	is.Equal(1, len(keys))
+	is.Equal("address_less_key", keys[0].ApiKey)
+
+	err = repo.SetKeyAddress(ctx, "address_less_key", "1BackfilledAddress")
+	is.NoErr(err)
+
+	keys, err = repo.GetKeysMissingAddress(ctx)
+	is.NoErr(err)
+	is.Equal(0, len(keys))
+
+	key, err := repo.GetKey(ctx, "address_less_key")
+	is.NoErr(err)
+	is.Equal("1BackfilledAddress", key.Address)
+
+	t.Run("unknown key", func(t *testing.T) {
+		err := repo.SetKeyAddress(ctx, "unknown_key", "1BackfilledAddress")
+		is.Equal(sql.ErrNoRows, err)
+	})
+
+	t.Run("empty address", func(t *testing.T) {
+		err := repo.SetKeyAddress(ctx, "address_less_key", "")
+		is.True(err != nil)
+	})
+}
+
+func TestGetTransactionWithAge(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 5, 23, 18, 10, 58, 22000000, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	// 2BDCFF23 was created at 2022-05-23T15:10:58.022Z
+	tx, age, err := repo.GetTransactionWithAge(ctx, "2BDCFF23")
+	is.NoErr(err)
+	is.Equal("2BDCFF23", tx.ID)
+	is.Equal(3*time.Hour, age)
+
+	clock.Advance(90 * time.Minute)
+
+	_, age, err = repo.GetTransactionWithAge(ctx, "2BDCFF23")
+	is.NoErr(err)
+	is.Equal(4*time.Hour+30*time.Minute, age)
+
+	t.Run("unknown transaction", func(t *testing.T) {
+		_, _, err := repo.GetTransactionWithAge(ctx, "unknown_tx")
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestStartMaintenance(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	// Only 6A4410C3 and 2BDCFF23 are within 7 days of now
+	clock := server.NewManualClock(time.Date(2022, 5, 26, 0, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	var logs bytes.Buffer
+	var logsMtx sync.Mutex
+
+	stop, err := repo.StartMaintenance(ctx, server.MaintenanceConfig{
+		Interval:  10 * time.Millisecond,
+		Retention: 7 * 24 * time.Hour,
+		Optimize:  true,
+		Logger:    log.New(&lockedWriter{w: &logs, mtx: &logsMtx}, "", 0),
+	})
+	is.NoErr(err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		txs, err := repo.GetAllTransactions(ctx, true, 0)
+		is.NoErr(err)
+
+		if len(txs) == 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("old transactions were not deleted, %d transactions left", len(txs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop()
+	stop()
+
+	_, err = repo.GetTransaction(ctx, "6A4410C3")
+	is.NoErr(err)
+	_, err = repo.GetTransaction(ctx, "2BDCFF23")
+	is.NoErr(err)
+
+	logsMtx.Lock()
+	defer logsMtx.Unlock()
+	is.True(strings.Contains(logs.String(), "maintenance deleted 4 transactions"))
+}
+
+func TestStartMaintenanceInvalidInterval(t *testing.T) {
+	is := is.New(t)
+
+	repo := repository.NewRepository(db, nil)
+	ctx := context.Background()
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		stop, err := repo.StartMaintenance(ctx, server.MaintenanceConfig{Interval: interval})
+		is.True(err != nil)
+		is.True(stop == nil)
+	}
+}
+
+// lockedWriter guards a writer which is written to from another goroutine.
+type lockedWriter struct {
+	w   *bytes.Buffer
+	mtx *sync.Mutex
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.w.Write(p)
+}
+
+func TestGetTransactionInfoMulti(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	to := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, 0, -60)
+
+	series, err := repo.GetTransactionInfoMulti(ctx, from, to, []server.Granularity{server.Day, server.Hour, server.Minute})
+	is.NoErr(err)
+	is.Equal(3, len(series))
+
+	total := func(txInfos []server.TransactionInfo) (int, int64) {
+		var count int
+		var dataBytes int64
+		for _, txInfo := range txInfos {
+			count += txInfo.Count
+			dataBytes += txInfo.DataBytes
+		}
+		return count, dataBytes
+	}
+
+	dayCount, dayBytes := total(series[server.Day])
+	is.Equal(6, dayCount)
+	is.Equal(int64(823), dayBytes)
+
+	for _, granularity := range []server.Granularity{server.Hour, server.Minute} {
+		count, dataBytes := total(series[granularity])
+		is.Equal(dayCount, count)
+		is.Equal(dayBytes, dataBytes)
+	}
+
+	single, err := repo.GetTransactionInfo(ctx, from, to, server.Hour)
+	is.NoErr(err)
+	is.Equal(single, series[server.Hour])
+}
+
+func TestGetTopFilenames(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	for i, filename := range []string{"backup.tar", "backup.tar", "backup.tar", "report.csv", "report.csv", "", "textfile1.txt"} {
+		err = repo.InsertTransaction(ctx, server.Transaction{ID: fmt.Sprintf("top_tx_%d", i), ApiKey: "api_key_1", DataBytes: 1, Filename: filename})
+		is.NoErr(err)
+	}
+
+	counts, err := repo.GetTopFilenames(ctx, 3)
+	is.NoErr(err)
+	is.Equal([]server.FilenameCount{
+		{Filename: "backup.tar", Count: 3},
+		{Filename: "report.csv", Count: 2},
+		{Filename: "textfile1.txt", Count: 2},
+	}, counts)
+
+	t.Run("empty filenames are excluded", func(t *testing.T) {
+		counts, err := repo.GetTopFilenames(ctx, 100)
+		is.NoErr(err)
+		for _, count := range counts {
+			is.True(count.Filename != "")
+		}
+	})
+}
+
+func TestGetKeyWithUsage(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	keyWithUsage, err := repo.GetKeyWithUsage(ctx, "api_key_1")
+	is.NoErr(err)
+
+	key, err := repo.GetKey(ctx, "api_key_1")
+	is.NoErr(err)
+
+	keysUsage, err := repo.GetKeysUsage(ctx, []string{"api_key_1"})
+	is.NoErr(err)
+	is.Equal(1, len(keysUsage))
+
+	is.Equal(key.ApiKey, keyWithUsage.ApiKey)
+	is.Equal(key.PublicKey, keyWithUsage.PublicKey)
+	is.Equal(key.Address, keyWithUsage.Address)
+	is.Equal(keysUsage[0].CreatedAt, keyWithUsage.CreatedAt)
+	is.Equal(keysUsage[0].DataBytes, keyWithUsage.DataBytes)
+	is.Equal(int64(4), keyWithUsage.TransactionCount)
+	is.Equal("", keyWithUsage.PrivateKey)
+
+	t.Run("revoked key", func(t *testing.T) {
+		keyWithUsage, err := repo.GetKeyWithUsage(ctx, "api_key_3")
+		is.NoErr(err)
+		is.Equal("2022-06-24 15:10:58.022Z", *keyWithUsage.RevokedAt)
+		is.Equal(int64(0), keyWithUsage.DataBytes)
+		is.Equal(int64(0), keyWithUsage.TransactionCount)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := repo.GetKeyWithUsage(ctx, "unknown_key")
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestTransactionMetadata(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	metadata, err := repo.GetTransactionMetadata(ctx, "6A4410C3")
+	is.NoErr(err)
+	is.Equal(nil, metadata)
+
+	expected := map[string]interface{}{
+		"tag": "invoice",
+		"fee": float64(12),
+		"source": map[string]interface{}{
+			"app":      "uploader",
+			"versions": []interface{}{"1.0", "1.1"},
+		},
+	}
+
+	err = repo.SetTransactionMetadata(ctx, "6A4410C3", expected)
+	is.NoErr(err)
+
+	metadata, err = repo.GetTransactionMetadata(ctx, "6A4410C3")
+	is.NoErr(err)
+	is.Equal(expected, metadata)
+
+	t.Run("query a key", func(t *testing.T) {
+		if db.DriverName() != "postgres" {
+			t.Skip("jsonb operators are only supported on postgres")
+		}
+
+		var ids []string
+		err := db.SelectContext(ctx, &ids, `SELECT id FROM transactions WHERE metadata->'source'->>'app' = $1;`, "uploader")
+		is.NoErr(err)
+		is.Equal([]string{"6A4410C3"}, ids)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		err := repo.SetTransactionMetadata(ctx, "6A4410C3", nil)
+		is.NoErr(err)
+
+		metadata, err := repo.GetTransactionMetadata(ctx, "6A4410C3")
+		is.NoErr(err)
+		is.Equal(nil, metadata)
+	})
+
+	t.Run("unknown transaction", func(t *testing.T) {
+		err := repo.SetTransactionMetadata(ctx, "unknown", expected)
+		is.Equal(sql.ErrNoRows, err)
+
+		_, err = repo.GetTransactionMetadata(ctx, "unknown")
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestGetTransactionsForDay(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	txs, err := repo.GetTransactionsForDay(ctx, "2022-05-12")
+	is.NoErr(err)
+	is.Equal(2, len(txs))
+	is.Equal("7650035F", txs[0].ID)
+	is.Equal("27EC83F0", txs[1].ID)
+	is.Equal("2022-05-12 15:10:58.022Z", txs[0].CreatedAt)
+
+	txs, err = repo.GetTransactionsForDay(ctx, "2022-05-13")
+	is.NoErr(err)
+	is.Equal(0, len(txs))
+
+	for _, day := range []string{"2022-5-12", "20220512", "2022-05-12%", "2022-05-12T00:00:00Z", ""} {
+		_, err = repo.GetTransactionsForDay(ctx, day)
+		is.True(errors.Is(err, server.ErrInvalidDay))
+	}
+}
+
+func TestForEachKeyUsage(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	expected, err := repo.GetAllKeysUsage(ctx)
+	is.NoErr(err)
+
+	var keys []server.KeyUsage
+	var sum int64
+	err = repo.ForEachKeyUsage(ctx, func(key server.KeyUsage) error {
+		keys = append(keys, key)
+		sum += key.DataBytes
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(expected, keys)
+
+	total, err := repo.GetTotalDataBytes(ctx)
+	is.NoErr(err)
+	is.Equal(int64(823), total)
+	is.Equal(total, sum)
+
+	t.Run("stops on error", func(t *testing.T) {
+		errStop := errors.New("stop")
+		calls := 0
+		err := repo.ForEachKeyUsage(ctx, func(key server.KeyUsage) error {
+			calls++
+			return errStop
+		})
+		is.Equal(errStop, err)
+		is.Equal(1, calls)
+	})
+}
+
+func TestTransactionTimestampsFixedWidth(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 5, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	// Inserted at 10:00:05, 10:00:05.5 and 10:00:06.
+	for i := 0; i < 3; i++ {
+		err = repo.InsertTransaction(ctx, server.Transaction{ID: fmt.Sprintf("fraction_tx_%d", i), ApiKey: "api_key_1", DataBytes: 10})
+		is.NoErr(err)
+		clock.Advance(500 * time.Millisecond)
+	}
+
+	var createdAt []string
+	err = db.SelectContext(ctx, &createdAt, `SELECT created_at FROM transactions WHERE id LIKE 'fraction_tx_%' ORDER BY id;`)
+	is.NoErr(err)
+	is.Equal([]string{"2022-07-01T10:00:05.000Z", "2022-07-01T10:00:05.500Z", "2022-07-01T10:00:06.000Z"}, createdAt)
+
+	t.Run("minute", func(t *testing.T) {
+		txInfos, err := repo.GetTransactionInfo(ctx, time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC), time.Date(2022, 7, 1, 10, 1, 0, 0, time.UTC), server.Minute)
+		is.NoErr(err)
+		is.Equal(1, len(txInfos))
+		is.Equal(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC), txInfos[0].Timestamp)
+		is.Equal(3, txInfos[0].Count)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		// A round second must not sort after a later fraction of the same second.
+		txInfos, err := repo.GetTransactionInfo(ctx, time.Date(2022, 7, 1, 10, 0, 5, 200000000, time.UTC), time.Date(2022, 7, 1, 10, 1, 0, 0, time.UTC), server.None)
+		is.NoErr(err)
+		is.Equal(2, len(txInfos))
+		is.Equal(time.Date(2022, 7, 1, 10, 0, 6, 0, time.UTC), txInfos[0].Timestamp)
+		is.Equal(1, txInfos[0].Count)
+		is.Equal(time.Date(2022, 7, 1, 10, 0, 5, 0, time.UTC), txInfos[1].Timestamp)
+		is.Equal(1, txInfos[1].Count)
+	})
+}
+
+func TestReserveTransaction(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	t.Run("reserve then finalize", func(t *testing.T) {
+		reserved, err := repo.ReserveTransaction(ctx, "reserved_tx", "api_key_1")
+		is.NoErr(err)
+		is.True(reserved)
+
+		tx, err := repo.GetTransaction(ctx, "reserved_tx")
+		is.NoErr(err)
+		is.Equal(server.TransactionStatusReserving, tx.Status)
+		is.Equal(int64(0), tx.DataBytes)
+
+		clock.Advance(time.Second)
+
+		err = repo.FinalizeTransaction(ctx, "reserved_tx", server.Transaction{ApiKey: "api_key_1", DataBytes: 42, Filename: "reserved.txt"})
+		is.NoErr(err)
+
+		tx, err = repo.GetTransaction(ctx, "reserved_tx")
+		is.NoErr(err)
+		is.Equal(server.TransactionStatusBroadcast, tx.Status)
+		is.Equal(int64(42), tx.DataBytes)
+		is.Equal("reserved.txt", tx.Filename)
+		is.Equal("2022-07-01T10:00:01.000Z", tx.CreatedAt)
+
+		err = repo.FinalizeTransaction(ctx, "reserved_tx", server.Transaction{ApiKey: "api_key_1", DataBytes: 43})
+		is.Equal(sql.ErrNoRows, err)
+	})
+
+	t.Run("double reserve", func(t *testing.T) {
+		reserved, err := repo.ReserveTransaction(ctx, "double_tx", "api_key_1")
+		is.NoErr(err)
+		is.True(reserved)
+
+		reserved, err = repo.ReserveTransaction(ctx, "double_tx", "api_key_2")
+		is.NoErr(err)
+		is.True(!reserved)
+
+		reserved, err = repo.ReserveTransaction(ctx, "6A4410C3", "api_key_2")
+		is.NoErr(err)
+		is.True(!reserved)
+	})
+
+	t.Run("finalize with another api key", func(t *testing.T) {
+		err := repo.FinalizeTransaction(ctx, "double_tx", server.Transaction{ApiKey: "api_key_2", DataBytes: 1})
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestReservedTransactionsExcludedFromReads(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	reserved, err := repo.ReserveTransaction(ctx, "reserved_tx", "api_key_4")
+	is.NoErr(err)
+	is.True(reserved)
+
+	from := time.Date(2022, 6, 30, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 7, 2, 0, 0, 0, 0, time.UTC)
+
+	txInfos, err := repo.GetTransactionInfo(ctx, from, to, server.Day)
+	is.NoErr(err)
+	is.Equal(0, len(txInfos))
+
+	_, summary, err := repo.GetTransactionInfoWithSummary(ctx, from, to, server.Day)
+	is.NoErr(err)
+	is.Equal(server.TransactionInfoSummary{}, summary)
+
+	txs, err := repo.GetAllTransactions(ctx, true, 0)
+	is.NoErr(err)
+	is.Equal(6, len(txs))
+
+	txs, total, err := repo.QueryTransactions(ctx, server.TransactionFilter{ApiKey: "api_key_4"})
+	is.NoErr(err)
+	is.Equal(0, len(txs))
+	is.Equal(0, total)
+
+	delta, err := repo.GetUsageDelta(ctx, from, to)
+	is.NoErr(err)
+	_, ok := delta["api_key_4"]
+	is.True(!ok)
+
+	discrepancies, err := repo.ReconcileWithUpstream(ctx, func(ctx context.Context, apiKey string) (int64, error) {
+		if apiKey == "api_key_4" {
+			return 0, nil
+		}
+		return -1, nil
+	})
+	is.NoErr(err)
+	for _, discrepancy := range discrepancies {
+		is.True(discrepancy.ApiKey != "api_key_4")
+	}
+
+	// the reservation itself can still be read
+	tx, err := repo.GetTransaction(ctx, "reserved_tx")
+	is.NoErr(err)
+	is.Equal(server.TransactionStatusReserving, tx.Status)
+
+	err = repo.FinalizeTransaction(ctx, "reserved_tx", server.Transaction{ApiKey: "api_key_4", DataBytes: 42})
+	is.NoErr(err)
+
+	_, summary, err = repo.GetTransactionInfoWithSummary(ctx, from, to, server.Day)
+	is.NoErr(err)
+	is.Equal(server.TransactionInfoSummary{TotalCount: 1, TotalDataBytes: 42}, summary)
+
+	txs, total, err = repo.QueryTransactions(ctx, server.TransactionFilter{ApiKey: "api_key_4"})
+	is.NoErr(err)
+	is.Equal(1, len(txs))
+	is.Equal(1, total)
+}
+
+func TestGetAllKeysUsageWithFilter(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	keys, err := repo.GetAllKeysUsageWithFilter(ctx, false)
+	is.NoErr(err)
+	is.Equal(3, len(keys))
+	is.Equal("api_key_1", keys[0].ApiKey)
+	is.Equal(int64(523), keys[0].DataBytes)
+	is.Equal("api_key_2", keys[1].ApiKey)
+	is.Equal(int64(300), keys[1].DataBytes)
+	is.Equal("api_key_4", keys[2].ApiKey)
+	is.Equal(int64(0), keys[2].DataBytes)
+
+	allKeys, err := repo.GetAllKeysUsage(ctx)
+	is.NoErr(err)
+	is.Equal(keys, allKeys)
+
+	keys, err = repo.GetAllKeysUsageWithFilter(ctx, true)
+	is.NoErr(err)
+	is.Equal(2, len(keys))
+	is.Equal("api_key_1", keys[0].ApiKey)
+	is.Equal("api_key_2", keys[1].ApiKey)
+}
+
+func TestGetStuckTransactions(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "stale_pending", ApiKey: "api_key_1", DataBytes: 1})
+	is.NoErr(err)
+	err = repo.UpdateTransactionStatus(ctx, "stale_pending", server.TransactionStatusPending, clock.Now())
+	is.NoErr(err)
+
+	// A plain insert has been broadcast and is never stuck pending.
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "stale_inserted", ApiKey: "api_key_1", DataBytes: 1})
+	is.NoErr(err)
+
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "stale_broadcast", ApiKey: "api_key_1", DataBytes: 1})
+	is.NoErr(err)
+
+	clock.Advance(50 * time.Minute)
+
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "fresh_pending", ApiKey: "api_key_1", DataBytes: 1})
+	is.NoErr(err)
+	err = repo.UpdateTransactionStatus(ctx, "fresh_pending", server.TransactionStatusPending, clock.Now())
+	is.NoErr(err)
+
+	// Broadcast recently, so not stuck in broadcast yet.
+	err = repo.UpdateTransactionStatus(ctx, "stale_broadcast", server.TransactionStatusBroadcast, clock.Now())
+	is.NoErr(err)
+
+	clock.Advance(20 * time.Minute)
+
+	txs, err := repo.GetStuckTransactions(ctx, server.TransactionStatusPending, time.Hour)
+	is.NoErr(err)
+
+	// The fixture transactions are pending since 2022-05.
+	ids := make([]string, 0)
+	for _, tx := range txs {
+		ids = append(ids, tx.ID)
+	}
+	is.Equal([]string{"2C34AE2C", "BA93B557", "7650035F", "27EC83F0", "2BDCFF23", "6A4410C3", "stale_pending"}, ids)
+
+	// The plain insert is only reported once it waits too long for being confirmed.
+	txs, err = repo.GetStuckTransactions(ctx, server.TransactionStatusBroadcast, time.Hour)
+	is.NoErr(err)
+	is.Equal(1, len(txs))
+	is.Equal("stale_inserted", txs[0].ID)
+
+	txs, err = repo.GetStuckTransactions(ctx, server.TransactionStatusBroadcast, 10*time.Minute)
+	is.NoErr(err)
+	is.Equal(2, len(txs))
+	is.Equal("stale_inserted", txs[0].ID)
+	is.Equal("stale_broadcast", txs[1].ID)
+
+	_, err = repo.GetStuckTransactions(ctx, "unknown", time.Hour)
+	is.True(errors.Is(err, server.ErrInvalidStatus))
+}
+
+func TestGetTransactionInfoAscending(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	to := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, 0, -60)
+
+	descending, err := repo.GetTransactionInfo(ctx, from, to, server.Day)
+	is.NoErr(err)
+
+	ascending, err := repo.GetTransactionInfoWithOptions(ctx, from, to, server.Day, server.TransactionInfoOptions{Ascending: true})
+	is.NoErr(err)
+	is.Equal(len(descending), len(ascending))
+	is.Equal(time.Date(2022, 4, 28, 0, 0, 0, 0, time.UTC), ascending[0].Timestamp)
+
+	for i := range ascending {
+		is.Equal(descending[len(descending)-1-i], ascending[i])
+	}
+}
+
+type fakeBalanceProvider map[string]int64
+
+func (p fakeBalanceProvider) Balance(ctx context.Context, address string) (int64, error) {
+	balance, ok := p[address]
+	if !ok {
+		return 0, errors.Errorf("unknown address %s", address)
+	}
+
+	return balance, nil
+}
+
+func TestReconcileBalances(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	ctx := context.Background()
+
+	// Each key is funded with 1000 satoshis and spends one per byte written.
+	expected := func(key server.KeyUsage) int64 {
+		return 1000 - key.DataBytes
+	}
+
+	repo := repository.NewRepository(db, time.Now, repository.WithExpectedBalance(expected, 10))
+	exact := repository.NewRepository(db, time.Now, repository.WithExpectedBalance(expected, 0))
+
+	provider := fakeBalanceProvider{
+		"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH": 477,  // api_key_1 wrote 523 bytes
+		"1cMh228HTCiwS8ZsaakH8A8wze1JR5ZsP":  695,  // api_key_2 wrote 300 bytes, within the tolerance
+		"5ec39af2":                           1200, // api_key_4 wrote nothing
+	}
+
+	discrepancies, err := repo.ReconcileBalances(ctx, provider)
+	is.NoErr(err)
+	is.Equal([]server.BalanceDiscrepancy{{ApiKey: "api_key_4", Address: "5ec39af2", Expected: 1000, Actual: 1200}}, discrepancies)
+
+	discrepancies, err = exact.ReconcileBalances(ctx, provider)
+	is.NoErr(err)
+	is.Equal(2, len(discrepancies))
+	is.Equal("api_key_2", discrepancies[0].ApiKey)
+
+	delete(provider, "1cMh228HTCiwS8ZsaakH8A8wze1JR5ZsP")
+	_, err = repo.ReconcileBalances(ctx, provider)
+	is.True(err != nil)
+
+	t.Run("no expected balance", func(t *testing.T) {
+		_, err := repository.NewRepository(db, time.Now).ReconcileBalances(ctx, provider)
+		is.True(err != nil)
+	})
+}
+
+func TestTransactionProof(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	proof := []byte{0x00, 0x01, 0xfe, 0xff, 0x00, 0x7f}
+
+	err = repo.SetTransactionProof(ctx, "6A4410C3", proof)
+	is.NoErr(err)
+
+	stored, err := repo.GetTransactionProof(ctx, "6A4410C3")
+	is.NoErr(err)
+	is.Equal(proof, stored)
+
+	replaced := []byte{0xde, 0xad, 0xbe, 0xef}
+
+	err = repo.SetTransactionProof(ctx, "6A4410C3", replaced)
+	is.NoErr(err)
+
+	stored, err = repo.GetTransactionProof(ctx, "6A4410C3")
+	is.NoErr(err)
+	is.Equal(replaced, stored)
+
+	_, err = repo.GetTransactionProof(ctx, "2BDCFF23")
+	is.Equal(sql.ErrNoRows, err)
+}
+
+func TestGetAllKeysUsageSince(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, func() time.Time {
+		return time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	})
+	ctx := context.Background()
+
+	keys, err := repo.GetAllKeysUsageSince(ctx, 10*24*time.Hour)
+	is.NoErr(err)
+	is.Equal(3, len(keys))
+
+	for _, key := range keys {
+		is.True(key.RecentDataBytes <= key.DataBytes)
+	}
+
+	// Only the transactions of 2022-05-23 and 2022-05-25 are recent.
+	is.Equal(int64(523), keys[0].DataBytes)
+	is.Equal(int64(50), keys[0].RecentDataBytes)
+	is.Equal(int64(300), keys[1].DataBytes)
+	is.Equal(int64(100), keys[1].RecentDataBytes)
+	is.Equal(int64(0), keys[2].RecentDataBytes)
+}
+
+func TestGetKeyUsageShares(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	shares, err := repo.GetKeyUsageShares(ctx)
+	is.NoErr(err)
+	is.Equal(2, len(shares))
+	is.Equal("api_key_1", shares[0].ApiKey)
+	is.Equal(int64(523), shares[0].DataBytes)
+	is.True(math.Abs(shares[0].Percent-100*523.0/823.0) < 0.0001)
+
+	var sum float64
+	for _, share := range shares {
+		sum += share.Percent
+	}
+	is.True(math.Abs(sum-100) < 0.0001)
+
+	t.Run("zero total", func(t *testing.T) {
+		_, err := db.ExecContext(ctx, `UPDATE transactions SET data_bytes = 0;`)
+		is.NoErr(err)
+
+		shares, err := repo.GetKeyUsageShares(ctx)
+		is.NoErr(err)
+		is.Equal(2, len(shares))
+
+		for _, share := range shares {
+			is.Equal(0.0, share.Percent)
+		}
+	})
+}
+
+func TestSlowQueryLogRequestID(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	var logs bytes.Buffer
+	var infos []repository.QueryInfo
+	repo := repository.NewRepository(db, time.Now,
+		repository.WithSlowQueryLog(0, log.New(&logs, "", 0)),
+		repository.WithQueryObserver(func(ctx context.Context, info repository.QueryInfo) {
+			infos = append(infos, info)
+		}),
+	)
+
+	ctx := server.WithRequestID(context.Background(), "req-1234")
+
+	_, err = repo.GetKey(ctx, "api_key_1")
+	is.NoErr(err)
+
+	is.True(strings.Contains(logs.String(), "[request_id=req-1234]"))
+	is.True(strings.Contains(logs.String(), "SELECT * FROM keys"))
+	is.Equal(1, len(infos))
+	is.Equal("req-1234", infos[0].RequestID)
+
+	t.Run("without request id", func(t *testing.T) {
+		logs.Reset()
+
+		_, err := repo.GetKey(context.Background(), "api_key_1")
+		is.NoErr(err)
+		is.True(strings.Contains(logs.String(), "[request_id=-]"))
+	})
+
+	t.Run("below threshold", func(t *testing.T) {
+		var logs bytes.Buffer
+		repo := repository.NewRepository(db, time.Now, repository.WithSlowQueryLog(time.Hour, log.New(&logs, "", 0)))
+
+		_, err := repo.GetKey(ctx, "api_key_1")
+		is.NoErr(err)
+		is.Equal("", logs.String())
+	})
+}
+
+func TestGetTransactionInfoShapes(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	to := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, 0, -60)
+
+	slice, err := repo.GetTransactionInfo(ctx, from, to, server.Day)
+	is.NoErr(err)
+	is.Equal(5, len(slice))
+
+	t.Run("map", func(t *testing.T) {
+		buckets, err := repo.GetTransactionInfoMap(ctx, from, to, server.Day)
+		is.NoErr(err)
+		is.Equal(len(slice), len(buckets))
+
+		for _, txInfo := range slice {
+			is.Equal(txInfo, buckets[txInfo.Timestamp.Format("2006-01-02")])
+		}
+
+		is.Equal(2, buckets["2022-05-12"].Count)
+		is.Equal(int64(533), buckets["2022-05-12"].DataBytes)
+	})
+
+	t.Run("columns", func(t *testing.T) {
+		columns, err := repo.GetTransactionInfoColumns(ctx, from, to, server.Day)
+		is.NoErr(err)
+		is.Equal(len(slice), len(columns.Timestamps))
+		is.Equal(len(slice), len(columns.Counts))
+		is.Equal(len(slice), len(columns.DataBytes))
+		is.Equal(len(slice), len(columns.ActiveKeys))
+
+		for i, txInfo := range slice {
+			j := len(slice) - 1 - i
+			is.Equal(txInfo.Timestamp, columns.Timestamps[j])
+			is.Equal(txInfo.Count, columns.Counts[j])
+			is.Equal(txInfo.DataBytes, columns.DataBytes[j])
+			is.Equal(txInfo.ActiveKeys, columns.ActiveKeys[j])
+		}
+	})
+}
+
+func TestExportTransactionsAnonymized(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now, repository.WithAnonymizationSalt([]byte("test salt")))
+	ctx := context.Background()
+
+	from := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	err = repo.ExportTransactionsAnonymized(ctx, &buf, from, to)
+	is.NoErr(err)
+
+	output := buf.String()
+	for _, raw := range []string{"api_key_1", "api_key_2", "somepicture", "textfile", "1234", "6A4410C3"} {
+		is.True(!strings.Contains(output, raw))
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	is.Equal(5, len(lines))
+
+	hashes := make(map[string]int)
+	for _, line := range lines {
+		var exported map[string]interface{}
+		is.NoErr(json.Unmarshal([]byte(line), &exported))
+
+		_, hasFilename := exported["filename"]
+		is.True(!hasFilename)
+
+		hash, ok := exported["api_key_hash"].(string)
+		is.True(ok)
+		is.Equal(64, len(hash))
+		hashes[hash]++
+	}
+	is.Equal(2, len(hashes))
+
+	t.Run("stable across exports", func(t *testing.T) {
+		var again bytes.Buffer
+		err := repo.ExportTransactionsAnonymized(ctx, &again, from, to)
+		is.NoErr(err)
+		is.Equal(output, again.String())
+
+		var salted bytes.Buffer
+		other := repository.NewRepository(db, time.Now, repository.WithAnonymizationSalt([]byte("other salt")))
+		err = other.ExportTransactionsAnonymized(ctx, &salted, from, to)
+		is.NoErr(err)
+		is.True(output != salted.String())
+	})
+
+	t.Run("without salt", func(t *testing.T) {
+		err := repository.NewRepository(db, time.Now).ExportTransactionsAnonymized(ctx, &bytes.Buffer{}, from, to)
+		is.True(err != nil)
+	})
+}
+
+func TestChainRepository(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	ctx := context.Background()
+
+	secondaryDB, err := sqlx.Open("sqlite3", filepath.Join(t.TempDir(), "secondary.db"))
+	is.NoErr(err)
+	defer secondaryDB.Close()
+
+	err = database.RunMigrationsSQLite(secondaryDB)
+	is.NoErr(err)
+
+	primary := repository.NewRepository(db, time.Now)
+	secondary := repository.NewRepository(secondaryDB, time.Now)
+
+	err = secondary.InsertKey(ctx, server.Key{ApiKey: "secondary_only", PublicKey: "pub", PrivateKey: "priv", Address: "secondary_address"})
+	is.NoErr(err)
+
+	err = secondary.InsertKey(ctx, server.Key{ApiKey: "api_key_1", PublicKey: "pub", PrivateKey: "priv", Address: "stale_address"})
+	is.NoErr(err)
+
+	err = secondary.InsertTransaction(ctx, server.Transaction{ID: "secondary_tx", ApiKey: "secondary_only", DataBytes: 1})
+	is.NoErr(err)
+
+	chain := repository.NewChainRepository(primary, secondary)
+
+	t.Run("key only in secondary", func(t *testing.T) {
+		key, err := chain.GetKey(ctx, "secondary_only")
+		is.NoErr(err)
+		is.Equal("secondary_address", key.Address)
+
+		tx, err := chain.GetTransaction(ctx, "secondary_tx")
+		is.NoErr(err)
+		is.Equal("secondary_only", tx.ApiKey)
+	})
+
+	t.Run("key in both", func(t *testing.T) {
+		key, err := chain.GetKey(ctx, "api_key_1")
+		is.NoErr(err)
+		is.Equal("1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", key.Address)
+	})
+
+	t.Run("key in neither", func(t *testing.T) {
+		_, err := chain.GetKey(ctx, "unknown_key")
+		is.Equal(sql.ErrNoRows, err)
+	})
+
+	t.Run("lists do not fall back", func(t *testing.T) {
+		primaryKeys, err := primary.GetAllKeys(ctx, true, false)
+		is.NoErr(err)
+
+		keys, err := chain.GetAllKeys(ctx, true, false)
+		is.NoErr(err)
+		is.Equal(primaryKeys, keys)
+
+		usages, err := chain.GetAllKeysUsage(ctx)
+		is.NoErr(err)
+		for _, usage := range usages {
+			is.True(usage.ApiKey != "secondary_only")
+		}
+
+		txs, err := chain.GetAllTransactions(ctx, true, 0)
+		is.NoErr(err)
+		for _, tx := range txs {
+			is.True(tx.ID != "secondary_tx")
+		}
+
+		var exported bytes.Buffer
+		err = chain.ExportTransactionsJSONL(ctx, &exported, time.Time{}, time.Now())
+		is.NoErr(err)
+		is.True(!strings.Contains(exported.String(), "secondary_tx"))
+	})
+
+	t.Run("writes go to the primary", func(t *testing.T) {
+		err := chain.InsertKey(ctx, server.Key{ApiKey: "chain_key", PublicKey: "pub", PrivateKey: "priv", Address: "chain_address"})
+		is.NoErr(err)
+
+		_, err = primary.GetKey(ctx, "chain_key")
+		is.NoErr(err)
+
+		_, err = secondary.GetKey(ctx, "chain_key")
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestGetThroughput(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	// Written at 10:00, 10:05, 10:10 and 10:15, so the window from 10:05:01 holds the last two.
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "throughput_old", ApiKey: "api_key_1", DataBytes: 1000})
+	is.NoErr(err)
+
+	for i := 0; i < 3; i++ {
+		clock.Advance(5 * time.Minute)
+		err = repo.InsertTransaction(ctx, server.Transaction{ID: fmt.Sprintf("throughput_%d", i), ApiKey: "api_key_1", DataBytes: 200})
+		is.NoErr(err)
+	}
+	clock.Advance(time.Second)
+
+	bytesPerSec, txPerSec, err := repo.GetThroughput(ctx, 10*time.Minute)
+	is.NoErr(err)
+	is.Equal(400.0/600.0, bytesPerSec)
+	is.Equal(2.0/600.0, txPerSec)
+
+	_, _, err = repo.GetThroughput(ctx, 0)
+	is.True(errors.Is(err, server.ErrInvalidRange))
+}
+
+func TestGetTransactionEnriched(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	tx, err := repo.GetTransactionEnriched(ctx, "2BDCFF23")
+	is.NoErr(err)
+	is.Equal("2BDCFF23", tx.ID)
+	is.Equal("api_key_1", tx.ApiKey)
+	is.Equal(int64(50), tx.DataBytes)
+	is.Equal("2022-05-23 15:10:58.022Z", tx.CreatedAt)
+	is.Equal("1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", tx.Address)
+	is.Equal("", tx.Secret)
+
+	key, err := repo.GetKey(ctx, "api_key_1")
+	is.NoErr(err)
+	is.Equal(key.PublicKey, tx.PublicKey)
+
+	t.Run("missing key", func(t *testing.T) {
+		err := repo.InsertTransaction(ctx, server.Transaction{ID: "keyless_tx", ApiKey: "deleted_key", DataBytes: 1})
+		is.NoErr(err)
+
+		tx, err := repo.GetTransactionEnriched(ctx, "keyless_tx")
+		is.NoErr(err)
+		is.Equal("deleted_key", tx.ApiKey)
+		is.Equal("", tx.Address)
+		is.Equal("", tx.PublicKey)
+	})
+
+	t.Run("missing transaction", func(t *testing.T) {
+		_, err := repo.GetTransactionEnriched(ctx, "unknown")
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestStatementTimeout(t *testing.T) {
+	if db.DriverName() != "postgres" {
+		t.Skip("statement_timeout is only supported on postgres")
+	}
+
+	is := is.New(t)
+	ctx := context.Background()
+
+	repo := repository.NewRepository(db, time.Now, repository.WithStatementTimeout(100*time.Millisecond))
+
+	start := time.Now()
+	err := repo.WithTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, `SELECT pg_sleep(5);`)
+		return err
+	})
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "statement timeout"))
+	is.True(time.Since(start) < 2*time.Second)
+
+	err = repo.WithTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, `SELECT pg_sleep(0.01);`)
+		return err
+	})
+	is.NoErr(err)
+}
+
+func TestGetTransactionsWithoutSecret(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	// 2BDCFF23 is the only transaction of api_key_1 with a secret.
+	txs, err := repo.GetTransactionsWithoutSecret(ctx, "api_key_1")
+	is.NoErr(err)
+
+	ids := make([]string, 0)
+	for _, tx := range txs {
+		is.Equal("", tx.Secret)
+		ids = append(ids, tx.ID)
+	}
+	is.Equal([]string{"27EC83F0", "BA93B557", "2C34AE2C"}, ids)
+
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "with_secret", ApiKey: "api_key_4", DataBytes: 1, Secret: "s3cret"})
+	is.NoErr(err)
+
+	txs, err = repo.GetTransactionsWithoutSecret(ctx, "api_key_4")
+	is.NoErr(err)
+	is.Equal(0, len(txs))
+}
+
+// flakyDriver wraps the SQLite driver with connections which fail with driver.ErrBadConn while
+// the driver is down, like connections to a database which failed over.
+type flakyDriver struct {
+	down   int32
+	closed int32
+}
+
+type flakyConn struct {
+	driver.Conn
+	driver *flakyDriver
+}
+
+func (d *flakyDriver) Open(name string) (driver.Conn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &flakyConn{Conn: conn, driver: d}, nil
+}
+
+func (c *flakyConn) Prepare(query string) (driver.Stmt, error) {
+	if atomic.LoadInt32(&c.driver.down) == 1 {
+		return nil, driver.ErrBadConn
+	}
+
+	return c.Conn.Prepare(query)
+}
+
+func (c *flakyConn) Close() error {
+	atomic.AddInt32(&c.driver.closed, 1)
+	return c.Conn.Close()
+}
+
+var (
+	flaky               = &flakyDriver{}
+	registerFlakyDriver sync.Once
+)
+
+func TestSetTransactionSecretHashed(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	// The fixture transaction has the encryption key 1234
+	err = repo.SetTransactionSecretHashed(ctx, "2BDCFF23", "my-recovery-secret")
+	is.NoErr(err)
+
+	t.Run("plaintext is not stored", func(t *testing.T) {
+		var secret, secretHash string
+		err := db.QueryRowContext(ctx, `SELECT secret, secret_hash FROM transactions WHERE id = $1;`, "2BDCFF23").Scan(&secret, &secretHash)
+		is.NoErr(err)
+
+		// The encryption key is kept apart from the recovery secret
+		is.Equal("1234", secret)
+		is.True(secretHash != "")
+		is.True(!strings.Contains(secretHash, "my-recovery-secret"))
+	})
+
+	t.Run("verify correct secret", func(t *testing.T) {
+		ok, err := repo.VerifyTransactionSecret(ctx, "2BDCFF23", "my-recovery-secret")
+		is.NoErr(err)
+		is.True(ok)
+	})
+
+	t.Run("verify wrong secret", func(t *testing.T) {
+		ok, err := repo.VerifyTransactionSecret(ctx, "2BDCFF23", "wrong-secret")
+		is.NoErr(err)
+		is.True(!ok)
+
+		ok, err = repo.VerifyTransactionSecret(ctx, "2BDCFF23", "1234")
+		is.NoErr(err)
+		is.True(!ok)
+	})
+
+	t.Run("unknown transaction", func(t *testing.T) {
+		err := repo.SetTransactionSecretHashed(ctx, "unknown", "my-recovery-secret")
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+// TestHashedSecretEncryptedRead stores an encrypted transaction, hashes its recovery secret and
+// then decrypts the data with the stored transaction as the read handler does.
+func TestHashedSecretEncryptedRead(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	data := []byte("encrypted payload")
+
+	encrypted, err := encryption.Encrypt(data, []byte("encryption-key"))
+	is.NoErr(err)
+
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "encrypted_tx", ApiKey: "api_key_1", DataBytes: int64(len(encrypted)), Secret: "encryption-key"})
+	is.NoErr(err)
+
+	err = repo.SetTransactionSecretHashed(ctx, "encrypted_tx", "my-recovery-secret")
+	is.NoErr(err)
+
+	_, err = repo.HashPlaintextSecrets(ctx)
+	is.NoErr(err)
+
+	tx, err := repo.GetTransaction(ctx, "encrypted_tx")
+	is.NoErr(err)
+
+	decrypted, err := encryption.Decrypt(encrypted, []byte(tx.Secret))
+	is.NoErr(err)
+	is.Equal(data, decrypted)
+
+	ok, err := repo.VerifyTransactionSecret(ctx, "encrypted_tx", "my-recovery-secret")
+	is.NoErr(err)
+	is.True(ok)
+}
+
+func TestHashPlaintextSecrets(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	ok, err := repo.VerifyTransactionSecret(ctx, "2BDCFF23", "1234")
+	is.NoErr(err)
+	is.True(ok)
+
+	updated, err := repo.HashPlaintextSecrets(ctx)
+	is.NoErr(err)
+	is.Equal(int64(1), updated)
+
+	var secretHash string
+	err = db.QueryRowContext(ctx, `SELECT secret_hash FROM transactions WHERE id = $1;`, "2BDCFF23").Scan(&secretHash)
+	is.NoErr(err)
+	is.True(secretHash != "")
+
+	ok, err = repo.VerifyTransactionSecret(ctx, "2BDCFF23", "1234")
+	is.NoErr(err)
+	is.True(ok)
+
+	ok, err = repo.VerifyTransactionSecret(ctx, "2BDCFF23", "4321")
+	is.NoErr(err)
+	is.True(!ok)
+
+	updated, err = repo.HashPlaintextSecrets(ctx)
+	is.NoErr(err)
+	is.Equal(int64(0), updated)
+}
+
+func TestReconnectOnError(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	registerFlakyDriver.Do(func() {
+		sql.Register("flaky_sqlite3", flaky)
+	})
+	atomic.StoreInt32(&flaky.closed, 0)
+
+	path := filepath.Join(t.TempDir(), "flaky.db")
+
+	// The migrations run on a plain connection, as flakyConn only prepares the first statement of
+	// a migration with several statements.
+	migrationDB, err := sqlx.Open("sqlite3", path)
+	is.NoErr(err)
+
+	err = database.RunMigrationsSQLite(migrationDB)
+	is.NoErr(err)
+	is.NoErr(migrationDB.Close())
+
+	flakyDB, err := sqlx.Open("flaky_sqlite3", path)
+	is.NoErr(err)
+	defer flakyDB.Close()
+
+	repo := repository.NewRepository(sqlx.NewDb(flakyDB.DB, "sqlite3"), time.Now, repository.WithReconnectOnError())
+
+	err = repo.InsertKey(ctx, server.Key{ApiKey: "flaky_key", PublicKey: "pub", PrivateKey: "priv", Address: "flaky_address"})
+	is.NoErr(err)
+
+	atomic.StoreInt32(&flaky.down, 1)
+
+	_, err = repo.GetKey(ctx, "flaky_key")
+	is.True(errors.Is(err, server.ErrConnectionReset))
+	is.True(errors.Is(err, driver.ErrBadConn))
+	is.True(atomic.LoadInt32(&flaky.closed) > 0)
+
+	atomic.StoreInt32(&flaky.down, 0)
+
+	key, err := repo.GetKey(ctx, "flaky_key")
+	is.NoErr(err)
+	is.Equal("flaky_address", key.Address)
+
+	t.Run("without reconnect", func(t *testing.T) {
+		repo := repository.NewRepository(sqlx.NewDb(flakyDB.DB, "sqlite3"), time.Now)
+
+		atomic.StoreInt32(&flaky.down, 1)
+		defer atomic.StoreInt32(&flaky.down, 0)
+
+		_, err := repo.GetKey(ctx, "flaky_key")
+		is.True(errors.Is(err, driver.ErrBadConn))
+		is.True(!errors.Is(err, server.ErrConnectionReset))
+	})
+}
+
+func TestGetPeakBucket(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	to := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, 0, -60)
+
+	peak, err := repo.GetPeakBucket(ctx, from, to, server.Day)
+	is.NoErr(err)
+	is.Equal(time.Date(2022, 5, 12, 0, 0, 0, 0, time.UTC), peak.Timestamp)
+	is.Equal(2, peak.Count)
+	is.Equal(int64(533), peak.DataBytes)
+
+	// The peak bucket is the same as in the full series, including its percentiles
+	txInfos, err := repo.GetTransactionInfoMap(ctx, from, to, server.Day)
+	is.NoErr(err)
+	is.Equal(txInfos["2022-05-12"], peak)
+
+	t.Run("tie", func(t *testing.T) {
+		// Every hour has one transaction, the one with 333 bytes wins.
+		peak, err := repo.GetPeakBucket(ctx, from, to, server.Hour)
+		is.NoErr(err)
+		is.Equal(time.Date(2022, 5, 12, 22, 0, 0, 0, time.UTC), peak.Timestamp)
+		is.Equal(1, peak.Count)
+		is.Equal(int64(333), peak.DataBytes)
+	})
+
+	t.Run("empty range", func(t *testing.T) {
+		_, err := repo.GetPeakBucket(ctx, to, to.AddDate(0, 0, 1), server.Hour)
+		is.True(errors.Is(err, server.ErrNoTransactions))
+	})
+}
+
+func TestTransactionInfoNonUTCRange(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, nil)
+	ctx := context.Background()
+
+	// 2022-05-11 22:00 to 2022-05-13 23:00 UTC contains only 7650035F and 27EC83F0
+	zone := time.FixedZone("UTC+5", 5*60*60)
+	from := time.Date(2022, 5, 12, 3, 0, 0, 0, zone)
+	to := time.Date(2022, 5, 14, 4, 0, 0, 0, zone)
+
+	txInfos, summary, err := repo.GetTransactionInfoWithSummary(ctx, from, to, server.Day)
+	is.NoErr(err)
+	is.Equal(server.TransactionInfoSummary{TotalCount: 2, TotalDataBytes: 533}, summary)
+	is.Equal(1, len(txInfos))
+	is.Equal(2, txInfos[0].Count)
+
+	peak, err := repo.GetPeakBucket(ctx, from, to, server.Day)
+	is.NoErr(err)
+	is.Equal(time.Date(2022, 5, 12, 0, 0, 0, 0, time.UTC), peak.Timestamp)
+	is.Equal(2, peak.Count)
+	is.Equal(int64(533), peak.DataBytes)
+}
+
+func TestPreviewDestructiveMethods(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	t.Run("delete transactions", func(t *testing.T) {
+		before := time.Date(2022, 5, 20, 0, 0, 0, 0, time.UTC)
+
+		preview, err := repo.PreviewDeleteTransactionsBefore(ctx, before)
+		is.NoErr(err)
+		is.Equal(int64(4), preview)
+
+		txs, err := repo.GetAllTransactions(ctx, true, 0)
+		is.NoErr(err)
+		is.Equal(6, len(txs))
+
+		deleted, err := repo.DeleteTransactionsBefore(ctx, before)
+		is.NoErr(err)
+		is.Equal(preview, deleted)
+	})
+
+	t.Run("deactivate keys", func(t *testing.T) {
+		apiKeys := []string{"api_key_1", "api_key_3", "unknown_key"}
+
+		preview, err := repo.PreviewDeactivateKeys(ctx, apiKeys)
+		is.NoErr(err)
+		is.Equal(int64(1), preview)
+
+		key, err := repo.GetKey(ctx, "api_key_1")
+		is.NoErr(err)
+		is.Equal(nil, key.RevokedAt)
+
+		revoked, err := repo.DeactivateKeys(ctx, apiKeys, "preview test")
+		is.NoErr(err)
+		is.Equal(preview, revoked)
+	})
+}
+
+func TestSearchKeysByAddressPrefix(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	keys, err := repo.SearchKeysByAddressPrefix(ctx, "1BgG", 10)
+	is.NoErr(err)
+	is.Equal(1, len(keys))
+	is.Equal("api_key_1", keys[0].ApiKey)
+
+	keys, err = repo.SearchKeysByAddressPrefix(ctx, "unknown", 10)
+	is.NoErr(err)
+	is.True(keys != nil)
+	is.Equal(0, len(keys))
+
+	t.Run("wildcards", func(t *testing.T) {
+		keys, err := repo.SearchKeysByAddressPrefix(ctx, "_e99", 10)
+		is.NoErr(err)
+		is.Equal(0, len(keys))
+
+		keys, err = repo.SearchKeysByAddressPrefix(ctx, "%", 10)
+		is.NoErr(err)
+		is.Equal(0, len(keys))
+
+		err = repo.InsertKey(ctx, server.Key{ApiKey: "wildcard_key", PublicKey: "pub", PrivateKey: "priv", Address: "1_%wild"})
+		is.NoErr(err)
+
+		keys, err = repo.SearchKeysByAddressPrefix(ctx, "1_%", 10)
+		is.NoErr(err)
+		is.Equal(1, len(keys))
+		is.Equal("wildcard_key", keys[0].ApiKey)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		keys, err := repo.SearchKeysByAddressPrefix(ctx, "", 2)
+		is.NoErr(err)
+		is.Equal(2, len(keys))
+	})
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	ctx := context.Background()
+	repo := repository.NewRepository(db, time.Now)
+
+	err = repo.SetTransactionMetadata(ctx, "6A4410C3", map[string]interface{}{"tag": "snapshot"})
+	is.NoErr(err)
+
+	var snapshot bytes.Buffer
+	err = repo.Snapshot(ctx, &snapshot)
+	is.NoErr(err)
+
+	emptyDB, err := sqlx.Open("sqlite3", filepath.Join(t.TempDir(), "restored.db"))
+	is.NoErr(err)
+	defer emptyDB.Close()
+
+	err = database.RunMigrationsSQLite(emptyDB)
+	is.NoErr(err)
+
+	restored := repository.NewRepository(emptyDB, time.Now)
+
+	err = restored.Restore(ctx, bytes.NewReader(snapshot.Bytes()))
+	is.NoErr(err)
+
+	var again bytes.Buffer
+	err = restored.Snapshot(ctx, &again)
+	is.NoErr(err)
+	is.Equal(gunzip(t, snapshot.Bytes()), gunzip(t, again.Bytes()))
+
+	key, err := restored.GetKey(ctx, "api_key_1")
+	is.NoErr(err)
+	is.Equal("2099n2dskd", key.PrivateKey)
+
+	metadata, err := restored.GetTransactionMetadata(ctx, "6A4410C3")
+	is.NoErr(err)
+	is.Equal("snapshot", metadata["tag"])
+
+	t.Run("restore is transactional", func(t *testing.T) {
+		// All rows exist already, so the first insert fails and nothing is written.
+		err := restored.Restore(ctx, bytes.NewReader(snapshot.Bytes()))
+		is.True(err != nil)
+
+		var after bytes.Buffer
+		err = restored.Snapshot(ctx, &after)
+		is.NoErr(err)
+		is.Equal(gunzip(t, snapshot.Bytes()), gunzip(t, after.Bytes()))
+	})
+
+	t.Run("schema mismatch", func(t *testing.T) {
+		var old bytes.Buffer
+		gz := gzip.NewWriter(&old)
+		_, err := gz.Write([]byte(`{"format":"taal-client-snapshot","version":1,"schema_version":1}` + "\n"))
+		is.NoErr(err)
+		is.NoErr(gz.Close())
+
+		err = restored.Restore(ctx, &old)
+		is.True(errors.Is(err, server.ErrSchemaMismatch))
+	})
+}
+
+func gunzip(t *testing.T, b []byte) string {
+	t.Helper()
+
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+func TestGetTransactionInfoMinDataBytes(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	to := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, 0, -60)
+
+	all, err := repo.GetTransactionInfo(ctx, from, to, server.Day)
+	is.NoErr(err)
+	is.Equal(5, len(all))
+
+	unfiltered, err := repo.GetTransactionInfoWithOptions(ctx, from, to, server.Day, server.TransactionInfoOptions{MinDataBytes: 0})
+	is.NoErr(err)
+	is.Equal(all, unfiltered)
+
+	// The transactions of 50 and 40 bytes are left out, which empties their buckets.
+	large, err := repo.GetTransactionInfoWithOptions(ctx, from, to, server.Day, server.TransactionInfoOptions{MinDataBytes: 100})
+	is.NoErr(err)
+	is.Equal(3, len(large))
+
+	for _, bucket := range large {
+		is.True(bucket.DataBytes >= 100*int64(bucket.Count))
+	}
+
+	is.Equal(all[0], large[0])
+	is.Equal(all[1].Timestamp, time.Date(2022, 5, 23, 0, 0, 0, 0, time.UTC))
+	is.Equal(all[2], large[1])
+	is.Equal(all[3], large[2])
+
+	t.Run("with location", func(t *testing.T) {
+		location, err := time.LoadLocation("Asia/Tokyo")
+		is.NoErr(err)
+
+		large, err := repo.GetTransactionInfoWithOptions(ctx, from, to, server.Day, server.TransactionInfoOptions{MinDataBytes: 300, BucketLocation: location})
+		is.NoErr(err)
+		is.Equal(1, len(large))
+		is.Equal(int64(333), large[0].DataBytes)
+		is.Equal(333.0, large[0].DataBytesP50)
+	})
+}
+
+func TestVerifyKeyIntegrity(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now, repository.WithKeyDeriver(server.BSVKeyDeriver{}))
+	ctx := context.Background()
+
+	privateKey, err := bsvec.NewPrivateKey(bsvec.S256())
+	is.NoErr(err)
+
+	key, err := server.GetKeyFromPrivateKey("consistent_key", privateKey)
+	is.NoErr(err)
+
+	err = repo.InsertKey(ctx, key)
+	is.NoErr(err)
+
+	err = repo.VerifyKeyIntegrity(ctx, "consistent_key")
+	is.NoErr(err)
+
+	t.Run("wrong address", func(t *testing.T) {
+		inconsistent := key
+		inconsistent.ApiKey = "inconsistent_key"
+		inconsistent.Address = "1BoatSLRHtKNngkdXEeobR76b53LETtpyT"
+
+		err := repo.InsertKey(ctx, inconsistent)
+		is.NoErr(err)
+
+		err = repo.VerifyKeyIntegrity(ctx, "inconsistent_key")
+		is.True(errors.Is(err, server.ErrKeyCorrupt))
+	})
+
+	t.Run("undecodable private key", func(t *testing.T) {
+		err := repo.VerifyKeyIntegrity(ctx, "api_key_1")
+		is.True(errors.Is(err, server.ErrKeyCorrupt))
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		err := repo.VerifyKeyIntegrity(ctx, "unknown_key")
+		is.Equal(sql.ErrNoRows, err)
+	})
+}
+
+func TestInsertKeys(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	t.Run("clean batch", func(t *testing.T) {
+		keys := make([]server.Key, 0)
+		for i := 0; i < 250; i++ {
+			keys = append(keys, server.Key{ApiKey: fmt.Sprintf("bulk_key_%d", i), PublicKey: "pub", PrivateKey: "priv", Address: fmt.Sprintf("bulk_address_%d", i)})
+		}
+
+		err := repo.InsertKeys(ctx, keys)
+		is.NoErr(err)
+
+		key, err := repo.GetKey(ctx, "bulk_key_249")
+		is.NoErr(err)
+		is.Equal("bulk_address_249", key.Address)
+		is.Equal("priv", key.PrivateKey)
+
+		all, err := repo.GetAllKeys(ctx, true, false)
+		is.NoErr(err)
+		is.Equal(254, len(all))
+	})
+
+	t.Run("batch with duplicate", func(t *testing.T) {
+		keys := []server.Key{
+			{ApiKey: "new_key_1", PublicKey: "pub", PrivateKey: "priv", Address: "new_address_1"},
+			{ApiKey: "api_key_1", PublicKey: "pub", PrivateKey: "priv", Address: "new_address_2"},
+			{ApiKey: "new_key_3", PublicKey: "pub", PrivateKey: "priv", Address: "new_address_3"},
+		}
+
+		err := repo.InsertKeys(ctx, keys)
+		is.True(err != nil)
+
+		_, err = repo.GetKey(ctx, "new_key_1")
+		is.Equal(sql.ErrNoRows, err)
+
+		key, err := repo.GetKey(ctx, "api_key_1")
+		is.NoErr(err)
+		is.Equal("1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", key.Address)
+	})
+}
+
+func TestGetTransactionInfoHashCount(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	for i, isHash := range []bool{false, true, true, false, true} {
+		clock.Advance(time.Minute)
+		err = repo.InsertTransaction(ctx, server.Transaction{ID: fmt.Sprintf("hash_count_tx_%d", i), ApiKey: "api_key_1", DataBytes: 10, IsHash: isHash})
+		is.NoErr(err)
+	}
+
+	txInfos, err := repo.GetTransactionInfo(ctx, time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, 7, 2, 0, 0, 0, 0, time.UTC), server.Hour)
+	is.NoErr(err)
+	is.Equal(1, len(txInfos))
+	is.Equal(5, txInfos[0].Count)
+	is.Equal(2, txInfos[0].FullCount)
+	is.Equal(3, txInfos[0].HashCount)
+}
+
+func TestFindDuplicateAddresses(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	duplicates, err := repo.FindDuplicateAddresses(ctx)
+	is.NoErr(err)
+	is.Equal(0, len(duplicates))
+
+	err = repo.InsertKey(ctx, server.Key{ApiKey: "shared_key", PublicKey: "pub", PrivateKey: "priv", Address: "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"})
+	is.NoErr(err)
+
+	// Shares the address with the revoked api_key_3 only.
+	err = repo.InsertKey(ctx, server.Key{ApiKey: "revoked_shared_key", PublicKey: "pub", PrivateKey: "priv", Address: "1CUNEBjYrCn2y1SdiUMohaKUi4wpP326Lb"})
+	is.NoErr(err)
+
+	duplicates, err = repo.FindDuplicateAddresses(ctx)
+	is.NoErr(err)
+	is.Equal(map[string][]string{"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH": {"api_key_1", "shared_key"}}, duplicates)
+}
+
+func TestGetTransactionInfoByISOWeek(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	days := []time.Time{
+		time.Date(2019, 12, 29, 12, 0, 0, 0, time.UTC), // Sunday of 2019-W52
+		time.Date(2019, 12, 30, 12, 0, 0, 0, time.UTC), // Monday of 2020-W01
+		time.Date(2020, 12, 31, 12, 0, 0, 0, time.UTC), // Thursday of 2020-W53
+		time.Date(2021, 1, 3, 23, 0, 0, 0, time.UTC),   // Sunday of 2020-W53
+		time.Date(2021, 1, 4, 0, 30, 0, 0, time.UTC),   // Monday of 2021-W01
+	}
+
+	clock := server.NewManualClock(days[0])
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	for i, day := range days {
+		clock.Advance(day.Sub(clock.Now()))
+
+		err := repo.InsertTransaction(ctx, server.Transaction{ID: fmt.Sprintf("week%d", i), ApiKey: "api_key_1", DataBytes: int64(10 * (i + 1))})
+		is.NoErr(err)
+	}
+
+	weeks, err := repo.GetTransactionInfoByISOWeek(ctx, time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC))
+	is.NoErr(err)
+
+	is.Equal([]server.TransactionWeekInfo{
+		{Week: "2019-W52", WeekStart: time.Date(2019, 12, 23, 0, 0, 0, 0, time.UTC), Count: 1, DataBytes: 10, ActiveKeys: 1},
+		{Week: "2020-W01", WeekStart: time.Date(2019, 12, 30, 0, 0, 0, 0, time.UTC), Count: 1, DataBytes: 20, ActiveKeys: 1},
+		{Week: "2020-W53", WeekStart: time.Date(2020, 12, 28, 0, 0, 0, 0, time.UTC), Count: 2, DataBytes: 70, ActiveKeys: 1},
+		{Week: "2021-W01", WeekStart: time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC), Count: 1, DataBytes: 50, ActiveKeys: 1},
+	}, weeks)
+}
+
+func TestGetRevokedKeys(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	for _, apiKey := range []string{"api_key_1", "api_key_4", "api_key_2"} {
+		err := repo.DeactivateKey(ctx, apiKey, "retired "+apiKey)
+		is.NoErr(err)
+
+		clock.Advance(24 * time.Hour)
+	}
+
+	page, total, err := repo.GetRevokedKeys(ctx, 3, 0)
+	is.NoErr(err)
+	is.Equal(4, total)
+	is.Equal(3, len(page))
+	is.Equal("api_key_2", page[0].ApiKey)
+	is.Equal("2022-07-03T10:00:00.000Z", *page[0].RevokedAt)
+	is.Equal("retired api_key_2", *page[0].RevokedReason)
+	is.Equal("api_key_4", page[1].ApiKey)
+	is.Equal("api_key_1", page[2].ApiKey)
+
+	page, total, err = repo.GetRevokedKeys(ctx, 3, 3)
+	is.NoErr(err)
+	is.Equal(4, total)
+	is.Equal(1, len(page))
+	is.Equal("api_key_3", page[0].ApiKey)
+	is.Equal("2022-06-24 15:10:58.022Z", *page[0].RevokedAt)
+	is.Equal(nil, page[0].RevokedReason)
+
+	page, total, err = repo.GetRevokedKeys(ctx, 3, 6)
+	is.NoErr(err)
+	is.Equal(4, total)
+	is.Equal(0, len(page))
+}
+
+func TestPurgeRevokedKey(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	t.Run("active key", func(t *testing.T) {
+		keysDeleted, txDeleted, err := repo.PurgeRevokedKey(ctx, "api_key_1")
+		is.True(errors.Is(err, server.ErrKeyActive))
+		is.Equal(int64(0), keysDeleted)
+		is.Equal(int64(0), txDeleted)
+
+		var keyErr server.KeyActiveError
+		is.True(errors.As(err, &keyErr))
+		is.Equal("api_key_1", keyErr.ApiKey)
+
+		_, err = repo.GetKey(ctx, "api_key_1")
+		is.NoErr(err)
+
+		_, err = repo.GetTransaction(ctx, "BA93B557")
+		is.NoErr(err)
+	})
+
+	t.Run("revoked key", func(t *testing.T) {
+		err := repo.DeactivateKey(ctx, "api_key_2", "retention")
+		is.NoErr(err)
+
+		err = repo.SetTransactionProof(ctx, "6A4410C3", []byte{0x01, 0x02})
+		is.NoErr(err)
+
+		keysDeleted, txDeleted, err := repo.PurgeRevokedKey(ctx, "api_key_2")
+		is.NoErr(err)
+		is.Equal(int64(1), keysDeleted)
+		is.Equal(int64(2), txDeleted)
+
+		_, err = repo.GetKey(ctx, "api_key_2")
+		is.True(errors.Is(err, sql.ErrNoRows))
+
+		for _, txid := range []string{"6A4410C3", "7650035F"} {
+			_, err = repo.GetTransaction(ctx, txid)
+			is.True(errors.Is(err, sql.ErrNoRows))
+		}
+
+		_, err = repo.GetTransactionProof(ctx, "6A4410C3")
+		is.True(errors.Is(err, sql.ErrNoRows))
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, _, err := repo.PurgeRevokedKey(ctx, "unknown_api_key")
+		is.True(errors.Is(err, sql.ErrNoRows))
+	})
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(gz)
+}
+
+func TestTransactionPayloadCodec(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	ctx := context.Background()
+	payload := []byte(strings.Repeat(`{"name":"somepicture1.png","owner":"api_key_2"}`, 100))
+
+	t.Run("gzip", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now, repository.WithCodec(gzipCodec{}))
+
+		err := repo.SetTransactionPayload(ctx, "7650035F", payload)
+		is.NoErr(err)
+
+		var stored []byte
+		err = db.GetContext(ctx, &stored, db.Rebind(`SELECT payload FROM payloads WHERE txid = ?;`), "7650035F")
+		is.NoErr(err)
+		is.True(len(stored) < len(payload))
+
+		read, err := repo.GetTransactionPayload(ctx, "7650035F")
+		is.NoErr(err)
+		is.Equal(payload, read)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now)
+
+		err := repo.SetTransactionPayload(ctx, "6A4410C3", payload)
+		is.NoErr(err)
+
+		var stored []byte
+		err = db.GetContext(ctx, &stored, db.Rebind(`SELECT payload FROM payloads WHERE txid = ?;`), "6A4410C3")
+		is.NoErr(err)
+		is.Equal(payload, stored)
+
+		read, err := repo.GetTransactionPayload(ctx, "6A4410C3")
+		is.NoErr(err)
+		is.Equal(payload, read)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		repo := repository.NewRepository(db, time.Now)
+
+		_, err := repo.GetTransactionPayload(ctx, "2C34AE2C")
+		is.True(errors.Is(err, sql.ErrNoRows))
+	})
+}
+
+func TestReconcileWithUpstream(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	upstream := map[string]int64{"api_key_1": 4, "api_key_2": 3, "api_key_4": 0}
+	var asked []string
+
+	counter := func(ctx context.Context, apiKey string) (int64, error) {
+		asked = append(asked, apiKey)
+		return upstream[apiKey], nil
+	}
+
+	discrepancies, err := repo.ReconcileWithUpstream(ctx, counter)
+	is.NoErr(err)
+	is.Equal([]server.CountDiscrepancy{{ApiKey: "api_key_2", Local: 2, Upstream: 3}}, discrepancies)
+
+	// the revoked api_key_3 is not compared
+	is.Equal([]string{"api_key_1", "api_key_2", "api_key_4"}, asked)
+
+	t.Run("counter error", func(t *testing.T) {
+		failing := errors.New("upstream unavailable")
+
+		_, err := repo.ReconcileWithUpstream(ctx, func(ctx context.Context, apiKey string) (int64, error) {
+			return 0, failing
+		})
+		is.True(errors.Is(err, failing))
+	})
+}
+
+func TestGetTransactionSummaries(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 5, 26, 0, 0, 0, 0, time.UTC)
+	}
+
+	repo := repository.NewRepository(db, now)
+	ctx := context.Background()
+
+	t.Run("all", func(t *testing.T) {
+		summaries, err := repo.GetTransactionSummaries(ctx, true, 0, 0, 0)
+		is.NoErr(err)
+		is.Equal(6, len(summaries))
+		is.Equal(server.TransactionSummary{
+			ID:        "2BDCFF23",
+			ApiKey:    "api_key_1",
+			DataBytes: 50,
+			Filename:  "textfile2.txt",
+			CreatedAt: "2022-05-23 15:10:58.022Z",
+		}, summaries[1])
+
+		encoded, err := json.Marshal(summaries[1])
+		is.NoErr(err)
+		is.True(!strings.Contains(string(encoded), "secret"))
+		is.True(!strings.Contains(string(encoded), "1234"))
+	})
+
+	t.Run("hours back with limit and offset", func(t *testing.T) {
+		// 6A4410C3, 2BDCFF23, 27EC83F0 and 7650035F are within the last 15 days
+		summaries, err := repo.GetTransactionSummaries(ctx, false, 15*24, 2, 1)
+		is.NoErr(err)
+
+		ids := make([]string, len(summaries))
+		for i, summary := range summaries {
+			ids[i] = summary.ID
+		}
+		is.Equal([]string{"2BDCFF23", "27EC83F0"}, ids)
+	})
+}
+
+func TestInsertTransactionGracePeriod(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := func() time.Time {
+		return time.Date(2022, 7, 3, 10, 0, 0, 0, time.UTC)
+	}
+
+	ctx, cancel := context.WithCancel(repository.ContextWithActor(context.Background(), "handler"))
+	cancel()
+
+	t.Run("without grace period", func(t *testing.T) {
+		repo := repository.NewRepository(db, now)
+
+		err := repo.InsertTransaction(ctx, server.Transaction{ID: "grace0001", ApiKey: "api_key_1", DataBytes: 10})
+		is.True(errors.Is(err, context.Canceled))
+
+		_, err = repo.GetTransaction(context.Background(), "grace0001")
+		is.True(errors.Is(err, sql.ErrNoRows))
+	})
+
+	t.Run("with grace period", func(t *testing.T) {
+		repo := repository.NewRepository(db, now, repository.WithInsertGracePeriod(5*time.Second), repository.WithAuditLog())
+
+		err := repo.InsertTransaction(ctx, server.Transaction{ID: "grace0002", ApiKey: "api_key_1", DataBytes: 10})
+		is.NoErr(err)
+
+		_, err = repo.GetTransaction(context.Background(), "grace0002")
+		is.NoErr(err)
+
+		// the actor is kept from the canceled context
+		entries, err := repo.GetAuditLog(context.Background(), now().Add(-time.Minute), now().Add(time.Minute))
+		is.NoErr(err)
+
+		var found bool
+		for _, entry := range entries {
+			if entry.TargetID == "grace0002" {
+				found = true
+				is.Equal("handler", entry.Actor)
+			}
+		}
+		is.True(found)
+	})
+}
+
+func TestGetWriteGaps(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	// api_key_1 wrote on 04-28, 05-10, 05-12 22:10 and 05-23
+	gaps, err := repo.GetWriteGaps(ctx, "api_key_1", 10*24*time.Hour)
+	is.NoErr(err)
+	is.Equal([]server.Gap{
+		{
+			From:     time.Date(2022, 4, 28, 15, 10, 58, 22000000, time.UTC),
+			To:       time.Date(2022, 5, 10, 15, 10, 58, 22000000, time.UTC),
+			Duration: 12 * 24 * time.Hour,
+		},
+		{
+			From:     time.Date(2022, 5, 12, 22, 10, 58, 22000000, time.UTC),
+			To:       time.Date(2022, 5, 23, 15, 10, 58, 22000000, time.UTC),
+			Duration: 10*24*time.Hour + 17*time.Hour,
+		},
+	}, gaps)
+
+	gaps, err = repo.GetWriteGaps(ctx, "api_key_1", 12*24*time.Hour)
+	is.NoErr(err)
+	is.Equal(0, len(gaps))
+
+	gaps, err = repo.GetWriteGaps(ctx, "unknown_api_key", 0)
+	is.NoErr(err)
+	is.Equal(0, len(gaps))
+}
+
+// gcmEncryptor encrypts with AES-GCM, so that decrypting with a wrong key fails.
+type gcmEncryptor struct {
+	key []byte
+}
+
+func (e gcmEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	gcm, err := e.gcm()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (e gcmEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	gcm, err := e.gcm()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
+
+func (e gcmEncryptor) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(e.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func TestPrivateKeyEncryption(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	ctx := context.Background()
+	encryptor := gcmEncryptor{key: bytes.Repeat([]byte{0x11}, 32)}
+	repo := repository.NewRepository(db, time.Now, repository.WithEncryptor(encryptor))
+
+	err = repo.InsertKey(ctx, server.Key{ApiKey: "encrypted_key_1", PrivateKey: "plain-private-key-1", PublicKey: "pub1", Address: "addr1"})
+	is.NoErr(err)
+
+	t.Run("encrypted on write", func(t *testing.T) {
+		var stored struct {
+			PrivateKey string `db:"private_key"`
+			Encrypted  int    `db:"private_key_encrypted"`
+		}
+		err := db.GetContext(ctx, &stored, db.Rebind(`SELECT private_key, private_key_encrypted FROM keys WHERE api_key = ?;`), "encrypted_key_1")
+		is.NoErr(err)
+		is.Equal(1, stored.Encrypted)
+		is.True(!strings.Contains(stored.PrivateKey, "plain-private-key-1"))
+	})
+
+	t.Run("decrypted on read", func(t *testing.T) {
+		key, err := repo.GetKey(ctx, "encrypted_key_1")
+		is.NoErr(err)
+		is.Equal("plain-private-key-1", key.PrivateKey)
+		is.True(key.PrivateKeyEncrypted)
+
+		err = repo.InsertKeys(ctx, []server.Key{{ApiKey: "encrypted_key_2", PrivateKey: "plain-private-key-2", PublicKey: "pub2", Address: "addr2"}})
+		is.NoErr(err)
+
+		usages, err := repo.GetKeysUsage(ctx, []string{"encrypted_key_2"})
+		is.NoErr(err)
+		is.Equal(1, len(usages))
+		is.Equal("plain-private-key-2", usages[0].PrivateKey)
+	})
+
+	t.Run("plaintext keys are still read", func(t *testing.T) {
+		key, err := repo.GetKey(ctx, "api_key_2")
+		is.NoErr(err)
+		is.Equal("xp3k0cj3m", key.PrivateKey)
+		is.True(!key.PrivateKeyEncrypted)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		wrong := repository.NewRepository(db, time.Now, repository.WithEncryptor(gcmEncryptor{key: bytes.Repeat([]byte{0x22}, 32)}))
+
+		_, err := wrong.GetKey(ctx, "encrypted_key_1")
+		is.True(errors.Is(err, server.ErrDecryptionFailed))
+	})
+
+	t.Run("no encryptor", func(t *testing.T) {
+		plain := repository.NewRepository(db, time.Now)
+
+		_, err := plain.GetKey(ctx, "encrypted_key_1")
+		is.True(errors.Is(err, server.ErrDecryptionFailed))
+	})
+}
+
+func TestGetTransactionInfoTimestampLocation(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 5, 15, 10, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "location_tx", ApiKey: "api_key_1", DataBytes: 10})
+	is.NoErr(err)
+
+	from := time.Date(2022, 7, 5, 14, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 7, 5, 16, 0, 0, 0, time.UTC)
+
+	t.Run("utc", func(t *testing.T) {
+		transactions, err := repo.GetTransactionInfo(ctx, from, to, server.Hour)
+		is.NoErr(err)
+		is.Equal(1, len(transactions))
+		is.Equal(time.UTC, transactions[0].Timestamp.Location())
+		is.Equal(15, transactions[0].Timestamp.Hour())
+
+		encoded, err := json.Marshal(transactions[0].Timestamp)
+		is.NoErr(err)
+		is.Equal(`"2022-07-05T15:00:00Z"`, string(encoded))
+	})
+
+	t.Run("bucket location", func(t *testing.T) {
+		berlin, err := time.LoadLocation("Europe/Berlin")
+		is.NoErr(err)
+
+		transactions, err := repo.GetTransactionInfoWithOptions(ctx, from, to, server.Hour, server.TransactionInfoOptions{BucketLocation: berlin})
+		is.NoErr(err)
+		is.Equal(1, len(transactions))
+		is.Equal(berlin, transactions[0].Timestamp.Location())
+		is.Equal(17, transactions[0].Timestamp.Hour())
+		is.Equal(15, transactions[0].Timestamp.UTC().Hour())
+	})
+}
+
+func TestGetRecentTransactions(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	tcs := []struct {
+		name        string
+		n           int
+		expectedIDs []string
+	}{
+		{name: "newest three", n: 3, expectedIDs: []string{"6A4410C3", "2BDCFF23", "27EC83F0"}},
+		{name: "more than stored", n: 10, expectedIDs: []string{"6A4410C3", "2BDCFF23", "27EC83F0", "7650035F", "BA93B557", "2C34AE2C"}},
+		{name: "zero", n: 0, expectedIDs: []string{}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			txs, err := repo.GetRecentTransactions(ctx, tc.n)
+			is.NoErr(err)
+
+			ids := make([]string, len(txs))
+			for i, tx := range txs {
+				ids[i] = tx.ID
+			}
+			is.Equal(tc.expectedIDs, ids)
+		})
+	}
+}
+
+func TestClampFutureTimestamps(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	now := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	clock := server.NewManualClock(now.Add(48 * time.Hour))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	for _, txid := range []string{"future_tx_1", "future_tx_2"} {
+		err := repo.InsertTransaction(ctx, server.Transaction{ID: txid, ApiKey: "api_key_1", DataBytes: 10})
+		is.NoErr(err)
+	}
+
+	clock.Advance(-48 * time.Hour)
+
+	clamped, err := repo.ClampFutureTimestamps(ctx)
+	is.NoErr(err)
+	is.Equal(int64(2), clamped)
+
+	for _, txid := range []string{"future_tx_1", "future_tx_2"} {
+		tx, err := repo.GetTransaction(ctx, txid)
+		is.NoErr(err)
+		is.Equal(now.Format(repository.ISO8601), tx.CreatedAt)
+	}
+
+	// past transactions are left alone
+	tx, err := repo.GetTransaction(ctx, "6A4410C3")
+	is.NoErr(err)
+	is.True(strings.HasPrefix(tx.CreatedAt, "2022-05-25"))
+
+	clamped, err = repo.ClampFutureTimestamps(ctx)
+	is.NoErr(err)
+	is.Equal(int64(0), clamped)
+}
+
+func TestRunAggregate(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	repo := repository.NewRepository(db, time.Now)
+	ctx := context.Background()
+
+	from := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("count per api key", func(t *testing.T) {
+		rows, err := repo.RunAggregate(ctx, server.AggregateSpec{Aggregate: server.AggregateCount, GroupBy: server.DimensionApiKey, From: from, To: to})
+		is.NoErr(err)
+		is.Equal([]map[string]interface{}{
+			{"api_key": "api_key_1", "value": int64(3)},
+			{"api_key": "api_key_2", "value": int64(2)},
+		}, rows)
+	})
+
+	t.Run("sum without grouping", func(t *testing.T) {
+		rows, err := repo.RunAggregate(ctx, server.AggregateSpec{Aggregate: server.AggregateSumDataBytes, From: from, To: to})
+		is.NoErr(err)
+		is.Equal([]map[string]interface{}{{"value": int64(783)}}, rows)
+	})
+
+	t.Run("rejected aggregate", func(t *testing.T) {
+		_, err := repo.RunAggregate(ctx, server.AggregateSpec{Aggregate: "sum(secret)", From: from, To: to})
+		is.True(errors.Is(err, server.ErrInvalidAggregate))
+	})
+
+	t.Run("rejected dimension", func(t *testing.T) {
+		_, err := repo.RunAggregate(ctx, server.AggregateSpec{Aggregate: server.AggregateCount, GroupBy: "secret", From: from, To: to})
+		is.True(errors.Is(err, server.ErrInvalidAggregate))
+	})
+}
+
+func TestKeyUsageTotalFees(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "fee_tx_1", ApiKey: "api_key_1", DataBytes: 10, FeeSatoshis: 120})
+	is.NoErr(err)
+	err = repo.InsertTransaction(ctx, server.Transaction{ID: "fee_tx_2", ApiKey: "api_key_1", DataBytes: 10, FeeSatoshis: 35})
+	is.NoErr(err)
+
+	tx, err := repo.GetTransaction(ctx, "fee_tx_1")
+	is.NoErr(err)
+	is.Equal(int64(120), tx.FeeSatoshis)
+
+	keyWithUsage, err := repo.GetKeyWithUsage(ctx, "api_key_1")
+	is.NoErr(err)
+	is.Equal(int64(155), keyWithUsage.TotalFees)
+
+	keysUsage, err := repo.GetKeysUsage(ctx, []string{"api_key_1", "api_key_4"})
+	is.NoErr(err)
+	is.Equal(2, len(keysUsage))
+
+	fees := make(map[string]int64)
+	for _, keyUsage := range keysUsage {
+		fees[keyUsage.ApiKey] = keyUsage.TotalFees
+	}
+
+	is.Equal(int64(155), fees["api_key_1"])
+	// The fixture transactions carry no fee data
+	is.Equal(int64(0), fees["api_key_4"])
+
+	t.Run("negative fee", func(t *testing.T) {
+		err := repo.InsertTransaction(ctx, server.Transaction{ID: "fee_tx_3", ApiKey: "api_key_1", DataBytes: 10, FeeSatoshis: -1})
+		is.True(errors.Is(err, server.ErrInvalidTransaction))
+	})
+}
+
+func TestTailTransactions(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = repo.TailTransactions(ctx, 0)
+	is.True(err != nil)
+
+	txs, err := repo.TailTransactions(ctx, 10*time.Millisecond)
+	is.NoErr(err)
+
+	received := make(map[string]int)
+
+	receive := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case tx := <-txs:
+				received[tx.ID]++
+			case <-time.After(10 * time.Second):
+				t.Fatalf("received %d of %d transactions", i, n)
+			}
+		}
+	}
+
+	// Transactions within the same millisecond are told apart by their id
+	for _, id := range []string{"tail_tx_b", "tail_tx_a", "tail_tx_c"} {
+		err = repo.InsertTransaction(ctx, server.Transaction{ID: id, ApiKey: "api_key_1", DataBytes: 10})
+		is.NoErr(err)
+	}
+	receive(3)
+
+	for i := 0; i < 120; i++ {
+		clock.Advance(time.Millisecond)
+		err = repo.InsertTransaction(ctx, server.Transaction{ID: fmt.Sprintf("tail_tx_%03d", i), ApiKey: "api_key_1", DataBytes: 10})
+		is.NoErr(err)
+	}
+	receive(120)
+
+	// Further polls must not emit any transaction again
+	select {
+	case tx := <-txs:
+		t.Fatalf("received %s again", tx.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	is.Equal(123, len(received))
+	for id, count := range received {
+		is.Equal(1, count) // every transaction is received once
+		is.True(strings.HasPrefix(id, "tail_tx_"))
+	}
+
+	cancel()
+
+	for range txs {
+	}
+}
+
+func TestGetTransactionInfoWithComparison(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	previousWeek := time.Date(2023, 2, 27, 0, 0, 0, 0, time.UTC)
+	currentWeek := previousWeek.Add(7 * 24 * time.Hour)
+
+	clock := server.NewManualClock(previousWeek)
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	insert := func(at time.Time, n int) {
+		clock.Advance(at.Sub(clock.Now()))
+		for i := 0; i < n; i++ {
+			err := repo.InsertTransaction(ctx, server.Transaction{ID: fmt.Sprintf("cmp_tx_%s_%d", at.Format("0102T15"), i), ApiKey: "api_key_1", DataBytes: 10})
+			is.NoErr(err)
+		}
+	}
+
+	day := 24 * time.Hour
+
+	// Monday has 2 then 3 transactions, Tuesday 1 then none and Wednesday none then 1
+	insert(previousWeek.Add(10*time.Hour), 2)
+	insert(previousWeek.Add(day+10*time.Hour), 1)
+	insert(currentWeek.Add(10*time.Hour), 3)
+	insert(currentWeek.Add(2*day+10*time.Hour), 1)
+
+	comparisons, err := repo.GetTransactionInfoWithComparison(ctx, currentWeek, currentWeek.Add(7*day), server.Day)
+	is.NoErr(err)
+	is.Equal(3, len(comparisons))
+
+	monday := comparisons[0]
+	is.Equal(time.Duration(0), monday.Offset)
+	is.Equal(currentWeek, monday.Current.Timestamp)
+	is.Equal(previousWeek, monday.Previous.Timestamp)
+	is.Equal(3, monday.Current.Count)
+	is.Equal(2, monday.Previous.Count)
+	is.Equal(int64(30), monday.Current.DataBytes)
+	is.Equal(50.0, *monday.CountChangePercent)
+	is.Equal(50.0, *monday.DataBytesChangePercent)
+
+	tuesday := comparisons[1]
+	is.Equal(day, tuesday.Offset)
+	is.Equal(currentWeek.Add(day), tuesday.Current.Timestamp)
+	is.Equal(0, tuesday.Current.Count)
+	is.Equal(1, tuesday.Previous.Count)
+	is.Equal(-100.0, *tuesday.CountChangePercent)
+
+	wednesday := comparisons[2]
+	is.Equal(2*day, wednesday.Offset)
+	is.Equal(1, wednesday.Current.Count)
+	is.Equal(0, wednesday.Previous.Count)
+	is.True(wednesday.CountChangePercent == nil) // the previous bucket is empty
+	is.True(wednesday.DataBytesChangePercent == nil)
+
+	t.Run("invalid range", func(t *testing.T) {
+		_, err := repo.GetTransactionInfoWithComparison(ctx, currentWeek, previousWeek, server.Day)
+		is.True(err != nil)
+	})
+}
+
+func TestGetTransactionInfoWithComparisonUnaligned(t *testing.T) {
+	is := is.New(t)
+	err := prepareTestDatabase()
+	is.NoErr(err)
+
+	clock := server.NewManualClock(time.Date(2023, 3, 6, 0, 0, 0, 0, time.UTC))
+	repo := repository.NewRepository(db, nil, repository.WithClock(clock))
+	ctx := context.Background()
+
+	insert := func(id string, at time.Time) {
+		clock.Advance(at.Sub(clock.Now()))
+		err := repo.InsertTransaction(ctx, server.Transaction{ID: id, ApiKey: "api_key_1", DataBytes: 10})
+		is.NoErr(err)
+	}
+
+	hour := func(h int, m int) time.Time {
+		return time.Date(2023, 3, 6, h, m, 0, 0, time.UTC)
+	}
+
+	// 10:30 to 12:15 is widened to 10:00 to 13:00, so the previous window is 07:00 to 10:00
+	insert("unaligned_previous_1", hour(7, 20))
+	insert("unaligned_previous_2", hour(9, 59))
+	insert("unaligned_at_from", hour(10, 0))
+	insert("unaligned_current", hour(12, 10))
+
+	comparisons, err := repo.GetTransactionInfoWithComparison(ctx, hour(10, 30), hour(12, 15), server.Hour)
+	is.NoErr(err)
+	is.Equal(2, len(comparisons))
+
+	// The transaction at the start of the window only counts for the current one
+	is.Equal(time.Duration(0), comparisons[0].Offset)
+	is.Equal(hour(10, 0), comparisons[0].Current.Timestamp)
+	is.Equal(hour(7, 0), comparisons[0].Previous.Timestamp)
+	is.Equal(1, comparisons[0].Current.Count)
+	is.Equal(1, comparisons[0].Previous.Count)
+	is.Equal(0.0, *comparisons[0].CountChangePercent)
+
+	is.Equal(2*time.Hour, comparisons[1].Offset)
+	is.Equal(hour(12, 0), comparisons[1].Current.Timestamp)
+	is.Equal(hour(9, 0), comparisons[1].Previous.Timestamp)
+	is.Equal(1, comparisons[1].Current.Count)
+	is.Equal(1, comparisons[1].Previous.Count)
+}
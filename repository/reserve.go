@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"taal-client/server"
+)
+
+// notReserving excludes the placeholders stored by ReserveTransaction from the listings and
+// aggregates, as they have no data yet. Reads of a single transaction by id still return them.
+const notReserving = `status <> 'reserving'`
+
+// ReserveTransaction stores a placeholder for the transaction with the reserving status, so that
+// concurrent writers do not broadcast the same transaction twice. It returns false if a
+// transaction with the id is already reserved or stored. The placeholder is left out of the
+// transaction listings and aggregates until it is finalized.
+func (r Repository) ReserveTransaction(ctx context.Context, txid string, apiKey string) (bool, error) {
+	err := r.validateTransaction(ctx, server.Transaction{ID: txid, ApiKey: apiKey})
+	if err != nil {
+		return false, err
+	}
+
+	createdAt := r.now().UTC().Format(ISO8601)
+	query := `INSERT INTO transactions (created_at, id, api_key, data_bytes, status, status_at) VALUES ($1, $2, $3, 0, $4, $5) ON CONFLICT (id) DO NOTHING;`
+
+	reserved := false
+
+	err = r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		result, err := ex.ExecContext(ctx, query, createdAt, txid, apiKey, server.TransactionStatusReserving, createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+
+		if rows == 0 {
+			return nil, nil
+		}
+
+		reserved = true
+
+		return []auditEntry{{operation: AuditTransactionReserved, targetID: txid}}, nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return reserved, nil
+}
+
+// FinalizeTransaction fills in the transaction reserved with ReserveTransaction after it was
+// broadcast, which gives it the broadcast status with the current time as created_at. The api key of tx must
+// be the one it was reserved with. It returns sql.ErrNoRows if there is no such reservation.
+func (r Repository) FinalizeTransaction(ctx context.Context, txid string, tx server.Transaction) error {
+	tx.ID = txid
+
+	err := r.validateTransaction(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	now := r.now().UTC().Format(ISO8601)
+	query := `UPDATE transactions SET created_at = $1, data_bytes = $2, filename = $3, secret = $4, is_hash = $5, content_hash = $6, status = $7, status_at = $8,
+	fee_satoshis = $9 WHERE id = $10 AND api_key = $11 AND status = $12;`
+
+	err = r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		result, err := ex.ExecContext(ctx, query, now, tx.DataBytes, tx.Filename, tx.Secret, bool2integer(tx.IsHash), tx.ContentHash,
+			server.TransactionStatusBroadcast, now, tx.FeeSatoshis, txid, tx.ApiKey, server.TransactionStatusReserving)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+
+		if rows == 0 {
+			return nil, sql.ErrNoRows
+		}
+
+		return []auditEntry{{operation: AuditTransactionInserted, targetID: txid}}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if r.infoCache != nil {
+		r.infoCache.clear()
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const (
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlockDetected     = "40P01"
+)
+
+// isSerializationFailure reports whether err is a PostgreSQL error after which the transaction
+// can safely be retried.
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	return pqErr.Code == sqlStateSerializationFailure || pqErr.Code == sqlStateDeadlockDetected
+}
+
+// retry calls run until it succeeds, returns an error which is not retryable or maxRetries
+// retries have been made. The wait between attempts starts at backoff and doubles each time.
+func retry(ctx context.Context, maxRetries int, backoff time.Duration, retryable func(error) bool, run func() error) error {
+	err := run()
+
+	for attempt := 0; attempt < maxRetries && err != nil && retryable(err); attempt++ {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff << attempt):
+		}
+
+		err = run()
+	}
+
+	return err
+}
@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+)
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("serialization failure succeeds on retry", func(t *testing.T) {
+		is := is.New(t)
+
+		calls := 0
+		err := retry(ctx, 3, time.Millisecond, isSerializationFailure, func() error {
+			calls++
+			if calls == 1 {
+				return &pq.Error{Code: sqlStateSerializationFailure}
+			}
+			return nil
+		})
+
+		is.NoErr(err)
+		is.Equal(2, calls)
+	})
+
+	t.Run("deadlock is retried until the limit", func(t *testing.T) {
+		is := is.New(t)
+
+		calls := 0
+		err := retry(ctx, 2, time.Millisecond, isSerializationFailure, func() error {
+			calls++
+			return errors.Wrap(&pq.Error{Code: sqlStateDeadlockDetected}, "failed to update")
+		})
+
+		is.True(isSerializationFailure(err))
+		is.Equal(3, calls)
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		is := is.New(t)
+
+		calls := 0
+		err := retry(ctx, 3, time.Millisecond, isSerializationFailure, func() error {
+			calls++
+			return &pq.Error{Code: "23505"}
+		})
+
+		is.True(err != nil)
+		is.Equal(1, calls)
+	})
+}
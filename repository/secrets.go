@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SetTransactionSecretHashed stores a salted bcrypt hash of the recovery secret of the
+// transaction. The recovery secret itself is not stored, so it can only be verified with
+// VerifyTransactionSecret afterwards. The encryption key in the secret column is left as it is,
+// as reading an encrypted transaction needs it.
+func (r Repository) SetTransactionSecretHashed(ctx context.Context, txid string, secret string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE transactions SET secret_hash = $1 WHERE id = $2;`
+
+	result, err := r.db.ExecContext(ctx, query, string(hash), txid)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// VerifyTransactionSecret reports whether secret matches the secret of the transaction. Transactions
+// without a secret hash are compared against the legacy plaintext secret column.
+func (r Repository) VerifyTransactionSecret(ctx context.Context, txid string, secret string) (bool, error) {
+	query := `SELECT secret, secret_hash FROM transactions WHERE id = $1;`
+
+	stored := struct {
+		Secret     string `db:"secret"`
+		SecretHash string `db:"secret_hash"`
+	}{}
+
+	err := r.reader().GetContext(ctx, &stored, query, txid)
+	if err != nil {
+		return false, err
+	}
+
+	if stored.SecretHash != "" {
+		err = bcrypt.CompareHashAndPassword([]byte(stored.SecretHash), []byte(secret))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	if stored.Secret == "" {
+		return false, nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(stored.Secret), []byte(secret)) == 1, nil
+}
+
+// HashPlaintextSecrets migrates the transactions which were verified against their plaintext
+// secret column to a hash of it and returns the number of transactions updated. Verification then
+// no longer reads the plaintext. The secret column is kept, because it is the encryption key
+// needed to decrypt the data of encrypted transactions on read.
+func (r Repository) HashPlaintextSecrets(ctx context.Context) (int64, error) {
+	query := `SELECT id, secret FROM transactions WHERE secret <> '' AND secret_hash = '';`
+
+	legacy := []struct {
+		ID     string `db:"id"`
+		Secret string `db:"secret"`
+	}{}
+
+	err := r.db.SelectContext(ctx, &legacy, query)
+	if err != nil {
+		return 0, err
+	}
+
+	var updated int64
+
+	for _, tx := range legacy {
+		hash, err := bcrypt.GenerateFromPassword([]byte(tx.Secret), bcrypt.DefaultCost)
+		if err != nil {
+			return updated, err
+		}
+
+		_, err = r.db.ExecContext(ctx, `UPDATE transactions SET secret_hash = $1 WHERE id = $2;`, string(hash), tx.ID)
+		if err != nil {
+			return updated, err
+		}
+
+		updated++
+	}
+
+	return updated, nil
+}
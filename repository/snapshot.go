@@ -0,0 +1,215 @@
+package repository
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+const (
+	snapshotFormat  = "taal-client-snapshot"
+	snapshotVersion = 1
+)
+
+// snapshotHeader is the first line of a snapshot.
+type snapshotHeader struct {
+	Format        string `json:"format"`
+	Version       int    `json:"version"`
+	SchemaVersion int    `json:"schema_version"`
+}
+
+// snapshotRecord is a line of a snapshot after the header, holding either a key or a transaction.
+type snapshotRecord struct {
+	Key         *keyBackup           `json:"key,omitempty"`
+	Transaction *transactionSnapshot `json:"transaction,omitempty"`
+}
+
+// transactionSnapshot holds all columns of a transaction, unlike server.Transaction it includes
+// all of them in JSON.
+type transactionSnapshot struct {
+	ID             string  `db:"id" json:"id"`
+	ApiKey         string  `db:"api_key" json:"api_key"`
+	DataBytes      int64   `db:"data_bytes" json:"data_bytes"`
+	CreatedAt      string  `db:"created_at" json:"created_at"`
+	Filename       string  `db:"filename" json:"filename"`
+	Secret         string  `db:"secret" json:"secret"`
+	SecretHash     string  `db:"secret_hash" json:"secret_hash"`
+	IsHash         bool    `db:"is_hash" json:"is_hash"`
+	ContentHash    string  `db:"content_hash" json:"content_hash"`
+	Status         string  `db:"status" json:"status"`
+	StatusAt       *string `db:"status_at" json:"status_at"`
+	ReplacedBy     *string `db:"replaced_by" json:"replaced_by"`
+	IdempotencyKey *string `db:"idempotency_key" json:"idempotency_key"`
+	Metadata       *string `db:"metadata" json:"metadata"`
+	FeeSatoshis    int64   `db:"fee_satoshis" json:"fee_satoshis"`
+}
+
+// Snapshot writes all keys and transactions to w as gzipped JSON Lines, starting with a header
+// which records the schema version. All rows are read from one consistent snapshot. The output
+// holds the secrets unencrypted and the private keys as they are stored, which is unencrypted
+// unless WithEncryptor is used, so it is only meant for seeding test environments.
+func (r Repository) Snapshot(ctx context.Context, w io.Writer) error {
+	schemaVersion, err := r.getSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	encoder := json.NewEncoder(gz)
+
+	err = encoder.Encode(snapshotHeader{Format: snapshotFormat, Version: snapshotVersion, SchemaVersion: schemaVersion})
+	if err != nil {
+		return err
+	}
+
+	err = r.withReadTx(ctx, func(tx *sqlx.Tx) error {
+		keys, err := tx.QueryxContext(ctx, `SELECT * FROM keys ORDER BY created_at, api_key;`)
+		if err != nil {
+			return err
+		}
+		defer keys.Close()
+
+		for keys.Next() {
+			var key keyBackup
+			if err := keys.StructScan(&key); err != nil {
+				return err
+			}
+
+			if err := encoder.Encode(snapshotRecord{Key: &key}); err != nil {
+				return err
+			}
+		}
+
+		if err := keys.Err(); err != nil {
+			return err
+		}
+
+		txs, err := tx.QueryxContext(ctx, `SELECT * FROM transactions ORDER BY created_at, id;`)
+		if err != nil {
+			return err
+		}
+		defer txs.Close()
+
+		for txs.Next() {
+			var transaction transactionSnapshot
+			if err := txs.StructScan(&transaction); err != nil {
+				return err
+			}
+
+			if err := encoder.Encode(snapshotRecord{Transaction: &transaction}); err != nil {
+				return err
+			}
+		}
+
+		return txs.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// Restore inserts the keys and transactions of a snapshot written by Snapshot in one transaction.
+// It returns server.ErrSchemaMismatch if the snapshot was taken at another schema version. The
+// database should not have any of the rows yet, an existing row fails the whole restore.
+func (r Repository) Restore(ctx context.Context, reader io.Reader) error {
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return errors.Wrap(err, "invalid snapshot")
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	// Lines hold whole transactions including their metadata
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return errors.Wrap(err, "invalid snapshot")
+		}
+		return errors.New("invalid snapshot: missing header")
+	}
+
+	var header snapshotHeader
+
+	err = json.Unmarshal(scanner.Bytes(), &header)
+	if err != nil || header.Format != snapshotFormat {
+		return errors.New("invalid snapshot: unknown format")
+	}
+
+	if header.Version != snapshotVersion {
+		return errors.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	schemaVersion, err := r.getSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if header.SchemaVersion != schemaVersion {
+		return errors.Wrapf(server.ErrSchemaMismatch, "snapshot has version %d, database has version %d", header.SchemaVersion, schemaVersion)
+	}
+
+	keyQuery := `INSERT INTO keys (api_key, public_key, private_key, address, created_at, revoked_at, revoked_reason, private_key_encrypted) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`
+	txQuery := `INSERT INTO transactions (id, api_key, data_bytes, created_at, filename, secret, secret_hash, is_hash, content_hash, status, status_at, replaced_by, idempotency_key, metadata, fee_satoshis)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15);`
+
+	err = r.WithTx(ctx, func(tx *sqlx.Tx) error {
+		for scanner.Scan() {
+			var record snapshotRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				return errors.Wrap(err, "invalid snapshot record")
+			}
+
+			switch {
+			case record.Key != nil:
+				key := record.Key
+				_, err := tx.ExecContext(ctx, keyQuery, key.ApiKey, key.PublicKey, key.PrivateKey, key.Address, key.CreatedAt, key.RevokedAt, key.RevokedReason,
+					bool2integer(key.PrivateKeyEncrypted))
+				if err != nil {
+					return errors.Wrapf(err, "failed to restore key %s", key.ApiKey)
+				}
+			case record.Transaction != nil:
+				t := record.Transaction
+				_, err := tx.ExecContext(ctx, txQuery, t.ID, t.ApiKey, t.DataBytes, t.CreatedAt, t.Filename, t.Secret, t.SecretHash, bool2integer(t.IsHash),
+					t.ContentHash, t.Status, t.StatusAt, t.ReplacedBy, t.IdempotencyKey, t.Metadata, t.FeeSatoshis)
+				if err != nil {
+					return errors.Wrapf(err, "failed to restore transaction %s", t.ID)
+				}
+			default:
+				return errors.New("invalid snapshot record: neither key nor transaction")
+			}
+		}
+
+		return errors.Wrap(scanner.Err(), "failed to read snapshot")
+	})
+	if err != nil {
+		return err
+	}
+
+	if r.infoCache != nil {
+		r.infoCache.clear()
+	}
+
+	return nil
+}
+
+// getSchemaVersion returns the version of the applied migrations.
+func (r Repository) getSchemaVersion(ctx context.Context) (int, error) {
+	var version int
+
+	err := r.db.GetContext(ctx, &version, `SELECT version FROM schema_migrations LIMIT 1;`)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read schema version")
+	}
+
+	return version, nil
+}
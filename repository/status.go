@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"taal-client/server"
+)
+
+// UpdateTransactionStatus sets the status of the transaction, which changed at the given time. It
+// returns a server.InvalidStatusError for an unknown status or reserving, which only
+// ReserveTransaction sets, and sql.ErrNoRows if there is no transaction with the id.
+func (r Repository) UpdateTransactionStatus(ctx context.Context, txid string, status string, at time.Time) error {
+	if !server.ValidTransactionStatus(status) || status == server.TransactionStatusReserving {
+		return server.InvalidStatusError{Status: status}
+	}
+
+	query := `UPDATE transactions SET status = $1, status_at = $2 WHERE id = $3;`
+
+	return r.mutate(ctx, func(ex execer) ([]auditEntry, error) {
+		result, err := ex.ExecContext(ctx, query, status, at.UTC().Format(ISO8601), txid)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+
+		if rows == 0 {
+			return nil, sql.ErrNoRows
+		}
+
+		return []auditEntry{{operation: AuditTransactionStatusUpdated, targetID: txid}}, nil
+	})
+}
+
+// GetTransactionsByStatus returns the transactions with the status, the ones changed last first.
+func (r Repository) GetTransactionsByStatus(ctx context.Context, status string) ([]server.Transaction, error) {
+	if !server.ValidTransactionStatus(status) {
+		return nil, server.InvalidStatusError{Status: status}
+	}
+
+	query := `SELECT * FROM transactions WHERE status = $1 ORDER BY COALESCE(status_at, created_at) DESC, id;`
+
+	txs := make([]server.Transaction, 0)
+
+	err := r.reader().SelectContext(ctx, &txs, query, status)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range txs {
+		txs[idx].CreatedAt = formatDBTimestamp(txs[idx].CreatedAt)
+	}
+
+	return txs, nil
+}
+
+// GetStuckTransactions returns the transactions which have had the status for longer than
+// olderThan, measured from the last status change or, if it never changed, from created_at. The
+// oldest are returned first.
+func (r Repository) GetStuckTransactions(ctx context.Context, status string, olderThan time.Duration) ([]server.Transaction, error) {
+	if !server.ValidTransactionStatus(status) {
+		return nil, server.InvalidStatusError{Status: status}
+	}
+
+	query := `SELECT * FROM transactions WHERE status = $1 AND COALESCE(status_at, created_at) < $2 ORDER BY COALESCE(status_at, created_at), id;`
+
+	threshold := r.now().Add(-olderThan).UTC().Format(ISO8601)
+
+	txs := make([]server.Transaction, 0)
+
+	err := r.reader().SelectContext(ctx, &txs, query, status, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range txs {
+		txs[idx].CreatedAt = formatDBTimestamp(txs[idx].CreatedAt)
+	}
+
+	return txs, nil
+}
@@ -0,0 +1,614 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+func (r Repository) GetTransactionInfo(ctx context.Context, from time.Time, to time.Time, granularity server.Granularity) ([]server.TransactionInfo, error) {
+	return r.GetTransactionInfoWithOptions(ctx, from, to, granularity, server.TransactionInfoOptions{})
+}
+
+// GetTransactionInfoWithOptions returns the number and size of the transactions between from and
+// to per bucket of the given granularity, adjusted by opts.
+func (r Repository) GetTransactionInfoWithOptions(ctx context.Context, from time.Time, to time.Time, granularity server.Granularity, opts server.TransactionInfoOptions) ([]server.TransactionInfo, error) {
+	err := validateRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.infoCache == nil {
+		return getTransactionInfo(ctx, r.reader(), from, to, granularity, opts)
+	}
+
+	key := transactionInfoCacheKey{from: from.UTC(), to: to.UTC(), granularity: granularity, opts: opts}
+	if txInfos, ok := r.infoCache.get(key, r.now()); ok {
+		return txInfos, nil
+	}
+
+	txInfos, err := getTransactionInfo(ctx, r.reader(), from, to, granularity, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.infoCache.set(key, txInfos, r.now())
+
+	return txInfos, nil
+}
+
+// GetTransactionInfoMap returns the buckets of GetTransactionInfo keyed by their timestamp in the
+// layout of the granularity, such as 2006-01-02T15 for Hour.
+func (r Repository) GetTransactionInfoMap(ctx context.Context, from time.Time, to time.Time, granularity server.Granularity) (map[string]server.TransactionInfo, error) {
+	txInfos, err := r.GetTransactionInfo(ctx, from, to, granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	_, layout := granularitySecondsToPositionAndFormat(granularity)
+
+	buckets := make(map[string]server.TransactionInfo, len(txInfos))
+	for _, txInfo := range txInfos {
+		buckets[txInfo.Timestamp.Format(layout)] = txInfo
+	}
+
+	return buckets, nil
+}
+
+// GetTransactionInfoColumns returns the buckets of GetTransactionInfo as parallel slices, oldest
+// first, as expected by most plotting libraries.
+func (r Repository) GetTransactionInfoColumns(ctx context.Context, from time.Time, to time.Time, granularity server.Granularity) (server.TransactionInfoColumns, error) {
+	txInfos, err := r.GetTransactionInfoWithOptions(ctx, from, to, granularity, server.TransactionInfoOptions{Ascending: true})
+	if err != nil {
+		return server.TransactionInfoColumns{}, err
+	}
+
+	columns := server.TransactionInfoColumns{
+		Timestamps: make([]time.Time, len(txInfos)),
+		Counts:     make([]int, len(txInfos)),
+		DataBytes:  make([]int64, len(txInfos)),
+		ActiveKeys: make([]int, len(txInfos)),
+	}
+
+	for i, txInfo := range txInfos {
+		columns.Timestamps[i] = txInfo.Timestamp
+		columns.Counts[i] = txInfo.Count
+		columns.DataBytes[i] = txInfo.DataBytes
+		columns.ActiveKeys[i] = txInfo.ActiveKeys
+	}
+
+	return columns, nil
+}
+
+// GetPeakBucket returns the bucket between from and to with the most transactions, or of those
+// the one with the most data bytes and then the earliest. It returns server.ErrNoTransactions if
+// there are no transactions in the range.
+func (r Repository) GetPeakBucket(ctx context.Context, from time.Time, to time.Time, granularity server.Granularity) (server.TransactionInfo, error) {
+	err := validateRange(from, to)
+	if err != nil {
+		return server.TransactionInfo{}, err
+	}
+
+	q := r.reader()
+	isPostgres := q.DriverName() == "postgres"
+
+	position, format := granularitySecondsToPositionAndFormat(granularity)
+
+	err = checkBucketLayout(position, format)
+	if err != nil {
+		return server.TransactionInfo{}, err
+	}
+
+	where := `created_at > $2 AND created_at < $3 AND ` + notReserving
+	query := `SELECT ` + bucketColumns("created_at", isPostgres) + ` FROM transactions WHERE ` + where + `
+	GROUP BY timestamp ORDER BY count DESC, data_bytes DESC, timestamp LIMIT 1;`
+
+	args := []interface{}{position, from.UTC().Format(ISO8601), to.UTC().Format(ISO8601)}
+
+	txs := make([]TransactionInfo, 0, 1)
+
+	err = sqlx.SelectContext(ctx, q, &txs, query, args...)
+	if err != nil {
+		return server.TransactionInfo{}, err
+	}
+
+	if len(txs) == 0 {
+		return server.TransactionInfo{}, server.ErrNoTransactions
+	}
+
+	if !isPostgres {
+		// Only the sizes within the peak bucket are loaded
+		where += ` AND SUBSTR(created_at, 0, $1) = $4`
+		err = setPercentilesSqlite(ctx, q, txs, "created_at", where, append(args, txs[0].Timestamp))
+		if err != nil {
+			return server.TransactionInfo{}, err
+		}
+	}
+
+	txInfos, err := toTransactionInfos(txs, format, time.UTC)
+	if err != nil {
+		return server.TransactionInfo{}, err
+	}
+
+	return txInfos[0], nil
+}
+
+// GetTransactionInfoWithSummary returns the same buckets as GetTransactionInfo together with the
+// totals over the whole range. Both are read within one transaction so that they are consistent.
+func (r Repository) GetTransactionInfoWithSummary(ctx context.Context, from time.Time, to time.Time, granularity server.Granularity) ([]server.TransactionInfo, server.TransactionInfoSummary, error) {
+	err := validateRange(from, to)
+	if err != nil {
+		return nil, server.TransactionInfoSummary{}, err
+	}
+
+	var txInfos []server.TransactionInfo
+	var summary server.TransactionInfoSummary
+
+	err = r.withReadTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+
+		txInfos, err = getTransactionInfo(ctx, tx, from, to, granularity, server.TransactionInfoOptions{})
+		if err != nil {
+			return err
+		}
+
+		query := `SELECT count(*) AS count, COALESCE(sum(data_bytes), 0) AS data_bytes FROM transactions WHERE created_at > $1 AND created_at < $2 AND ` + notReserving + `;`
+
+		return tx.GetContext(ctx, &summary, query, from.UTC().Format(ISO8601), to.UTC().Format(ISO8601))
+	})
+	if err != nil {
+		return nil, server.TransactionInfoSummary{}, err
+	}
+
+	return txInfos, summary, nil
+}
+
+// GetTransactionInfoMulti returns the buckets between from and to for each of the granularities.
+// All series are read within one transaction so that they are consistent with each other.
+func (r Repository) GetTransactionInfoMulti(ctx context.Context, from time.Time, to time.Time, granularities []server.Granularity) (map[server.Granularity][]server.TransactionInfo, error) {
+	err := validateRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	series := make(map[server.Granularity][]server.TransactionInfo, len(granularities))
+
+	err = r.withReadTx(ctx, func(tx *sqlx.Tx) error {
+		for _, granularity := range granularities {
+			if _, ok := series[granularity]; ok {
+				continue
+			}
+
+			txInfos, err := getTransactionInfo(ctx, tx, from, to, granularity, server.TransactionInfoOptions{})
+			if err != nil {
+				return err
+			}
+
+			series[granularity] = txInfos
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return series, nil
+}
+
+// GetTransactionInfoWithComparison returns the buckets between from and to next to the buckets of
+// the preceding window of the same length, which ends at from. The window is widened to whole
+// buckets in UTC, with from truncated and to rounded up to the granularity, and includes from but
+// not to. Buckets are paired by their offset from the start of their window and returned oldest
+// first. A bucket with transactions in only one of the windows is paired with an empty one. Both
+// windows are read within one transaction so that they are consistent with each other.
+func (r Repository) GetTransactionInfoWithComparison(ctx context.Context, from time.Time, to time.Time, granularity server.Granularity) ([]server.TransactionInfoComparison, error) {
+	err := validateRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	step := granularityStep(granularity)
+
+	currentStart := from.UTC().Truncate(step)
+	currentEnd := to.UTC().Truncate(step)
+	if currentEnd.Before(to) {
+		currentEnd = currentEnd.Add(step)
+	}
+	previousStart := currentStart.Add(-currentEnd.Sub(currentStart))
+
+	var current, previous []server.TransactionInfo
+
+	err = r.withReadTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+
+		// getTransactionInfo leaves out both ends of the range. created_at is stored in
+		// milliseconds, so starting a millisecond early includes the start of the window.
+		current, err = getTransactionInfo(ctx, tx, currentStart.Add(-time.Millisecond), currentEnd, granularity, server.TransactionInfoOptions{})
+		if err != nil {
+			return err
+		}
+
+		previous, err = getTransactionInfo(ctx, tx, previousStart.Add(-time.Millisecond), currentStart, granularity, server.TransactionInfoOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	comparisons := make(map[time.Duration]*server.TransactionInfoComparison)
+	comparison := func(offset time.Duration) *server.TransactionInfoComparison {
+		c, ok := comparisons[offset]
+		if !ok {
+			c = &server.TransactionInfoComparison{
+				Offset:   offset,
+				Current:  server.TransactionInfo{Timestamp: currentStart.Add(offset)},
+				Previous: server.TransactionInfo{Timestamp: previousStart.Add(offset)},
+			}
+			comparisons[offset] = c
+		}
+		return c
+	}
+
+	for _, txInfo := range current {
+		comparison(txInfo.Timestamp.Sub(currentStart)).Current = txInfo
+	}
+
+	for _, txInfo := range previous {
+		comparison(txInfo.Timestamp.Sub(previousStart)).Previous = txInfo
+	}
+
+	result := make([]server.TransactionInfoComparison, 0, len(comparisons))
+	for _, c := range comparisons {
+		c.CountChangePercent = changePercent(int64(c.Previous.Count), int64(c.Current.Count))
+		c.DataBytesChangePercent = changePercent(c.Previous.DataBytes, c.Current.DataBytes)
+		result = append(result, *c)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Offset < result[j].Offset
+	})
+
+	return result, nil
+}
+
+// changePercent returns the change from previous to current in percent, or nil if previous is 0.
+func changePercent(previous int64, current int64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+
+	change := float64(current-previous) / float64(previous) * 100
+	return &change
+}
+
+// granularityStep returns the length of the buckets of the granularity.
+func granularityStep(granularity server.Granularity) time.Duration {
+	switch granularity {
+	case server.None:
+		return time.Second
+	case server.Minute:
+		return time.Minute
+	case server.Hour:
+		return time.Hour
+	}
+
+	// Day
+	return 24 * time.Hour
+}
+
+// isoWeekPostgres labels created_at with its ISO 8601 week. date_trunc cuts it to the Monday of
+// its week, which always lies in the same ISO week-numbering year as the rest of the week.
+const isoWeekPostgres = `to_char(date_trunc('week', created_at::timestamptz AT TIME ZONE 'UTC'), 'IYYY-"W"IW')`
+
+// isoWeekSqlite labels created_at with its ISO 8601 week. SQLite has no ISO week format, so it
+// is derived from the Thursday of the week: '-3 days' followed by 'weekday 4' moves any day from
+// Monday to Sunday to that Thursday. Week 01 is the week holding the first Thursday of the year, so
+// the year of the Thursday is the ISO year and its day of the year gives the week number.
+const isoWeekSqlite = `printf('%s-W%02d', strftime('%Y', created_at, '-3 days', 'weekday 4'),
+	(CAST(strftime('%j', created_at, '-3 days', 'weekday 4') AS INTEGER) - 1) / 7 + 1)`
+
+// GetTransactionInfoByISOWeek returns the number and size of the transactions between from and to
+// per ISO 8601 week in UTC, oldest first.
+func (r Repository) GetTransactionInfoByISOWeek(ctx context.Context, from time.Time, to time.Time) ([]server.TransactionWeekInfo, error) {
+	err := validateRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	week := isoWeekSqlite
+	if r.reader().DriverName() == "postgres" {
+		week = isoWeekPostgres
+	}
+
+	query := `SELECT ` + week + ` AS week, count(*) AS count, sum(data_bytes) AS data_bytes, count(DISTINCT api_key) AS active_keys
+	FROM transactions WHERE created_at > $1 AND created_at < $2 AND ` + notReserving + ` GROUP BY week ORDER BY week;`
+
+	weeks := make([]TransactionWeekInfo, 0)
+
+	err = r.reader().SelectContext(ctx, &weeks, query, from.UTC().Format(ISO8601), to.UTC().Format(ISO8601))
+	if err != nil {
+		return nil, err
+	}
+
+	weekInfos := make([]server.TransactionWeekInfo, len(weeks))
+	for i, w := range weeks {
+		weekStart, err := parseISOWeek(w.Week)
+		if err != nil {
+			return nil, err
+		}
+
+		weekInfos[i] = server.TransactionWeekInfo{
+			Week:       w.Week,
+			WeekStart:  weekStart,
+			Count:      w.Count,
+			DataBytes:  w.DataBytes,
+			ActiveKeys: w.ActiveKeys,
+		}
+	}
+
+	return weekInfos, nil
+}
+
+// parseISOWeek returns the Monday starting the ISO 8601 week labelled YYYY-Www. The 4th of January
+// always lies in week 01.
+func parseISOWeek(label string) (time.Time, error) {
+	var year, week int
+	_, err := fmt.Sscanf(label, "%4d-W%2d", &year, &week)
+	if err != nil || week < 1 || week > 53 {
+		return time.Time{}, errors.Errorf("invalid ISO week %q", label)
+	}
+
+	jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, time.UTC)
+	daysSinceMonday := (int(jan4.Weekday()) + 6) % 7
+
+	return jan4.AddDate(0, 0, (week-1)*7-daysSinceMonday), nil
+}
+
+// validateRange returns server.ErrInvalidRange if from is after to or to is not set. An empty
+// range with from equal to to is valid.
+func validateRange(from time.Time, to time.Time) error {
+	if to.IsZero() {
+		return errors.Wrap(server.ErrInvalidRange, "to must be set")
+	}
+
+	if from.After(to) {
+		return errors.Wrapf(server.ErrInvalidRange, "from %s is after to %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func getTransactionInfo(ctx context.Context, q queryer, from time.Time, to time.Time, granularity server.Granularity, opts server.TransactionInfoOptions) ([]server.TransactionInfo, error) {
+	isPostgres := q.DriverName() == "postgres"
+
+	source, args := bucketSource(isPostgres, opts.BucketLocation, from)
+
+	columns := bucketColumns(source, isPostgres)
+
+	// The bucket source takes the arguments from $4 on
+	where := `created_at > $2 AND created_at < $3 AND ` + notReserving
+	if opts.MinDataBytes > 0 {
+		args = append(args, opts.MinDataBytes)
+		where += ` AND data_bytes >= $` + strconv.Itoa(3+len(args))
+	}
+
+	query := `SELECT ` + columns + ` FROM transactions WHERE ` + where + ` GROUP BY timestamp`
+
+	// A running total only makes sense in ascending order
+	order := "DESC"
+	if opts.Ascending || opts.Cumulative {
+		order = "ASC"
+	}
+
+	if opts.Cumulative {
+		if isPostgres {
+			query = `SELECT b.*, SUM(b.data_bytes) OVER (ORDER BY b.timestamp) AS cumulative_data_bytes FROM (` + query + `) b`
+		}
+	}
+
+	query += ` ORDER BY timestamp ` + order + `;`
+
+	txs := make([]TransactionInfo, 0)
+	position, format := granularitySecondsToPositionAndFormat(granularity)
+
+	err := checkBucketLayout(position, format)
+	if err != nil {
+		return nil, err
+	}
+
+	args = append([]interface{}{position, from.UTC().Format(ISO8601), to.UTC().Format(ISO8601)}, args...)
+	err = sqlx.SelectContext(ctx, q, &txs, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isPostgres {
+		err = setPercentilesSqlite(ctx, q, txs, source, where, args)
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.Cumulative {
+			var cumulative int64
+			for i := range txs {
+				cumulative += txs[i].DataBytes
+				txs[i].CumulativeDataBytes = cumulative
+			}
+		}
+	}
+
+	location := time.UTC
+	if opts.BucketLocation != nil {
+		location = opts.BucketLocation
+	}
+
+	return toTransactionInfos(txs, format, location)
+}
+
+// bucketColumns returns the columns of the buckets of getTransactionInfo, grouped by the prefix of
+// source cut by SUBSTR at position $1.
+func bucketColumns(source string, isPostgres bool) string {
+	columns := `SUBSTR(` + source + `, 0, $1) AS timestamp, count(*) as count, sum(data_bytes) AS data_bytes, count(DISTINCT api_key) AS active_keys,
+	SUM(CASE WHEN is_hash <> 0 THEN 0 ELSE 1 END) AS full_count, SUM(CASE WHEN is_hash <> 0 THEN 1 ELSE 0 END) AS hash_count`
+	if isPostgres {
+		columns += `, percentile_cont(0.5) WITHIN GROUP (ORDER BY data_bytes) AS data_bytes_p50, percentile_cont(0.95) WITHIN GROUP (ORDER BY data_bytes) AS data_bytes_p95`
+	}
+
+	return columns
+}
+
+// toTransactionInfos converts the buckets read from the database, parsing their timestamps in
+// the layout of the granularity in location.
+func toTransactionInfos(txs []TransactionInfo, format string, location *time.Location) ([]server.TransactionInfo, error) {
+	txInfos := make([]server.TransactionInfo, len(txs))
+
+	for i, tx := range txs {
+		timestamp, err := parseBucketTimestamp(format, tx.Timestamp, location)
+		if err != nil {
+			return nil, err
+		}
+		txInfos[i] = server.TransactionInfo{
+			Timestamp:           timestamp,
+			Count:               tx.Count,
+			DataBytes:           tx.DataBytes,
+			DataBytesP50:        tx.DataBytesP50,
+			DataBytesP95:        tx.DataBytesP95,
+			CumulativeDataBytes: tx.CumulativeDataBytes,
+			ActiveKeys:          tx.ActiveKeys,
+			FullCount:           tx.FullCount,
+			HashCount:           tx.HashCount,
+		}
+	}
+
+	return txInfos, nil
+}
+
+// setPercentilesSqlite sets the data size percentiles of the buckets. SQLite has no percentile
+// function, so the sizes of all transactions in the range are loaded and the percentiles are
+// interpolated in the same way as percentile_cont does on PostgreSQL. The cost of this grows with
+// the number of transactions in the range rather than with the number of buckets.
+func setPercentilesSqlite(ctx context.Context, q queryer, txs []TransactionInfo, source string, where string, args []interface{}) error {
+	query := `SELECT SUBSTR(` + source + `, 0, $1) AS timestamp, data_bytes FROM transactions WHERE ` + where + ` ORDER BY timestamp, data_bytes;`
+
+	sizes := make([]struct {
+		Timestamp string `db:"timestamp"`
+		DataBytes int64  `db:"data_bytes"`
+	}, 0)
+
+	err := sqlx.SelectContext(ctx, q, &sizes, query, args...)
+	if err != nil {
+		return err
+	}
+
+	sizesByTimestamp := make(map[string][]int64)
+	for _, size := range sizes {
+		sizesByTimestamp[size.Timestamp] = append(sizesByTimestamp[size.Timestamp], size.DataBytes)
+	}
+
+	for i := range txs {
+		sorted := sizesByTimestamp[txs[i].Timestamp]
+		txs[i].DataBytesP50 = percentileCont(sorted, 0.5)
+		txs[i].DataBytesP95 = percentileCont(sorted, 0.95)
+	}
+
+	return nil
+}
+
+// bucketSource returns the expression which the buckets are cut from, with created_at shifted
+// into location, and the extra query arguments it needs from $4 on. PostgreSQL converts every row with
+// the rules of the named zone. SQLite has no time zone support, so the offset which location has
+// at from is applied to the whole range, and buckets of a range spanning a DST change are off by
+// the DST shift on one side of it.
+func bucketSource(isPostgres bool, location *time.Location, from time.Time) (string, []interface{}) {
+	if location == nil || location == time.UTC {
+		return "created_at", nil
+	}
+
+	if isPostgres {
+		return `to_char(created_at::timestamptz AT TIME ZONE $4, 'YYYY-MM-DD"T"HH24:MI:SS')`, []interface{}{location.String()}
+	}
+
+	// SQLite numbers $n placeholders in the order they appear, so the offset cannot be passed as
+	// $4 ahead of $1. It is an integer, so it is safe to put into the query.
+	_, offset := from.In(location).Zone()
+
+	return fmt.Sprintf(`strftime('%%Y-%%m-%%dT%%H:%%M:%%S', created_at, '%+d seconds')`, offset), nil
+}
+
+// percentileCont returns the percentile p of the sorted values, interpolating linearly between
+// the two nearest values like percentile_cont on PostgreSQL.
+func percentileCont(sorted []int64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	position := p * float64(len(sorted)-1)
+	lower := int(math.Floor(position))
+	if lower+1 >= len(sorted) {
+		return float64(sorted[lower])
+	}
+
+	fraction := position - float64(lower)
+
+	return float64(sorted[lower]) + fraction*float64(sorted[lower+1]-sorted[lower])
+}
+
+// parseBucketTimestamp parses a bucket cut from created_at with the layout of its granularity.
+// It also accepts a space in place of the T, as in timestamps stored by SQLite, and a bucket which
+// still has a zone or fraction of a second because created_at was written without seconds.
+func parseBucketTimestamp(layout string, value string, location *time.Location) (time.Time, error) {
+	timestamp, err := time.ParseInLocation(layout, value, location)
+	if err == nil {
+		return timestamp, nil
+	}
+
+	normalized := strings.TrimSuffix(strings.Replace(value, " ", "T", 1), "Z")
+
+	tolerantLayouts := []string{layout, layout + ".999999999"}
+	if len(normalized) < len(layout) {
+		tolerantLayouts = append(tolerantLayouts, layout[:len(normalized)])
+	}
+
+	for _, tolerant := range tolerantLayouts {
+		timestamp, tolerantErr := time.ParseInLocation(tolerant, normalized, location)
+		if tolerantErr == nil {
+			return timestamp, nil
+		}
+	}
+
+	return time.Time{}, err
+}
+
+// checkBucketLayout returns an error unless the layout parses exactly the position-1 characters
+// which SUBSTR(created_at, 0, position) cuts from a timestamp stored in the ISO8601 layout.
+func checkBucketLayout(position int, layout string) error {
+	if position < 2 || position-1 > len(ISO8601) || ISO8601[:position-1] != layout {
+		return errors.Errorf("bucket layout %q does not match SUBSTR position %d", layout, position)
+	}
+
+	return nil
+}
+
+func granularitySecondsToPositionAndFormat(granularitySeconds server.Granularity) (int, string) {
+	switch granularitySeconds {
+	case server.None:
+		return 20, "2006-01-02T15:04:05"
+	case server.Minute:
+		return 17, "2006-01-02T15:04"
+	case server.Hour:
+		return 14, "2006-01-02T15"
+	}
+
+	// Day
+	return 11, "2006-01-02"
+}
@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"taal-client/server"
+)
+
+func TestPercentileCont(t *testing.T) {
+	tt := []struct {
+		name     string
+		sorted   []int64
+		p        float64
+		expected float64
+	}{
+		{name: "empty", sorted: []int64{}, p: 0.5, expected: 0},
+		{name: "single value", sorted: []int64{7}, p: 0.95, expected: 7},
+		{name: "median of even count", sorted: []int64{1, 2, 3, 4}, p: 0.5, expected: 2.5},
+		{name: "median of odd count", sorted: []int64{1, 2, 3}, p: 0.5, expected: 2},
+		{name: "maximum", sorted: []int64{1, 2, 3}, p: 1, expected: 3},
+		{name: "minimum", sorted: []int64{1, 2, 3}, p: 0, expected: 1},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(tc.expected, percentileCont(tc.sorted, tc.p))
+		})
+	}
+}
+
+func TestGranularityPositionMatchesFormat(t *testing.T) {
+	for _, granularity := range []server.Granularity{server.None, server.Minute, server.Hour, server.Day} {
+		t.Run(strconv.Itoa(int(granularity)), func(t *testing.T) {
+			is := is.New(t)
+
+			position, format := granularitySecondsToPositionAndFormat(granularity)
+			is.NoErr(checkBucketLayout(position, format))
+			is.Equal(position-1, len(format))
+		})
+	}
+}
+
+func TestCheckBucketLayout(t *testing.T) {
+	tt := []struct {
+		name     string
+		position int
+		layout   string
+		valid    bool
+	}{
+		{name: "day", position: 11, layout: "2006-01-02", valid: true},
+		{name: "seconds", position: 20, layout: "2006-01-02T15:04:05", valid: true},
+		{name: "position too long", position: 12, layout: "2006-01-02", valid: false},
+		{name: "position too short", position: 14, layout: "2006-01-02T15:04", valid: false},
+		{name: "layout of another format", position: 14, layout: "2006-01-02 15", valid: false},
+		{name: "position beyond timestamp", position: 40, layout: "2006-01-02", valid: false},
+		{name: "zero position", position: 0, layout: "", valid: false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			err := checkBucketLayout(tc.position, tc.layout)
+			is.Equal(tc.valid, err == nil)
+		})
+	}
+}
+
+func TestParseBucketTimestamp(t *testing.T) {
+	tt := []struct {
+		name     string
+		layout   string
+		value    string
+		expected time.Time
+	}{
+		{name: "day", layout: "2006-01-02", value: "2022-07-01", expected: time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "hour", layout: "2006-01-02T15", value: "2022-07-01T10", expected: time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)},
+		{name: "space separator", layout: "2006-01-02T15:04", value: "2022-07-01 10:30", expected: time.Date(2022, 7, 1, 10, 30, 0, 0, time.UTC)},
+		{name: "without seconds", layout: "2006-01-02T15:04:05", value: "2022-07-01T10:30Z", expected: time.Date(2022, 7, 1, 10, 30, 0, 0, time.UTC)},
+		{name: "without fraction", layout: "2006-01-02T15:04:05", value: "2022-07-01T10:30:15", expected: time.Date(2022, 7, 1, 10, 30, 15, 0, time.UTC)},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			timestamp, err := parseBucketTimestamp(tc.layout, tc.value, time.UTC)
+			is.NoErr(err)
+			is.True(tc.expected.Equal(timestamp))
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		is := is.New(t)
+
+		_, err := parseBucketTimestamp("2006-01-02", "not a date", time.UTC)
+		is.True(err != nil)
+	})
+}
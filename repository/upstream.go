@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"taal-client/server"
+)
+
+// ReconcileWithUpstream compares the number of transactions stored for each active key with the
+// number returned by counter, which typically asks the upstream miner API. It returns the keys
+// where the two differ, ordered by the creation of the key.
+func (r Repository) ReconcileWithUpstream(ctx context.Context, counter func(ctx context.Context, apiKey string) (int64, error)) ([]server.CountDiscrepancy, error) {
+	query := `SELECT k.api_key, count(t.id) AS count FROM keys k LEFT JOIN transactions t ON t.api_key = k.api_key AND t.` + notReserving + `
+	WHERE k.revoked_at IS NULL GROUP BY k.api_key ORDER BY k.created_at, k.api_key;`
+
+	counts := make([]struct {
+		ApiKey string `db:"api_key"`
+		Count  int64  `db:"count"`
+	}, 0)
+
+	// The counts are read up front, so that no rows are held open while counter is called.
+	err := r.reader().SelectContext(ctx, &counts, query)
+	if err != nil {
+		return nil, err
+	}
+
+	discrepancies := make([]server.CountDiscrepancy, 0)
+
+	for _, local := range counts {
+		upstream, err := counter(ctx, local.ApiKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get upstream count of api key %s", local.ApiKey)
+		}
+
+		if upstream != local.Count {
+			discrepancies = append(discrepancies, server.CountDiscrepancy{
+				ApiKey:   local.ApiKey,
+				Local:    local.Count,
+				Upstream: upstream,
+			})
+		}
+	}
+
+	return discrepancies, nil
+}
@@ -10,7 +10,7 @@ import (
 
 func (s Server) getApiKeys(c echo.Context) error {
 	ctx := context.Background()
-	keys, err := s.repository.GetAllKeys(ctx)
+	keys, err := s.repository.GetAllKeys(ctx, false, false)
 	if err != nil {
 		return s.sendError(c, http.StatusInternalServerError, errAPIKeysFailedToGetKeys, errors.Wrap(err, "failed to get api keys"))
 	}
@@ -25,5 +25,9 @@ func (s Server) getApiKeysUsage(c echo.Context) error {
 		return s.sendError(c, http.StatusInternalServerError, errAPIKeysFailedToGetKeys, errors.Wrap(err, "failed to get api keys"))
 	}
 
+	for idx := range keys {
+		keys[idx].DataBytesHuman = FormatBytes(keys[idx].DataBytes)
+	}
+
 	return c.JSON(http.StatusOK, KeysUsage{KeysUsage: keys})
 }
@@ -0,0 +1,49 @@
+package server
+
+import "strconv"
+
+var byteUnits = []string{"KB", "MB", "GB", "TB", "PB", "EB"}
+
+// FormatBytes formats a number of bytes in binary units, so 1 KB is 1024 bytes. Values of a
+// unit are rounded to two significant digits, and from 1000 on the next unit is used.
+func FormatBytes(bytes int64) string {
+	if bytes < 0 {
+		if bytes == -bytes {
+			// -bytes overflows for the smallest int64
+			return "-8.0 EB"
+		}
+		return "-" + FormatBytes(-bytes)
+	}
+
+	if bytes < 1024 {
+		return strconv.FormatInt(bytes, 10) + " B"
+	}
+
+	value := float64(bytes) / 1024
+	unit := 0
+
+	rounded := roundSignificant(value, 2)
+
+	// Rounding may carry the value over to the next unit, as for 999.9 KB
+	for unit < len(byteUnits)-1 && rounded >= 1000 {
+		value /= 1024
+		unit++
+		rounded = roundSignificant(value, 2)
+	}
+
+	decimals := 0
+	switch {
+	case rounded < 1:
+		decimals = 2
+	case rounded < 10:
+		decimals = 1
+	}
+
+	return strconv.FormatFloat(rounded, 'f', decimals, 64) + " " + byteUnits[unit]
+}
+
+// roundSignificant rounds value to the number of significant digits.
+func roundSignificant(value float64, digits int) float64 {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(value, 'g', digits, 64), 64)
+	return rounded
+}
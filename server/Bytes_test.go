@@ -0,0 +1,41 @@
+package server
+
+import (
+	"math"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tt := []struct {
+		name     string
+		bytes    int64
+		expected string
+	}{
+		{name: "zero", bytes: 0, expected: "0 B"},
+		{name: "largest bytes", bytes: 1023, expected: "1023 B"},
+		{name: "one kilobyte", bytes: 1024, expected: "1.0 KB"},
+		{name: "fraction", bytes: 1536, expected: "1.5 KB"},
+		{name: "rounds to ten", bytes: 10*1024 - 1, expected: "10 KB"},
+		{name: "rounds to three digits", bytes: 995 * 1024 / 10, expected: "100 KB"},
+		{name: "two significant digits", bytes: 123 * 1024, expected: "120 KB"},
+		{name: "kilobytes with decimal", bytes: 1234 * 1024 / 10, expected: "120 KB"},
+		{name: "carries over at 1000", bytes: 1023 * 1024, expected: "1.0 MB"},
+		{name: "below one of the next unit", bytes: 1000 * 1024, expected: "0.98 MB"},
+		{name: "one mebibyte minus one", bytes: 1024*1024 - 1, expected: "1.0 MB"},
+		{name: "one megabyte", bytes: 1024 * 1024, expected: "1.0 MB"},
+		{name: "one gigabyte minus one", bytes: 1024*1024*1024 - 1, expected: "1.0 GB"},
+		{name: "gigabytes", bytes: 250 * 1024 * 1024 * 1024, expected: "250 GB"},
+		{name: "largest value", bytes: math.MaxInt64, expected: "8.0 EB"},
+		{name: "negative", bytes: -1536, expected: "-1.5 KB"},
+		{name: "smallest value", bytes: math.MinInt64, expected: "-8.0 EB"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(tc.expected, FormatBytes(tc.bytes))
+		})
+	}
+}
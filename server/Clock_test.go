@@ -0,0 +1,38 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestManualClock(t *testing.T) {
+	t.Run("concurrent now and advance", func(t *testing.T) {
+		is := is.New(t)
+
+		start := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+		clock := NewManualClock(start)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					clock.Advance(time.Second)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					_ = clock.Now()
+				}
+			}()
+		}
+		wg.Wait()
+
+		is.Equal(start.Add(1000*time.Second), clock.Now())
+	})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidTransaction = errors.New("invalid transaction")
+	ErrSchemaMismatch     = errors.New("database schema version mismatch")
+	ErrResultTooLarge     = errors.New("result too large, paginate the request")
+	ErrInvalidRange       = errors.New("invalid time range")
+	ErrUnsupported        = errors.New("not supported by this database")
+	ErrInvalidStatus      = errors.New("invalid transaction status")
+	ErrDecryptionFailed   = errors.New("decryption failed, wrong passphrase or corrupted data")
+	ErrInvalidDay         = errors.New("invalid day, expected YYYY-MM-DD")
+	ErrConnectionReset    = errors.New("database connection was lost and has been reset, retry the request")
+	ErrNoTransactions     = errors.New("no transactions in the time range")
+	ErrKeyCorrupt         = errors.New("private key does not match the stored public key or address")
+	ErrInvalidSortOrder   = errors.New("invalid sort order, expected asc or desc")
+	ErrDataTooLarge       = errors.New("transaction data exceeds the maximum size")
+	ErrKeyActive          = errors.New("key is active")
+	ErrInvalidAggregate   = errors.New("invalid aggregate spec")
+)
+
+// InvalidStatusError is returned for a transaction status which is not one of the
+// TransactionStatus values. It matches ErrInvalidStatus with errors.Is.
+type InvalidStatusError struct {
+	Status string
+}
+
+func (e InvalidStatusError) Error() string {
+	return fmt.Sprintf("%s: %q", ErrInvalidStatus, e.Status)
+}
+
+func (e InvalidStatusError) Unwrap() error {
+	return ErrInvalidStatus
+}
+
+// InvalidTransactionError describes which field of a transaction failed validation.
+// It matches ErrInvalidTransaction with errors.Is.
+type InvalidTransactionError struct {
+	Field  string
+	Reason string
+}
+
+func (e InvalidTransactionError) Error() string {
+	return fmt.Sprintf("%s: %s %s", ErrInvalidTransaction, e.Field, e.Reason)
+}
+
+func (e InvalidTransactionError) Unwrap() error {
+	return ErrInvalidTransaction
+}
+
+// KeyActiveError is returned for an operation which is only allowed on a revoked key. It matches
+// ErrKeyActive with errors.Is.
+type KeyActiveError struct {
+	ApiKey string
+}
+
+func (e KeyActiveError) Error() string {
+	return fmt.Sprintf("%s: %s must be revoked first", ErrKeyActive, e.ApiKey)
+}
+
+func (e KeyActiveError) Unwrap() error {
+	return ErrKeyActive
+}
+
+// ConnectionResetError is returned for a query which failed on a dead database connection, after
+// the connections have been reset. It matches ErrConnectionReset with errors.Is and unwraps to the
+// error of the query.
+type ConnectionResetError struct {
+	Err error
+}
+
+func (e ConnectionResetError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrConnectionReset, e.Err)
+}
+
+func (e ConnectionResetError) Unwrap() error {
+	return e.Err
+}
+
+func (e ConnectionResetError) Is(target error) bool {
+	return target == ErrConnectionReset
+}
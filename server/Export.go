@@ -0,0 +1,47 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const mimeApplicationJSONLines = "application/jsonl"
+
+// exportTransactions streams the transactions between the RFC3339 query parameters from and to as
+// JSON Lines. Without from all transactions up to to are exported, without to all transactions
+// from from up to now are exported.
+func (s Server) exportTransactions(c echo.Context) error {
+	from := time.Unix(0, 0)
+	to := time.Now()
+
+	if fromParam := c.QueryParam("from"); fromParam != "" {
+		fromParsed, err := time.Parse(time.RFC3339, fromParam)
+		if err != nil {
+			return s.sendError(c, http.StatusBadRequest, errExportTransactionsInvalidFrom, errors.Wrapf(err, "given value for from parameter is %s, but must be RFC3339", fromParam))
+		}
+		from = fromParsed
+	}
+
+	if toParam := c.QueryParam("to"); toParam != "" {
+		toParsed, err := time.Parse(time.RFC3339, toParam)
+		if err != nil {
+			return s.sendError(c, http.StatusBadRequest, errExportTransactionsInvalidTo, errors.Wrapf(err, "given value for to parameter is %s, but must be RFC3339", toParam))
+		}
+		to = toParsed
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, mimeApplicationJSONLines)
+	c.Response().WriteHeader(http.StatusOK)
+
+	// The status has already been sent, so a failure can only be logged and ends the stream early.
+	err := s.repository.ExportTransactionsJSONL(c.Request().Context(), c.Response(), from, to)
+	if err != nil {
+		log.Printf("WARN: failed to export transactions: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,17 @@
+package server
+
+import "context"
+
+type requestIDContextKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the id of the request it belongs to, so that the
+// repository can include it in what it logs and reports.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// RequestIDFromContext returns the request id set with WithRequestID, or "" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
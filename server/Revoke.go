@@ -12,7 +12,7 @@ func (s Server) deactivate(c echo.Context) error {
 	apiKey := c.Param("apikey")
 
 	ctx := context.Background()
-	err := s.repository.DeactivateKey(ctx, apiKey)
+	err := s.repository.DeactivateKey(ctx, apiKey, c.QueryParam("reason"))
 	if err != nil {
 		s.sendError(c, http.StatusInternalServerError, errAPIKeysRevoke, errors.Wrap(err, "revoke failed"))
 	}
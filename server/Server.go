@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -23,13 +24,14 @@ import (
 type Repository interface {
 	InsertKey(ctx context.Context, key Key) error
 	GetKey(ctx context.Context, apiKey string) (Key, error)
-	GetAllKeys(ctx context.Context) ([]Key, error)
+	GetAllKeys(ctx context.Context, includeRevoked bool, revokedOnly bool) ([]Key, error)
 	GetAllKeysUsage(ctx context.Context) ([]KeyUsage, error)
 	InsertTransaction(ctx context.Context, tx Transaction) error
 	GetAllTransactions(ctx context.Context, all bool, hoursBack int) ([]Transaction, error)
 	GetTransactionInfo(ctx context.Context, from time.Time, to time.Time, granularity Granularity) ([]TransactionInfo, error)
 	GetTransaction(ctx context.Context, txid string) (*Transaction, error)
-	DeactivateKey(ctx context.Context, apikey string) error
+	ExportTransactionsJSONL(ctx context.Context, w io.Writer, from time.Time, to time.Time) error
+	DeactivateKey(ctx context.Context, apikey string, reason string) error
 	Health(ctx context.Context) error
 }
 
@@ -106,6 +108,7 @@ func New(address string, taal *client.Client, repo Repository) Server {
 	group.GET("/transactions/:txid", s.read)
 	group.GET("/transactions/", s.getTransactions)
 	group.GET("/transactions/info", s.getTransactionInfo)
+	group.GET("/transactions/export", s.exportTransactions)
 
 	group.GET("/health", func(c echo.Context) error {
 		err := s.repository.Health(context.Background())
@@ -83,6 +83,10 @@ func (s Server) getTransactionInfo(c echo.Context) error {
 	}
 	sort.SliceStable(txsWithGaps, func(i, j int) bool { return txsWithGaps[i].Timestamp.Before(txsWithGaps[j].Timestamp) })
 
+	for idx := range txsWithGaps {
+		txsWithGaps[idx].DataBytesHuman = FormatBytes(txsWithGaps[idx].DataBytes)
+	}
+
 	return c.JSON(http.StatusOK, TransactionInfos{
 		Transactions: txsWithGaps,
 		TimeUnit:     getTimeUnitFromGranularity(granularity),
@@ -112,11 +112,14 @@ func (s Server) write(c echo.Context) error {
 
 	log.Printf("Data tx ID: %s", dataTx.GetTxID())
 
+	contentHash := sha256.Sum256(reqBody)
+
 	tx := Transaction{
-		ID:        dataTx.GetTxID(),
-		ApiKey:    apiKey,
-		DataBytes: len(dataTx.ToBytes()),
-		Filename:  c.Request().Header.Get(HeaderFilename),
+		ID:          dataTx.GetTxID(),
+		ApiKey:      apiKey,
+		DataBytes:   int64(len(dataTx.ToBytes())),
+		Filename:    c.Request().Header.Get(HeaderFilename),
+		ContentHash: hex.EncodeToString(contentHash[:]),
 	}
 
 	switch mode {
@@ -36,4 +36,6 @@ const (
 	errPutSettingsGetDuration                    = 37
 	errPutSettingsBind                           = 38
 	errPutSettingsGetJson                        = 39
+	errExportTransactionsInvalidFrom             = 40
+	errExportTransactionsInvalidTo               = 41
 )
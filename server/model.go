@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/hex"
+	"log"
 	"time"
 
 	"github.com/bitcoinsv/bsvd/bsvec"
@@ -11,12 +12,60 @@ import (
 )
 
 type Key struct {
-	ApiKey     string  `db:"api_key" json:"api_key"`
-	PublicKey  string  `db:"public_key" json:"public_key"`
-	PrivateKey string  `db:"private_key" json:"-"`
-	Address    string  `db:"address" json:"address"`
-	CreatedAt  string  `db:"created_at" json:"createdAt"`
-	RevokedAt  *string `db:"revoked_at" json:"revokedAt"`
+	ApiKey        string  `db:"api_key" json:"api_key"`
+	PublicKey     string  `db:"public_key" json:"public_key"`
+	PrivateKey    string  `db:"private_key" json:"-"`
+	Address       string  `db:"address" json:"address"`
+	CreatedAt     string  `db:"created_at" json:"createdAt"`
+	RevokedAt     *string `db:"revoked_at" json:"revokedAt"`
+	RevokedReason *string `db:"revoked_reason" json:"revokedReason"`
+	// PrivateKeyEncrypted reports whether the private key is stored encrypted. PrivateKey is
+	// returned decrypted either way.
+	PrivateKeyEncrypted bool `db:"private_key_encrypted" json:"-"`
+}
+
+// KeyMeta is a Key without its public and private key, for checking a key without loading them.
+type KeyMeta struct {
+	ApiKey    string  `db:"api_key" json:"api_key"`
+	Address   string  `db:"address" json:"address"`
+	CreatedAt string  `db:"created_at" json:"createdAt"`
+	RevokedAt *string `db:"revoked_at" json:"revokedAt"`
+}
+
+// KeyFilter selects keys for QueryKeys. Zero fields do not filter.
+type KeyFilter struct {
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Revoked selects only revoked keys if true and only active keys if false.
+	Revoked       *bool
+	AddressPrefix string
+	Limit         int
+	// Offset skips keys of the result and is only used together with Limit.
+	Offset int
+}
+
+// SortOrder orders results by creation time.
+type SortOrder string
+
+const (
+	SortAscending  SortOrder = "asc"
+	SortDescending SortOrder = "desc"
+)
+
+// TransactionFilter selects transactions for QueryTransactions. Zero fields do not filter.
+type TransactionFilter struct {
+	From     time.Time
+	To       time.Time
+	MinBytes int64
+	MaxBytes int64
+	ApiKey   string
+	// IsHash selects only hash transactions if true and only full data transactions if false.
+	IsHash *bool
+	Limit  int
+	// Offset skips transactions of the result and is only used together with Limit.
+	Offset int
+	// SortOrder defaults to SortDescending, newest first.
+	SortOrder SortOrder
 }
 
 type Keys struct {
@@ -26,26 +75,262 @@ type Keys struct {
 type KeyUsage struct {
 	Key
 	DataBytes int64 `db:"data_bytes" json:"dataBytes"`
+	// RecentDataBytes is only set by GetAllKeysUsageSince.
+	RecentDataBytes int64 `db:"recent_data_bytes" json:"recentDataBytes"`
+	// TransactionCount is only set by GetKeyWithUsage.
+	TransactionCount int64 `db:"transaction_count" json:"transactionCount"`
+	// TotalFees is the sum of the fees of the transactions of the key, 0 if none recorded a fee.
+	TotalFees int64 `db:"total_fees" json:"totalFees"`
+	// DataBytesHuman is DataBytes formatted by FormatBytes.
+	DataBytesHuman string `db:"-" json:"dataBytesHuman"`
 }
 
 type KeysUsage struct {
 	KeysUsage []KeyUsage `json:"key_usages"`
 }
 
+// FilenameCount is the number of transactions written with a filename.
+type FilenameCount struct {
+	Filename string `db:"filename" json:"filename"`
+	Count    int    `db:"count" json:"count"`
+}
+
+// EnrichedTransaction is a transaction together with the public parts of the key it was written
+// with. Secret and SecretHash are always empty.
+type EnrichedTransaction struct {
+	Transaction
+	Address   string `db:"address" json:"address"`
+	PublicKey string `db:"public_key" json:"publicKey"`
+}
+
+// KeyUsageShare is the share of an api key in the data bytes of all transactions.
+type KeyUsageShare struct {
+	ApiKey    string  `db:"api_key" json:"apiKey"`
+	DataBytes int64   `db:"data_bytes" json:"dataBytes"`
+	Percent   float64 `db:"percent" json:"percent"`
+}
+
+// BalanceDiscrepancy is a key whose address has a different balance than expected.
+type BalanceDiscrepancy struct {
+	ApiKey   string `json:"apiKey"`
+	Address  string `json:"address"`
+	Expected int64  `json:"expected"`
+	Actual   int64  `json:"actual"`
+}
+
+// CountDiscrepancy is a key for which the upstream API reports a different number of
+// transactions than are stored locally.
+type CountDiscrepancy struct {
+	ApiKey   string `json:"apiKey"`
+	Local    int64  `json:"local"`
+	Upstream int64  `json:"upstream"`
+}
+
+// Gap is the idle interval between two consecutive writes of a key.
+type Gap struct {
+	From     time.Time     `json:"from"`
+	To       time.Time     `json:"to"`
+	Duration time.Duration `json:"duration"`
+}
+
+// ConsistencyReport lists the rows found by the consistency check.
+type ConsistencyReport struct {
+	// OrphanedTransactions are transactions whose api key does not exist.
+	OrphanedTransactions ConsistencyIssue `json:"orphanedTransactions"`
+	// DuplicateAddresses are keys sharing their address with another key.
+	DuplicateAddresses ConsistencyIssue `json:"duplicateAddresses"`
+	// FutureTransactions and FutureKeys were created after the time of the check.
+	FutureTransactions ConsistencyIssue `json:"futureTransactions"`
+	FutureKeys         ConsistencyIssue `json:"futureKeys"`
+	// MalformedAddresses are keys whose address is rejected by the validator set with
+	// WithAddressValidator. It is empty if none is set.
+	MalformedAddresses ConsistencyIssue `json:"malformedAddresses"`
+}
+
+// ConsistencyIssue is the number of rows with an issue and the ids of some of them.
+type ConsistencyIssue struct {
+	Count     int      `json:"count"`
+	SampleIDs []string `json:"sampleIds"`
+}
+
+// MaintenanceConfig configures the maintenance run periodically by the repository.
+type MaintenanceConfig struct {
+	// Interval is the time between two maintenance runs.
+	Interval time.Duration
+	// Retention is how long transactions are kept. Zero keeps them forever.
+	Retention time.Duration
+	// Optimize reclaims space and updates the query planner statistics after the delete.
+	Optimize bool
+	// Logger receives the results of each run if set.
+	Logger *log.Logger
+}
+
+// AuditEntry is a record of a write to the keys or transactions.
+type AuditEntry struct {
+	ID        int64  `db:"id" json:"id"`
+	CreatedAt string `db:"created_at" json:"createdAt"`
+	Operation string `db:"operation" json:"operation"`
+	TargetID  string `db:"target_id" json:"targetId"`
+	Actor     string `db:"actor" json:"actor"`
+}
+
 type Transaction struct {
+	ID         string `db:"id" json:"id"`
+	ApiKey     string `db:"api_key" json:"api_key"`
+	DataBytes  int64  `db:"data_bytes" json:"data_bytes"`
+	CreatedAt  string `db:"created_at" json:"created_at"`
+	Filename   string `db:"filename" json:"filename"`
+	Secret     string `db:"secret" json:"secret"`
+	SecretHash string `db:"secret_hash" json:"-"`
+	IsHash     bool   `db:"is_hash" json:"isHash"`
+	// ContentHash is the hex encoded SHA-256 of the written data. It is empty for transactions
+	// written before it was recorded.
+	ContentHash string `db:"content_hash" json:"contentHash"`
+	// Status is one of the TransactionStatus values and StatusAt the time it was last changed.
+	Status   string  `db:"status" json:"status"`
+	StatusAt *string `db:"status_at" json:"statusAt"`
+	// ReplacedBy is the id of the transaction which was broadcast in place of this one.
+	ReplacedBy *string `db:"replaced_by" json:"replacedBy"`
+	// IdempotencyKey is the key the transaction was stored with by InsertTransactionIdempotent.
+	IdempotencyKey *string `db:"idempotency_key" json:"-"`
+	// Metadata is the JSON document set by SetTransactionMetadata.
+	Metadata *string `db:"metadata" json:"-"`
+	// FeeSatoshis is the mining fee paid for the transaction. It is 0 for transactions written
+	// before it was recorded.
+	FeeSatoshis int64 `db:"fee_satoshis" json:"feeSatoshis"`
+}
+
+// TransactionSummary is the part of a Transaction shown in lists. It leaves out the secret.
+type TransactionSummary struct {
 	ID        string `db:"id" json:"id"`
 	ApiKey    string `db:"api_key" json:"api_key"`
-	DataBytes int    `db:"data_bytes" json:"data_bytes"`
-	CreatedAt string `db:"created_at" json:"created_at"`
+	DataBytes int64  `db:"data_bytes" json:"data_bytes"`
 	Filename  string `db:"filename" json:"filename"`
-	Secret    string `db:"secret" json:"secret"`
-	IsHash    bool   `db:"is_hash" json:"isHash"`
+	CreatedAt string `db:"created_at" json:"created_at"`
+}
+
+// The states of a transaction. InsertTransaction stores it as broadcast, and ReserveTransaction
+// as reserving until it is broadcast. Pending is left to callers which store a transaction before
+// broadcasting it.
+const (
+	TransactionStatusReserving = "reserving"
+	TransactionStatusPending   = "pending"
+	TransactionStatusBroadcast = "broadcast"
+	TransactionStatusConfirmed = "confirmed"
+	TransactionStatusRejected  = "rejected"
+)
+
+// ValidTransactionStatus reports whether status is one of the TransactionStatus values.
+func ValidTransactionStatus(status string) bool {
+	switch status {
+	case TransactionStatusReserving, TransactionStatusPending, TransactionStatusBroadcast, TransactionStatusConfirmed, TransactionStatusRejected:
+		return true
+	}
+
+	return false
 }
 
 type TransactionInfo struct {
-	Timestamp time.Time `json:"timestamp"`
-	Count     int       `json:"count"`
-	DataBytes int       `json:"data_bytes"`
+	// Timestamp is the start of the bucket with its location set to UTC, or to
+	// TransactionInfoOptions.BucketLocation if given, so that it is encoded with its zone.
+	Timestamp           time.Time `json:"timestamp"`
+	Count               int       `json:"count"`
+	DataBytes           int64     `json:"data_bytes"`
+	DataBytesP50        float64   `json:"data_bytes_p50"`
+	DataBytesP95        float64   `json:"data_bytes_p95"`
+	CumulativeDataBytes int64     `json:"cumulative_data_bytes"`
+	ActiveKeys          int       `json:"active_keys"`
+	// FullCount and HashCount split Count into the transactions with the full data and the ones
+	// with only its hash.
+	FullCount int `json:"full_count"`
+	HashCount int `json:"hash_count"`
+	// DataBytesHuman is DataBytes formatted by FormatBytes.
+	DataBytesHuman string `json:"data_bytes_human"`
+}
+
+// TransactionInfoComparison is a bucket of GetTransactionInfoWithComparison next to the bucket at
+// the same offset in the preceding window. Current and Previous are zero apart from Timestamp if
+// the window has no transactions in that bucket.
+type TransactionInfoComparison struct {
+	// Offset is the distance of both buckets from the start of their window.
+	Offset   time.Duration   `json:"offset"`
+	Current  TransactionInfo `json:"current"`
+	Previous TransactionInfo `json:"previous"`
+	// CountChangePercent and DataBytesChangePercent are the change from Previous to Current in
+	// percent, nil if Previous has no transactions.
+	CountChangePercent     *float64 `json:"count_change_percent"`
+	DataBytesChangePercent *float64 `json:"data_bytes_change_percent"`
+}
+
+// Aggregate is a value RunAggregate computes over transactions.
+type Aggregate string
+
+const (
+	AggregateCount        Aggregate = "count"
+	AggregateSumDataBytes Aggregate = "sum_data_bytes"
+	AggregateAvgDataBytes Aggregate = "avg_data_bytes"
+	AggregateMaxDataBytes Aggregate = "max_data_bytes"
+	AggregateActiveKeys   Aggregate = "active_keys"
+)
+
+// AggregateDimension is a column RunAggregate groups transactions by.
+type AggregateDimension string
+
+const (
+	DimensionNone   AggregateDimension = ""
+	DimensionApiKey AggregateDimension = "api_key"
+	DimensionIsHash AggregateDimension = "is_hash"
+	DimensionStatus AggregateDimension = "status"
+	DimensionDay    AggregateDimension = "day"
+)
+
+// AggregateSpec selects the aggregate computed by RunAggregate over the transactions created at
+// or after From and before To, optionally per value of GroupBy.
+type AggregateSpec struct {
+	Aggregate Aggregate
+	GroupBy   AggregateDimension
+	From      time.Time
+	To        time.Time
+}
+
+// TransactionWeekInfo is the number and size of the transactions in one ISO 8601 week, which
+// starts on Monday. Week is labelled YYYY-Www with the ISO week-numbering year, so the last days
+// of December can belong to week 01 of the next year and the first days of January to week 52 or
+// 53 of the previous one.
+type TransactionWeekInfo struct {
+	Week       string    `json:"week"`
+	WeekStart  time.Time `json:"week_start"`
+	Count      int       `json:"count"`
+	DataBytes  int64     `json:"data_bytes"`
+	ActiveKeys int       `json:"active_keys"`
+}
+
+// TransactionInfoOptions adjust the buckets returned for transaction information.
+type TransactionInfoOptions struct {
+	// Cumulative sets CumulativeDataBytes to the running total of the data bytes and returns
+	// the buckets in ascending order.
+	Cumulative bool
+	// Ascending returns the buckets oldest first instead of newest first.
+	Ascending bool
+	// MinDataBytes only counts the transactions with at least this many data bytes if set.
+	MinDataBytes int64
+	// BucketLocation cuts the buckets at the boundaries of this time zone instead of UTC. It must
+	// be a named zone such as Asia/Tokyo, as PostgreSQL looks it up by name.
+	BucketLocation *time.Location
+}
+
+// TransactionInfoColumns holds TransactionInfo buckets as parallel slices, where index i of each
+// slice belongs to the same bucket.
+type TransactionInfoColumns struct {
+	Timestamps []time.Time `json:"timestamps"`
+	Counts     []int       `json:"counts"`
+	DataBytes  []int64     `json:"data_bytes"`
+	ActiveKeys []int       `json:"active_keys"`
+}
+
+type TransactionInfoSummary struct {
+	TotalCount     int   `db:"count" json:"total_count"`
+	TotalDataBytes int64 `db:"data_bytes" json:"total_data_bytes"`
 }
 
 type TransactionInfos struct {
@@ -76,6 +361,40 @@ func GetKeyFromPrivateKey(apiKey string, pk *bsvec.PrivateKey) (Key, error) {
 	return key, nil
 }
 
+// BSVKeyDeriver derives the public key and mainnet address of a hex encoded private key in the
+// same way as GetKeyFromPrivateKey.
+type BSVKeyDeriver struct{}
+
+func (BSVKeyDeriver) DeriveKey(privateKey string) (publicKey string, address string, err error) {
+	pk, err := GetPrivateKey(privateKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err := GetKeyFromPrivateKey("", pk)
+	if err != nil {
+		return "", "", err
+	}
+
+	return key.PublicKey, key.Address, nil
+}
+
+// BSVAddressValidator accepts the mainnet addresses produced by GetKeyFromPrivateKey.
+type BSVAddressValidator struct{}
+
+func (BSVAddressValidator) ValidateAddress(address string) error {
+	decoded, err := bsvutil.DecodeAddress(address, &chaincfg.MainNetParams)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode address %s", address)
+	}
+
+	if !decoded.IsForNet(&chaincfg.MainNetParams) {
+		return errors.Errorf("address %s is not a mainnet address", address)
+	}
+
+	return nil
+}
+
 func GetPrivateKey(privateKey string) (*bsvec.PrivateKey, error) {
 	privateKeyDecoded, err := hex.DecodeString(privateKey)
 	if err != nil {